@@ -0,0 +1,274 @@
+// ----------------------------------------------------------------------------
+// Embedded MQTT broker
+// In-process broker with listeners, users, topic permissions, retained
+// messages, and an optional bridge to an upstream broker
+// Contact: Hugo Cruz - hugo.m.cruz@gmail.com
+// ----------------------------------------------------------------------------
+
+package broker
+
+import (
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+	log "github.com/sirupsen/logrus"
+)
+
+//Config - Embedded broker, disabled by default
+type Config struct {
+	Enabled        bool
+	Listeners      []ListenerConfig
+	Users          []UserConfig
+	AllowAnonymous bool
+	Bridge         BridgeConfig
+}
+
+//ListenerConfig - Address where the broker accepts clients. TLS with a certificate and key.
+type ListenerConfig struct {
+	Type    string `default:"tcp" validate:"oneof=tcp ws"`
+	Address string `validate:"required"`
+	TLSCert string
+	TLSKey  string
+}
+
+//UserConfig - User of the broker. Empty topic lists allow all the topics.
+type UserConfig struct {
+	Username    string `validate:"required"`
+	Password    string `secret:"true"`
+	ReadTopics  []string
+	WriteTopics []string
+}
+
+//BridgeConfig - Upstream broker where the messages of Topics are forwarded
+type BridgeConfig struct {
+	URL      string `validate:"url"`
+	ClientID string
+	Username string
+	Password string `secret:"true"`
+	Topics   []string
+	QoS      int `default:"1" validate:"min=0,max=2"`
+}
+
+//AllowFunc - Check of a message forwarded by the bridge, e.g. against a data quota
+type AllowFunc func(topic string, size int, qos byte) bool
+
+//Broker - Running embedded broker
+type Broker struct {
+	server   *mqtt.Server
+	upstream paho.Client
+	allow    AllowFunc
+	mutex    sync.Mutex
+	pending  []paho.Token
+}
+
+//Start - Start the listeners and the bridge. clientID is the default client ID of the bridge.
+//allow is checked before each forward to the upstream broker, nil forwards all the messages.
+func Start(config Config, clientID string, allow AllowFunc) (*Broker, error) {
+	server := mqtt.New(&mqtt.Options{
+		InlineClient: true,
+		Logger:       slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelError})),
+	})
+
+	if err := server.AddHook(&accessHook{config: config}, nil); err != nil {
+		return nil, err
+	}
+
+	listenerConfigs := config.Listeners
+	if len(listenerConfigs) == 0 {
+		listenerConfigs = []ListenerConfig{{Type: "tcp", Address: ":1883"}}
+	}
+
+	for _, lc := range listenerConfigs {
+		l, err := newListener(lc)
+		if err != nil {
+			return nil, err
+		}
+		if err := server.AddListener(l); err != nil {
+			return nil, errors.New("broker listener " + lc.Address + ": " + err.Error())
+		}
+		log.Info("Embedded broker listening on ", lc.Type, " ", lc.Address)
+	}
+
+	if err := server.Serve(); err != nil {
+		return nil, err
+	}
+
+	b := &Broker{server: server, allow: allow}
+	if config.Bridge.URL != "" {
+		if err := b.bridge(config.Bridge, clientID); err != nil {
+			server.Close()
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+func newListener(lc ListenerConfig) (listeners.Listener, error) {
+	lconfig := listeners.Config{ID: lc.Type + "-" + lc.Address, Address: lc.Address}
+
+	if lc.TLSCert != "" {
+		certificate, err := tls.LoadX509KeyPair(lc.TLSCert, lc.TLSKey)
+		if err != nil {
+			return nil, errors.New("broker listener " + lc.Address + ": " + err.Error())
+		}
+		lconfig.TLSConfig = &tls.Config{Certificates: []tls.Certificate{certificate}}
+	}
+
+	if lc.Type == "ws" {
+		return listeners.NewWebsocket(lconfig), nil
+	}
+	return listeners.NewTCP(lconfig), nil
+}
+
+// Forward the messages of the bridge topics to the upstream broker, keeping
+// their topic and retained flag
+func (b *Broker) bridge(config BridgeConfig, clientID string) error {
+	if config.ClientID != "" {
+		clientID = config.ClientID
+	}
+
+	opts := paho.NewClientOptions().AddBroker(config.URL).SetClientID(clientID)
+	opts.SetUsername(config.Username)
+	opts.SetPassword(config.Password)
+	opts.SetAutoReconnect(true)
+	opts.SetConnectRetry(true)
+	opts.SetMaxReconnectInterval(time.Minute)
+	opts.SetOnConnectHandler(func(c paho.Client) {
+		log.Info("Broker bridge connected to ", config.URL)
+	})
+	opts.SetConnectionLostHandler(func(c paho.Client, err error) {
+		log.Warn("Broker bridge lost the connection to ", config.URL, ": ", err.Error())
+	})
+
+	b.upstream = paho.NewClient(opts)
+	b.upstream.Connect()
+
+	// Messages with QoS 1 and 2 wait in memory while the upstream broker is not connected
+	qos := byte(config.QoS)
+	for i, filter := range config.Topics {
+		err := b.server.Subscribe(filter, i+1, func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+			b.forward(pk.TopicName, qos, pk.FixedHeader.Retain, pk.Payload)
+		})
+		if err != nil {
+			return errors.New("broker bridge topic " + filter + ": " + err.Error())
+		}
+		log.Info("Broker bridge forwards ", filter, " to ", config.URL)
+	}
+	return nil
+}
+
+//Close - Wait until the deadline for the messages forwarded by the bridge, disconnect the clients and the bridge, and stop the listeners
+func (b *Broker) Close(deadline time.Time) {
+	if b.upstream != nil {
+		b.waitForwards(deadline)
+		b.upstream.Disconnect(250)
+	}
+	b.server.Close()
+}
+
+// Publish a message to the upstream broker when allowed, keeping the token
+// until it completes
+func (b *Broker) forward(topic string, qos byte, retained bool, payload []byte) {
+	if b.allow != nil && !b.allow(topic, len(payload), qos) {
+		return
+	}
+
+	token := b.upstream.Publish(topic, qos, retained, payload)
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	remaining := b.pending[:0]
+	for _, t := range b.pending {
+		select {
+		case <-t.Done():
+		default:
+			remaining = append(remaining, t)
+		}
+	}
+	b.pending = append(remaining, token)
+}
+
+// Wait for the forwards in progress until the deadline
+func (b *Broker) waitForwards(deadline time.Time) {
+	b.mutex.Lock()
+	pending := b.pending
+	b.pending = nil
+	b.mutex.Unlock()
+
+	for _, token := range pending {
+		if !token.WaitTimeout(time.Until(deadline)) {
+			log.Warn(len(pending), " messages of the broker bridge not acknowledged before the shutdown timeout")
+			return
+		}
+	}
+}
+
+// Authentication of the users and permissions on the topics
+type accessHook struct {
+	mqtt.HookBase
+	config Config
+}
+
+func (h *accessHook) ID() string {
+	return "dump1090-access"
+}
+
+func (h *accessHook) Provides(b byte) bool {
+	return b == mqtt.OnConnectAuthenticate || b == mqtt.OnACLCheck
+}
+
+// Known users with their password, clients without user when anonymous access is allowed
+func (h *accessHook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	username := string(pk.Connect.Username)
+	if username == "" {
+		return h.config.AllowAnonymous
+	}
+
+	if user, ok := h.user(username); ok {
+		if user.Password == string(pk.Connect.Password) {
+			return true
+		}
+	}
+	log.Warn("Embedded broker rejected user ", username, " from ", cl.Net.Remote)
+	return false
+}
+
+func (h *accessHook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	user, ok := h.user(string(cl.Properties.Username))
+	if !ok {
+		// Anonymous clients have access to all the topics
+		return true
+	}
+
+	filters := user.ReadTopics
+	if write {
+		filters = user.WriteTopics
+	}
+	if len(filters) == 0 {
+		return true
+	}
+	for _, filter := range filters {
+		if auth.RString(filter).FilterMatches(topic) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *accessHook) user(username string) (UserConfig, bool) {
+	for _, user := range h.config.Users {
+		if user.Username == username {
+			return user, true
+		}
+	}
+	return UserConfig{}, false
+}
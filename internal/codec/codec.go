@@ -0,0 +1,81 @@
+// ----------------------------------------------------------------------------
+// Batch payload codecs
+// The publisher encodes the batches, the subscribers detect the codec
+// Contact: Hugo Cruz - hugo.m.cruz@gmail.com
+// ----------------------------------------------------------------------------
+
+package codec
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io/ioutil"
+)
+
+// Codec names in the configuration
+const (
+	Gzip = "gzip"
+	Zlib = "zlib"
+	None = "none"
+)
+
+//Valid - Check if the codec name is known. Empty means gzip.
+func Valid(codec string) bool {
+	switch codec {
+	case "", Gzip, Zlib, None:
+		return true
+	}
+	return false
+}
+
+//Encode - Compress the data with the codec
+func Encode(data []byte, codec string) ([]byte, error) {
+	var b bytes.Buffer
+
+	switch codec {
+	case "", Gzip:
+		gz := gzip.NewWriter(&b)
+		if _, err := gz.Write(data); err != nil {
+			return nil, err
+		}
+		if err := gz.Close(); err != nil {
+			return nil, err
+		}
+	case Zlib:
+		zw := zlib.NewWriter(&b)
+		if _, err := zw.Write(data); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+	case None:
+		return data, nil
+	default:
+		return nil, errors.New("unknown codec " + codec)
+	}
+
+	return b.Bytes(), nil
+}
+
+//Decode - Decompress a payload, detecting the codec from the first bytes.
+// Plain records always start with a digit.
+func Decode(payload []byte) ([]byte, error) {
+	switch {
+	case len(payload) >= 2 && payload[0] == 0x1f && payload[1] == 0x8b:
+		r, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(r)
+	case len(payload) >= 2 && payload[0] == 0x78 && (uint16(payload[0])<<8|uint16(payload[1]))%31 == 0:
+		r, err := zlib.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(r)
+	}
+	return payload, nil
+}
@@ -0,0 +1,84 @@
+package codec
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestValid(t *testing.T) {
+	tests := []struct {
+		codec string
+		valid bool
+	}{
+		{"", true},
+		{Gzip, true},
+		{Zlib, true},
+		{None, true},
+		{"lz4", false},
+		{"GZIP", false},
+	}
+
+	for _, tt := range tests {
+		if got := Valid(tt.codec); got != tt.valid {
+			t.Errorf("Valid(%q) = %v, want %v", tt.codec, got, tt.valid)
+		}
+	}
+}
+
+func TestEncodeDecode(t *testing.T) {
+	records := []byte("#batch station=sgn1 seq=1\nMSG,3,1,1,ABC123,1\nMSG,3,1,1,ABC123,1\n")
+
+	tests := []struct {
+		codec  string
+		prefix []byte
+	}{
+		{"", []byte{0x1f, 0x8b}},
+		{Gzip, []byte{0x1f, 0x8b}},
+		{Zlib, []byte{0x78}},
+		{None, records[:1]},
+	}
+
+	for _, tt := range tests {
+		encoded, err := Encode(records, tt.codec)
+		if err != nil {
+			t.Fatalf("Encode(%q): %v", tt.codec, err)
+		}
+		if !bytes.HasPrefix(encoded, tt.prefix) {
+			t.Errorf("Encode(%q) starts with %x, want %x", tt.codec, encoded[:2], tt.prefix)
+		}
+
+		decoded, err := Decode(encoded)
+		if err != nil || !bytes.Equal(decoded, records) {
+			t.Errorf("Decode of %q: %q (%v), want the records", tt.codec, decoded, err)
+		}
+	}
+
+	if _, err := Encode(records, "lz4"); err == nil {
+		t.Error("no error for an unknown codec")
+	}
+}
+
+func TestDecodePlain(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+	}{
+		{"records", []byte("3,1000,ABC123\n")},
+		{"empty", []byte{}},
+		{"x without zlib header", []byte("x1")},
+	}
+
+	for _, tt := range tests {
+		decoded, err := Decode(tt.payload)
+		if err != nil || !bytes.Equal(decoded, tt.payload) {
+			t.Errorf("%s: Decode = %q (%v), want the payload as it is", tt.name, decoded, err)
+		}
+	}
+}
+
+func TestDecodeCorrupt(t *testing.T) {
+	encoded, _ := Encode([]byte("3,1000,ABC123\n"), Gzip)
+	if _, err := Decode(encoded[:len(encoded)-4]); err == nil {
+		t.Error("no error for a truncated gzip payload")
+	}
+}
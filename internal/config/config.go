@@ -0,0 +1,113 @@
+// ----------------------------------------------------------------------------
+// Configuration loader shared by the publisher and the subscribers
+// JSON file, environment overrides, secrets from files, defaults and validation
+// Contact: Hugo Cruz - hugo.m.cruz@gmail.com
+// ----------------------------------------------------------------------------
+
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//MQTT - Settings common to all the binaries, embedded in their Configuration.
+// Defaults and validation rules are in the struct tags.
+type MQTT struct {
+	MQTTServerURL string `validate:"required,url"`
+	MQTTClientID  string `validate:"required"`
+	MQTTTopic     string `validate:"required"`
+	MQTTQos       int    `validate:"min=0,max=2"`
+	MQTTUsername  string
+	MQTTPassword  string `secret:"true"`
+	MQTTHeaders   map[string]string
+	MQTTProxy     string `secret:"true" validate:"url"`
+	StatusTopic   string
+	LogLevel      string `default:"INFO" validate:"oneof=DEBUG INFO WARN ERROR"`
+}
+
+//PathFlag - The -config command line flag
+func PathFlag() *string {
+	return flag.String("config", "config.json", "path of the configuration file")
+}
+
+//Load - Read the configuration file into cfg (a pointer to a struct).
+// Environment variables PREFIX_FIELD_NAME override the fields, PREFIX_FIELD_NAME_FILE
+// read them from a file. Secret fields also accept "file:/path" values.
+func Load(path string, prefix string, cfg interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(cfg); err != nil {
+		return errors.New(path + ": " + describeJSONError(data, err))
+	}
+
+	if err := applyEnvironment(cfg, prefix); err != nil {
+		return err
+	}
+	if err := readSecrets(cfg); err != nil {
+		return err
+	}
+
+	applyDefaults(cfg)
+
+	return Validate(cfg)
+}
+
+// JSON errors with line and column
+func describeJSONError(data []byte, err error) string {
+	var offset int64
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		offset = e.Offset
+	case *json.UnmarshalTypeError:
+		offset = e.Offset
+	default:
+		return err.Error()
+	}
+
+	line, column := 1, 1
+	for _, b := range data[:offset] {
+		if b == '\n' {
+			line++
+			column = 1
+		} else {
+			column++
+		}
+	}
+	return fmt.Sprintf("line %d, column %d: %s", line, column, err.Error())
+}
+
+//SetupLogging - Log format and level of all the binaries
+func SetupLogging(level string) {
+	log.SetFormatter(&log.TextFormatter{
+		DisableColors: false,
+		FullTimestamp: true,
+	})
+	SetLogLevel(level)
+}
+
+//SetLogLevel - Set the log level from the configuration
+func SetLogLevel(level string) {
+	if level == "DEBUG" {
+		log.SetLevel(log.DebugLevel)
+	} else if level == "INFO" {
+		log.SetLevel(log.InfoLevel)
+	} else if level == "ERROR" {
+		log.SetLevel(log.ErrorLevel)
+	} else if level == "WARN" {
+		log.SetLevel(log.WarnLevel)
+	} else {
+		log.SetLevel(log.InfoLevel) // Make info default in case of missing config
+	}
+}
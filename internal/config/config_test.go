@@ -0,0 +1,169 @@
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type testNested struct {
+	MinAltitude int64 `validate:"min=0"`
+	Names       []string
+}
+
+type testConfig struct {
+	MQTT
+	Port    int     `default:"30003" validate:"min=1,max=65535"`
+	Codec   string  `default:"gzip" validate:"oneof=gzip zlib none"`
+	Bands   []int64 `default:"0,10000"`
+	Secret  string  `secret:"true"`
+	Enabled bool
+	Filters testNested
+	Outputs []testOutput
+}
+
+type testOutput struct {
+	Name string `validate:"required"`
+	URL  string `validate:"url"`
+	QoS  *int   `validate:"min=0,max=2"`
+}
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+
+	file := filepath.Join(t.TempDir(), "config.json")
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+const minimal = `{"MQTTServerURL":"tcp://localhost:1883", "MQTTClientID":"test", "MQTTTopic":"adsb"}`
+
+func TestEnvName(t *testing.T) {
+	tests := []struct {
+		field string
+		want  string
+	}{
+		{"MQTTServerURL", "TEST_MQTT_SERVER_URL"},
+		{"StationID", "TEST_STATION_ID"},
+		{"Dump1090Port", "TEST_DUMP1090_PORT"},
+		{"HTTPListen", "TEST_HTTP_LISTEN"},
+		{"RewriteTimestamps", "TEST_REWRITE_TIMESTAMPS"},
+		{"Codec", "TEST_CODEC"},
+	}
+
+	for _, tt := range tests {
+		if got := EnvName("TEST", tt.field); got != tt.want {
+			t.Errorf("EnvName(%q) = %q, want %q", tt.field, got, tt.want)
+		}
+	}
+}
+
+func TestLoadDefaults(t *testing.T) {
+	var cfg testConfig
+	if err := Load(writeConfig(t, minimal), "TEST", &cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Port != 30003 || cfg.Codec != "gzip" || !reflect.DeepEqual(cfg.Bands, []int64{0, 10000}) || cfg.LogLevel != "INFO" {
+		t.Errorf("defaults not applied: port %d, codec %q, bands %v, log level %q", cfg.Port, cfg.Codec, cfg.Bands, cfg.LogLevel)
+	}
+}
+
+func TestLoadEnvironment(t *testing.T) {
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	ioutil.WriteFile(secretFile, []byte("from file\n"), 0600)
+
+	t.Setenv("TEST_MQTT_CLIENT_ID", "from-env")
+	t.Setenv("TEST_PORT", "1234")
+	t.Setenv("TEST_ENABLED", "true")
+	t.Setenv("TEST_FILTERS_MIN_ALTITUDE", "500")
+	t.Setenv("TEST_FILTERS_NAMES", `["a","b"]`)
+	t.Setenv("TEST_SECRET_FILE", secretFile)
+
+	var cfg testConfig
+	if err := Load(writeConfig(t, minimal), "TEST", &cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.MQTTClientID != "from-env" || cfg.Port != 1234 || !cfg.Enabled || cfg.Filters.MinAltitude != 500 ||
+		!reflect.DeepEqual(cfg.Filters.Names, []string{"a", "b"}) || cfg.Secret != "from file" {
+		t.Errorf("environment not applied: %+v", cfg)
+	}
+}
+
+func TestLoadSecretFile(t *testing.T) {
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	ioutil.WriteFile(secretFile, []byte("s3cret\n"), 0600)
+
+	var cfg testConfig
+	content := strings.Replace(minimal, "}", `, "Secret":"file:`+secretFile+`"}`, 1)
+	if err := Load(writeConfig(t, content), "TEST", &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Secret != "s3cret" {
+		t.Errorf("Secret = %q, want the content of the file", cfg.Secret)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		env     map[string]string
+		err     []string
+	}{
+		{"unknown field", `{"MQTTServerURL":"tcp://h:1", "Unknown":1}`, nil, []string{"unknown field \"Unknown\""}},
+		{"syntax error", "{\n  \"Port\": 1,\n  \"Codec\" \"gzip\"\n}", nil, []string{"line 3, column"}},
+		{"type error", `{"Port":"one"}`, nil, []string{"line 1, column"}},
+		{"required", `{"MQTTTopic":"adsb"}`, nil, []string{"MQTTServerURL: is required", "MQTTClientID: is required"}},
+		{"min and max", strings.Replace(minimal, "}", `, "Port":70000, "Filters":{"MinAltitude":-1}}`, 1), nil,
+			[]string{"Port: must be at most 65535, got 70000", "Filters.MinAltitude: must be at least 0, got -1"}},
+		{"oneof", strings.Replace(minimal, "}", `, "Codec":"lz4"}`, 1), nil, []string{"Codec: must be one of gzip, zlib, none"}},
+		{"url", strings.Replace(minimal, "tcp://localhost:1883", "localhost", 1), nil, []string{"MQTTServerURL: must be a URL"}},
+		{"slice entries", strings.Replace(minimal, "}", `, "Outputs":[{"Name":"a"}, {"URL":"x"}]}`, 1), nil,
+			[]string{"Outputs[1].Name: is required", "Outputs[1].URL: must be a URL"}},
+		{"optional value", strings.Replace(minimal, "}", `, "Outputs":[{"Name":"a"}, {"Name":"b", "QoS":3}]}`, 1), nil,
+			[]string{"Outputs[1].QoS: must be at most 2, got 3"}},
+		{"invalid environment", minimal, map[string]string{"TEST_PORT": "many"}, []string{"TEST_PORT: invalid integer"}},
+		{"missing secret file", minimal, map[string]string{"TEST_SECRET_FILE": "/nonexistent/secret"}, []string{"TEST_SECRET_FILE"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+
+			var cfg testConfig
+			err := Load(writeConfig(t, tt.content), "TEST", &cfg)
+			if err == nil {
+				t.Fatal("no error")
+			}
+			for _, want := range tt.err {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q does not contain %q", err.Error(), want)
+				}
+			}
+		})
+	}
+}
+
+func TestSecretNotInErrors(t *testing.T) {
+	content := strings.Replace(minimal, "}", `, "MQTTProxy":"user:s3cret@proxy", "Codec":"lz4"}`, 1)
+
+	var cfg testConfig
+	err := Load(writeConfig(t, content), "TEST", &cfg)
+	if err == nil {
+		t.Fatal("no error")
+	}
+	if !strings.Contains(err.Error(), "MQTTProxy: must be a URL") || strings.Contains(err.Error(), "s3cret") {
+		t.Errorf("error %q, want the MQTTProxy problem without its value", err.Error())
+	}
+	if !strings.Contains(err.Error(), `got "lz4"`) {
+		t.Errorf("error %q, want the value of the fields not secret", err.Error())
+	}
+}
@@ -0,0 +1,187 @@
+// ----------------------------------------------------------------------------
+// Environment overrides and secrets from files
+// PREFIX_FIELD variables, PREFIX_FIELD_FILE variables and "file:" secret values
+// Contact: Hugo Cruz - hugo.m.cruz@gmail.com
+// ----------------------------------------------------------------------------
+
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Prefix of the secret values read from a file
+const filePrefix = "file:"
+
+//EnvName - Environment variable of a field: MQTTServerURL -> PREFIX_MQTT_SERVER_URL
+func EnvName(prefix string, field string) string {
+	return prefix + "_" + toSnake(field)
+}
+
+// Upper snake case, keeping acronyms together
+func toSnake(name string) string {
+	runes := []rune(name)
+	var b strings.Builder
+
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			previous := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(previous) || unicode.IsDigit(previous) || (unicode.IsUpper(previous) && nextLower) {
+				b.WriteRune('_')
+			}
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+// Override the fields with the environment. Nested structs use the field
+// path (PREFIX_FILTERS_MIN_ALTITUDE), structs and slices also accept JSON.
+func applyEnvironment(cfg interface{}, prefix string) error {
+	return walkEnvironment(reflect.ValueOf(cfg).Elem(), prefix)
+}
+
+func walkEnvironment(v reflect.Value, prefix string) error {
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		value := v.Field(i)
+
+		if field.PkgPath != "" {
+			continue
+		}
+
+		// Embedded structs share the prefix of their parent
+		if field.Anonymous && value.Kind() == reflect.Struct {
+			if err := walkEnvironment(value, prefix); err != nil {
+				return err
+			}
+			continue
+		}
+
+		name := EnvName(prefix, field.Name)
+
+		raw, ok := os.LookupEnv(name)
+		if !ok {
+			if filename, fileOk := os.LookupEnv(name + "_FILE"); fileOk {
+				content, err := ioutil.ReadFile(filename)
+				if err != nil {
+					return errors.New(name + "_FILE: " + err.Error())
+				}
+				raw, ok = strings.TrimSpace(string(content)), true
+			}
+		}
+
+		if ok {
+			if err := setFromString(value, raw); err != nil {
+				return errors.New(name + ": " + err.Error())
+			}
+		}
+
+		if value.Kind() == reflect.Struct {
+			if err := walkEnvironment(value, name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Set a field from its text value
+func setFromString(value reflect.Value, raw string) error {
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return errors.New("invalid boolean " + strconv.Quote(raw))
+		}
+		value.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return errors.New("invalid integer " + strconv.Quote(raw))
+		}
+		value.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			return errors.New("invalid unsigned integer " + strconv.Quote(raw))
+		}
+		value.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return errors.New("invalid number " + strconv.Quote(raw))
+		}
+		value.SetFloat(f)
+	default:
+		// Structs, slices and maps are JSON
+		target := reflect.New(value.Type())
+		if err := json.Unmarshal([]byte(raw), target.Interface()); err != nil {
+			return errors.New("invalid JSON: " + err.Error())
+		}
+		value.Set(target.Elem())
+	}
+	return nil
+}
+
+// Replace the "file:/path" values of the secret fields with the file content
+func readSecrets(cfg interface{}) error {
+	return walkSecrets(reflect.ValueOf(cfg).Elem(), "")
+}
+
+func walkSecrets(v reflect.Value, path string) error {
+	switch v.Kind() {
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+			value := v.Field(i)
+
+			if field.Tag.Get("secret") == "true" && value.Kind() == reflect.String && strings.HasPrefix(value.String(), filePrefix) {
+				content, err := ioutil.ReadFile(strings.TrimPrefix(value.String(), filePrefix))
+				if err != nil {
+					return errors.New(fieldPath(path, field) + ": " + err.Error())
+				}
+				value.SetString(strings.TrimSpace(string(content)))
+				continue
+			}
+
+			if err := walkSecrets(value, fieldPath(path, field)); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			if err := walkSecrets(v.Index(i), path+"["+strconv.Itoa(i)+"]"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Path of a field in the error messages, embedded structs are transparent
+func fieldPath(path string, field reflect.StructField) string {
+	if field.Anonymous {
+		return path
+	}
+	if path == "" {
+		return field.Name
+	}
+	return path + "." + field.Name
+}
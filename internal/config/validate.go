@@ -0,0 +1,181 @@
+// ----------------------------------------------------------------------------
+// Configuration defaults and validation
+// Rules in the struct tags: default:"3" validate:"required,min=1,max=2,oneof=A B,url"
+// Contact: Hugo Cruz - hugo.m.cruz@gmail.com
+// ----------------------------------------------------------------------------
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Set the default of the fields left empty
+func applyDefaults(cfg interface{}) {
+	walkDefaults(reflect.ValueOf(cfg).Elem())
+}
+
+func walkDefaults(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+			value := v.Field(i)
+
+			if def, ok := field.Tag.Lookup("default"); ok && value.IsZero() {
+				if value.Kind() == reflect.Slice {
+					def = "[" + def + "]"
+				}
+				if err := setFromString(value, def); err != nil {
+					panic("invalid default for " + field.Name + ": " + err.Error())
+				}
+			}
+
+			walkDefaults(value)
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			walkDefaults(v.Index(i))
+		}
+	}
+}
+
+//Validate - Check the validation rules and return all the errors found
+func Validate(cfg interface{}) error {
+	problems := make([]string, 0)
+	walkValidate(reflect.ValueOf(cfg).Elem(), "", &problems)
+
+	if len(problems) > 0 {
+		return errors.New("invalid configuration: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func walkValidate(v reflect.Value, path string, problems *[]string) {
+	switch v.Kind() {
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+			value := v.Field(i)
+			name := fieldPath(path, field)
+
+			secret := field.Tag.Get("secret") == "true"
+			for _, rule := range splitRules(field.Tag.Get("validate")) {
+				if problem := checkRule(value, rule, secret); problem != "" {
+					*problems = append(*problems, name+": "+problem)
+				}
+			}
+
+			walkValidate(value, name, problems)
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			walkValidate(v.Index(i), path+"["+strconv.Itoa(i)+"]", problems)
+		}
+	}
+}
+
+func splitRules(tag string) []string {
+	if tag == "" {
+		return nil
+	}
+	return strings.Split(tag, ",")
+}
+
+// Check one rule, empty when the value is valid. The values of the secret
+// fields are not in the problem.
+func checkRule(value reflect.Value, rule string, secret bool) string {
+	name, arg := rule, ""
+	if i := strings.Index(rule, "="); i >= 0 {
+		name, arg = rule[:i], rule[i+1:]
+	}
+
+	// Optional values are checked when set
+	if value.Kind() == reflect.Ptr {
+		if value.IsNil() {
+			if name == "required" {
+				return "is required"
+			}
+			return ""
+		}
+		value = value.Elem()
+	}
+
+	switch name {
+	case "required":
+		if value.IsZero() {
+			return "is required"
+		}
+	case "min", "max":
+		limit, _ := strconv.ParseFloat(arg, 64)
+		n, ok := number(value)
+		if !ok || (value.Kind() == reflect.String && n == 0) {
+			return ""
+		}
+		if name == "min" && n < limit {
+			return "must be at least " + arg + got(value, secret)
+		}
+		if name == "max" && n > limit {
+			return "must be at most " + arg + got(value, secret)
+		}
+	case "oneof":
+		if value.Kind() != reflect.String || value.String() == "" {
+			return ""
+		}
+		for _, option := range strings.Fields(arg) {
+			if value.String() == option {
+				return ""
+			}
+		}
+		return "must be one of " + strings.Join(strings.Fields(arg), ", ") + got(value, secret)
+	case "url":
+		if value.Kind() != reflect.String || value.String() == "" {
+			return ""
+		}
+		u, err := url.Parse(value.String())
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return "must be a URL like scheme://host:port" + got(value, secret)
+		}
+	}
+	return ""
+}
+
+// Value of a field in a problem, e.g. a proxy URL with the password
+// is left out
+func got(value reflect.Value, secret bool) string {
+	if secret {
+		return ""
+	}
+	if value.Kind() == reflect.String {
+		return fmt.Sprintf(", got %q", value.String())
+	}
+	return fmt.Sprintf(", got %v", value.Interface())
+}
+
+// Numeric value of a field. Strings are checked by length.
+func number(value reflect.Value) (float64, bool) {
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(value.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(value.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return value.Float(), true
+	case reflect.String:
+		return float64(len(value.String())), true
+	}
+	return 0, false
+}
@@ -0,0 +1,163 @@
+// ----------------------------------------------------------------------------
+// MQTT connection options shared by the publisher and the subscribers
+// WebSocket headers, HTTP CONNECT and SOCKS5 proxies
+// Contact: Hugo Cruz - hugo.m.cruz@gmail.com
+// ----------------------------------------------------------------------------
+
+package connection
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"golang.org/x/net/proxy"
+)
+
+//Configure - Set the WebSocket headers (ws:// and wss:// brokers) and the proxy.
+// proxyURL is http://[user:pass@]host:port (HTTP CONNECT) or socks5://[user:pass@]host:port.
+// Without proxy the connection is opened directly.
+func Configure(opts *mqtt.ClientOptions, headers map[string]string, proxyURL string) error {
+	if len(headers) > 0 {
+		h := http.Header{}
+		for name, value := range headers {
+			h.Set(name, value)
+		}
+		opts.SetHTTPHeaders(h)
+	}
+
+	if proxyURL == "" {
+		return nil
+	}
+
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return errors.New("invalid proxy URL: " + err.Error())
+	}
+
+	var dialer proxy.Dialer
+	switch u.Scheme {
+	case "http":
+		dialer = &connectDialer{proxy: u}
+	case "socks5", "socks5h":
+		dialer, err = proxy.FromURL(u, &net.Dialer{Timeout: opts.ConnectTimeout})
+		if err != nil {
+			return errors.New("invalid proxy URL: " + err.Error())
+		}
+	default:
+		return errors.New("proxy URL must be http://host:port or socks5://host:port, got " + proxyURL)
+	}
+
+	opts.SetCustomOpenConnectionFn(func(uri *url.URL, options mqtt.ClientOptions) (net.Conn, error) {
+		return open(uri, options, u, dialer)
+	})
+	return nil
+}
+
+// Open the connection to the broker through the proxy
+func open(uri *url.URL, options mqtt.ClientOptions, proxyURL *url.URL, dialer proxy.Dialer) (net.Conn, error) {
+	switch uri.Scheme {
+	case "ws", "wss":
+		// The WebSocket dialer connects through the proxy by itself
+		dialURI := *uri
+		dialURI.User = nil
+		var tlsConfig *tls.Config
+		if uri.Scheme == "wss" {
+			tlsConfig = options.TLSConfig
+		}
+		return mqtt.NewWebsocket(dialURI.String(), tlsConfig, options.ConnectTimeout, options.HTTPHeaders,
+			&mqtt.WebsocketOptions{Proxy: http.ProxyURL(proxyURL)})
+
+	case "tcp", "mqtt":
+		return dialer.Dial("tcp", uri.Host)
+
+	case "ssl", "tls", "mqtts", "mqtt+ssl", "tcps":
+		conn, err := dialer.Dial("tcp", uri.Host)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig := &tls.Config{}
+		if options.TLSConfig != nil {
+			tlsConfig = options.TLSConfig.Clone()
+		}
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = uri.Hostname()
+		}
+
+		tlsConn := tls.Client(conn, tlsConfig)
+		conn.SetDeadline(time.Now().Add(options.ConnectTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn.SetDeadline(time.Time{})
+		return tlsConn, nil
+	}
+	return nil, errors.New("broker URL scheme " + uri.Scheme + " is not supported through a proxy")
+}
+
+// Tunnel through an HTTP proxy with the CONNECT method
+type connectDialer struct {
+	proxy *url.URL
+}
+
+func (d *connectDialer) Dial(network string, address string) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", d.proxy.Host, 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	request := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: http.Header{},
+	}
+	if d.proxy.User != nil {
+		password, _ := d.proxy.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(d.proxy.User.Username() + ":" + password))
+		request.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	if err := request.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, errors.New("proxy " + d.proxy.Host + " refused the connection to " + address + ": " + response.Status)
+	}
+	conn.SetDeadline(time.Time{})
+
+	// Bytes of the broker already read with the answer of the proxy
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// Connection that reads the buffered bytes first
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
@@ -0,0 +1,283 @@
+// ----------------------------------------------------------------------------
+// Signed and encrypted batches
+// The publisher seals the encoded batches with HMAC-SHA256 or AES-GCM, the
+// subscribers verify or decrypt them with the key named in the header
+// Contact: Hugo Cruz - hugo.m.cruz@gmail.com
+// ----------------------------------------------------------------------------
+
+package envelope
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Header: mode byte, version, key ID length and key ID.
+// Signed:    header | body | HMAC-SHA256(header | body)
+// Encrypted: header | nonce | AES-GCM(body), the header is authenticated data
+const (
+	signed    = 'S'
+	encrypted = 'E'
+	version   = 1
+)
+
+// Modes in the configuration
+const (
+	None    = "none"
+	Sign    = "sign"
+	Encrypt = "encrypt"
+)
+
+// Reasons of the rejected batches
+var (
+	ErrUnsealed   = errors.New("batch is not signed or encrypted")
+	ErrMalformed  = errors.New("malformed header")
+	ErrUnknownKey = errors.New("unknown key ID")
+	ErrSignature  = errors.New("invalid signature")
+	ErrDecrypt    = errors.New("decryption failed")
+)
+
+//Key - Key ID and the file with the key: hex, base64 or raw bytes
+type Key struct {
+	ID   string `validate:"required"`
+	File string `validate:"required"`
+}
+
+//SealConfig - Signature or encryption of the batches by the publisher
+type SealConfig struct {
+	Mode  string `default:"none" validate:"oneof=none sign encrypt"`
+	KeyID string
+	File  string
+}
+
+//OpenConfig - Keys accepted by the subscribers. During a rotation both the
+// old and the new key are listed. With keys the batches not sealed are
+// rejected, unless AllowUnsealed (while the publishers are migrated).
+type OpenConfig struct {
+	Keys          []Key
+	AllowUnsealed bool
+}
+
+//LoadKey - Read a key file. Hex and base64 contents are decoded.
+func LoadKey(file string) ([]byte, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	text := strings.TrimSpace(string(data))
+	if key, err := hex.DecodeString(text); err == nil && len(key) > 0 {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(text); err == nil && len(key) > 0 {
+		return key, nil
+	}
+	if len(text) == 0 {
+		return nil, errors.New(file + ": empty key")
+	}
+	return []byte(text), nil
+}
+
+// Header of a sealed batch
+func header(mode byte, keyID string) []byte {
+	h := []byte{mode, version, byte(len(keyID))}
+	return append(h, keyID...)
+}
+
+// AES-GCM with a key of 16, 24 or 32 bytes
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.New("encryption key must have 16, 24 or 32 bytes")
+	}
+	return cipher.NewGCM(block)
+}
+
+//Sealer - Seals the batches with one key. A nil Sealer leaves them as they are.
+type Sealer struct {
+	mode   byte
+	header []byte
+	key    []byte
+	aead   cipher.AEAD
+}
+
+//NewSealer - Sealer of the configuration, nil when the mode is none
+func NewSealer(config SealConfig) (*Sealer, error) {
+	if config.Mode == "" || config.Mode == None {
+		return nil, nil
+	}
+	if config.KeyID == "" || config.File == "" {
+		return nil, errors.New("Security.KeyID and Security.File are required to " + config.Mode)
+	}
+	if len(config.KeyID) > 255 {
+		return nil, errors.New("Security.KeyID is longer than 255 bytes")
+	}
+
+	key, err := LoadKey(config.File)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Sealer{key: key}
+	switch config.Mode {
+	case Sign:
+		s.mode = signed
+	case Encrypt:
+		s.mode = encrypted
+		if s.aead, err = newGCM(key); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("unknown security mode " + config.Mode)
+	}
+	s.header = header(s.mode, config.KeyID)
+	return s, nil
+}
+
+//Seal - Sign or encrypt an encoded batch
+func (s *Sealer) Seal(body []byte) []byte {
+	if s == nil {
+		return body
+	}
+
+	sealed := make([]byte, 0, len(s.header)+len(body)+sha256.Size+28)
+	sealed = append(sealed, s.header...)
+
+	if s.mode == signed {
+		sealed = append(sealed, body...)
+		mac := hmac.New(sha256.New, s.key)
+		mac.Write(sealed)
+		return mac.Sum(sealed)
+	}
+
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		log.Fatal("Error creating the nonce: ", err)
+	}
+	sealed = append(sealed, nonce...)
+	return s.aead.Seal(sealed, nonce, body, s.header)
+}
+
+//Opener - Verifies and decrypts the batches, and counts the rejected ones
+type Opener struct {
+	keys     map[string][]byte
+	required bool
+
+	mutex    sync.Mutex
+	rejected map[string]int64
+}
+
+//NewOpener - Opener with the keys of the configuration
+func NewOpener(config OpenConfig) (*Opener, error) {
+	o := &Opener{keys: make(map[string][]byte), rejected: make(map[string]int64)}
+
+	for _, k := range config.Keys {
+		key, err := LoadKey(k.File)
+		if err != nil {
+			return nil, errors.New("key " + k.ID + ": " + err.Error())
+		}
+		o.keys[k.ID] = key
+	}
+
+	o.required = len(o.keys) > 0 && !config.AllowUnsealed
+	if len(o.keys) > 0 && config.AllowUnsealed {
+		log.Warn("Security.AllowUnsealed: batches not signed or encrypted are accepted")
+	}
+	return o, nil
+}
+
+//IsSealed - Check if the payload starts with a header. Plain records start
+// with a digit, gzip with 0x1f and zlib with 0x78.
+func IsSealed(payload []byte) bool {
+	return len(payload) >= 3 && (payload[0] == signed || payload[0] == encrypted) && payload[1] == version
+}
+
+//Open - Body of a sealed batch. Batches not sealed are returned as they are
+// unless sealing is required. Rejected batches are counted and logged.
+func (o *Opener) Open(payload []byte, source string) ([]byte, error) {
+	body, err := o.open(payload)
+	if err != nil {
+		o.mutex.Lock()
+		o.rejected[err.Error()]++
+		o.mutex.Unlock()
+		log.Warn("Batch from ", source, " rejected: ", err.Error())
+	}
+	return body, err
+}
+
+func (o *Opener) open(payload []byte) ([]byte, error) {
+	if !IsSealed(payload) {
+		if o.required {
+			return nil, ErrUnsealed
+		}
+		return payload, nil
+	}
+
+	end := 3 + int(payload[2])
+	if len(payload) < end {
+		return nil, ErrMalformed
+	}
+	h := payload[:end]
+	key, ok := o.keys[string(payload[3:end])]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+
+	if payload[0] == signed {
+		if len(payload) < end+sha256.Size {
+			return nil, ErrMalformed
+		}
+		signedPart := payload[:len(payload)-sha256.Size]
+		mac := hmac.New(sha256.New, key)
+		mac.Write(signedPart)
+		if !hmac.Equal(mac.Sum(nil), payload[len(signedPart):]) {
+			return nil, ErrSignature
+		}
+		return bytes.Clone(signedPart[end:]), nil
+	}
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	if len(payload) < end+aead.NonceSize() {
+		return nil, ErrMalformed
+	}
+	nonce := payload[end : end+aead.NonceSize()]
+	body, err := aead.Open(nil, nonce, payload[end+aead.NonceSize():], h)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return body, nil
+}
+
+//Check - Health check with the rejected batches by reason. Never fails.
+func (o *Opener) Check() (string, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if len(o.rejected) == 0 {
+		return "no batch rejected", nil
+	}
+
+	reasons := make([]string, 0, len(o.rejected))
+	for reason, count := range o.rejected {
+		reasons = append(reasons, reason+": "+strconv.FormatInt(count, 10))
+	}
+	sort.Strings(reasons)
+	return "rejected batches - " + strings.Join(reasons, ", "), nil
+}
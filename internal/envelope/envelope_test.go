@@ -0,0 +1,201 @@
+package envelope
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// Key file with the key in hex, or raw when it is not a valid key in hex
+func writeKey(t *testing.T, content string) string {
+	t.Helper()
+
+	file := filepath.Join(t.TempDir(), "key")
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+const (
+	oldKey = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	newKey = "202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f"
+)
+
+func TestLoadKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []byte
+		err     bool
+	}{
+		{"hex", "00ff10\n", []byte{0x00, 0xff, 0x10}, false},
+		{"base64", "AP8Q", []byte{0x00, 0xff, 0x10}, false},
+		{"raw", "not a key in hex!", []byte("not a key in hex!"), false},
+		{"empty", " \n", nil, true},
+	}
+
+	for _, tt := range tests {
+		key, err := LoadKey(writeKey(t, tt.content))
+		if (err != nil) != tt.err {
+			t.Errorf("%s: error %v, want error %v", tt.name, err, tt.err)
+			continue
+		}
+		if !bytes.Equal(key, tt.want) {
+			t.Errorf("%s: key %x, want %x", tt.name, key, tt.want)
+		}
+	}
+}
+
+func TestNewSealer(t *testing.T) {
+	valid := writeKey(t, oldKey)
+	short := writeKey(t, "0001020304")
+
+	tests := []struct {
+		name   string
+		config SealConfig
+		sealer bool
+		err    bool
+	}{
+		{"none", SealConfig{Mode: None}, false, false},
+		{"empty mode", SealConfig{}, false, false},
+		{"sign", SealConfig{Mode: Sign, KeyID: "k1", File: valid}, true, false},
+		{"encrypt", SealConfig{Mode: Encrypt, KeyID: "k1", File: valid}, true, false},
+		{"without key ID", SealConfig{Mode: Sign, File: valid}, false, true},
+		{"encryption key size", SealConfig{Mode: Encrypt, KeyID: "k1", File: short}, false, true},
+		{"unknown mode", SealConfig{Mode: "rot13", KeyID: "k1", File: valid}, false, true},
+	}
+
+	for _, tt := range tests {
+		s, err := NewSealer(tt.config)
+		if (err != nil) != tt.err || (s != nil) != tt.sealer {
+			t.Errorf("%s: sealer %v error %v, want sealer %v error %v", tt.name, s != nil, err, tt.sealer, tt.err)
+		}
+	}
+}
+
+func TestSealOpen(t *testing.T) {
+	oldFile := writeKey(t, oldKey)
+	newFile := writeKey(t, newKey)
+	body := []byte("\x1f\x8b compressed batch")
+
+	// Subscriber during a rotation: both keys
+	opener, err := NewOpener(OpenConfig{Keys: []Key{{ID: "2026-09", File: oldFile}, {ID: "2026-10", File: newFile}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Subscriber with the old key only
+	oldOpener, err := NewOpener(OpenConfig{Keys: []Key{{ID: "2026-09", File: oldFile}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		mode   string
+		keyID  string
+		file   string
+		opener *Opener
+		err    error
+	}{
+		{"signed", Sign, "2026-09", oldFile, opener, nil},
+		{"encrypted", Encrypt, "2026-09", oldFile, opener, nil},
+		{"signed with the new key", Sign, "2026-10", newFile, opener, nil},
+		{"encrypted with the new key", Encrypt, "2026-10", newFile, opener, nil},
+		{"unknown key ID", Encrypt, "2026-10", newFile, oldOpener, ErrUnknownKey},
+		{"wrong signature key", Sign, "2026-09", newFile, opener, ErrSignature},
+		{"wrong encryption key", Encrypt, "2026-09", newFile, opener, ErrDecrypt},
+	}
+
+	for _, tt := range tests {
+		s, err := NewSealer(SealConfig{Mode: tt.mode, KeyID: tt.keyID, File: tt.file})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		sealed := s.Seal(body)
+		if !IsSealed(sealed) {
+			t.Errorf("%s: sealed batch without header", tt.name)
+		}
+		if tt.mode == Encrypt && bytes.Contains(sealed, body) {
+			t.Errorf("%s: body readable in the encrypted batch", tt.name)
+		}
+
+		opened, err := tt.opener.Open(sealed, "test")
+		if err != tt.err {
+			t.Errorf("%s: error %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if err == nil && !bytes.Equal(opened, body) {
+			t.Errorf("%s: opened %q, want %q", tt.name, opened, body)
+		}
+	}
+}
+
+func TestOpenTampered(t *testing.T) {
+	file := writeKey(t, oldKey)
+	opener, _ := NewOpener(OpenConfig{Keys: []Key{{ID: "k1", File: file}}})
+
+	for _, mode := range []string{Sign, Encrypt} {
+		s, _ := NewSealer(SealConfig{Mode: mode, KeyID: "k1", File: file})
+		sealed := s.Seal([]byte("3,1000,ABC123"))
+
+		tests := []struct {
+			name    string
+			payload []byte
+		}{
+			{"body changed", append(append([]byte{}, sealed[:len(sealed)-1]...), sealed[len(sealed)-1]^1)},
+			{"truncated", sealed[:5]},
+		}
+		for _, tt := range tests {
+			if _, err := opener.Open(tt.payload, "test"); err == nil {
+				t.Errorf("%s %s: accepted", mode, tt.name)
+			}
+		}
+	}
+}
+
+func TestOpenUnsealed(t *testing.T) {
+	file := writeKey(t, oldKey)
+	plain := []byte("3,1000,ABC123")
+
+	tests := []struct {
+		name   string
+		config OpenConfig
+		err    error
+	}{
+		{"without keys", OpenConfig{}, nil},
+		{"with keys", OpenConfig{Keys: []Key{{ID: "k1", File: file}}}, ErrUnsealed},
+		{"allowed during the migration", OpenConfig{Keys: []Key{{ID: "k1", File: file}}, AllowUnsealed: true}, nil},
+	}
+
+	for _, tt := range tests {
+		opener, err := NewOpener(tt.config)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		body, err := opener.Open(plain, "test")
+		if err != tt.err {
+			t.Errorf("%s: error %v, want %v", tt.name, err, tt.err)
+		}
+		if err == nil && !bytes.Equal(body, plain) {
+			t.Errorf("%s: body %q, want it unchanged", tt.name, body)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	opener, _ := NewOpener(OpenConfig{Keys: []Key{{ID: "k1", File: writeKey(t, oldKey)}}})
+
+	if state, err := opener.Check(); err != nil || state != "no batch rejected" {
+		t.Errorf("Check = %q, %v before any rejection", state, err)
+	}
+
+	opener.Open([]byte("3,1000"), "test")
+	opener.Open([]byte("3,1001"), "test")
+	if state, err := opener.Check(); err != nil || state != "rejected batches - "+ErrUnsealed.Error()+": 2" {
+		t.Errorf("Check = %q, %v after two unsealed batches", state, err)
+	}
+}
@@ -0,0 +1,180 @@
+// ----------------------------------------------------------------------------
+// Health and readiness endpoints
+// /healthz and /readyz answer JSON with the state and the failure reasons
+// Contact: Hugo Cruz - hugo.m.cruz@gmail.com
+// ----------------------------------------------------------------------------
+
+package health
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//Check - Returns the state for the response, and an error with the reason when failing
+type Check func() (string, error)
+
+//Result - Result of one check
+type Result struct {
+	OK     bool   `json:"ok"`
+	State  string `json:"state,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+//Response - JSON body of /healthz and /readyz
+type Response struct {
+	Status string            `json:"status"`
+	Checks map[string]Result `json:"checks"`
+}
+
+// Check with its name in the response
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+//Checks - The checks of one endpoint. Added at start, before serving.
+type Checks struct {
+	checks []namedCheck
+}
+
+//Add - Add a check
+func (c *Checks) Add(name string, check Check) {
+	c.checks = append(c.checks, namedCheck{name: name, check: check})
+}
+
+//Run - Run all the checks. Status is "ok" when all of them pass, "fail" otherwise.
+func (c *Checks) Run() Response {
+	response := Response{Status: "ok", Checks: make(map[string]Result)}
+
+	for _, nc := range c.checks {
+		state, err := nc.check()
+		result := Result{OK: err == nil, State: state}
+		if err != nil {
+			result.Reason = err.Error()
+			response.Status = "fail"
+		}
+		response.Checks[nc.name] = result
+	}
+	return response
+}
+
+// Answer 200 when the checks pass, 503 otherwise
+func (c *Checks) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	response := c.Run()
+
+	w.Header().Set("Content-Type", "application/json")
+	if response.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+//Register - Add /healthz (liveness) and /readyz (readiness) to the handlers
+func Register(mux *http.ServeMux, live *Checks, ready *Checks) {
+	mux.Handle("/healthz", live)
+	mux.Handle("/readyz", ready)
+}
+
+//Listen - Serve the handlers in a goroutine
+func Listen(listen string, mux *http.ServeMux) {
+	go func() {
+		log.Info("HTTP listener on ", listen)
+		if err := http.ListenAndServe(listen, mux); err != nil {
+			log.Error("HTTP listener stopped: ", err.Error())
+		}
+	}()
+}
+
+//Connected - Check of a connection, e.g. client.IsConnectionOpen of MQTT
+func Connected(name string, isConnected func() bool) Check {
+	return func() (string, error) {
+		if !isConnected() {
+			return "disconnected", errors.New("not connected to " + name)
+		}
+		return "connected to " + name, nil
+	}
+}
+
+//Activity - Time of the last event (data, message), safe for concurrent use
+type Activity struct {
+	nanos int64
+}
+
+//Mark - Record an event
+func (a *Activity) Mark(now time.Time) {
+	atomic.StoreInt64(&a.nanos, now.UnixNano())
+}
+
+//Last - Time of the last event, zero when there was none
+func (a *Activity) Last() time.Time {
+	nanos := atomic.LoadInt64(&a.nanos)
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+//MaxAge - Check of the age of the last event. Never fails when maxAge is 0.
+func MaxAge(a *Activity, what string, maxAge time.Duration) Check {
+	return func() (string, error) {
+		last := a.Last()
+		if last.IsZero() {
+			if maxAge > 0 && time.Since(startTime) > maxAge {
+				return "no " + what + " yet", errors.New("no " + what + " since the start")
+			}
+			return "no " + what + " yet", nil
+		}
+
+		age := time.Since(last)
+		state := "last " + what + " " + seconds(age) + " ago"
+		if maxAge > 0 && age > maxAge {
+			return state, errors.New("no " + what + " for " + seconds(age) + " (maximum " + seconds(maxAge) + ")")
+		}
+		return state, nil
+	}
+}
+
+//Sink - Result of the last write to a sink (file, REST service), safe for concurrent use
+type Sink struct {
+	mutex sync.Mutex
+	last  time.Time
+	err   error
+}
+
+//Done - Record the result of a write
+func (s *Sink) Done(now time.Time, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.last = now
+	s.err = err
+}
+
+//Check - Fails when the last write failed
+func (s *Sink) Check() (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.last.IsZero() {
+		return "no write yet", nil
+	}
+	if s.err != nil {
+		return "last write failed " + seconds(time.Since(s.last)) + " ago", s.err
+	}
+	return "last write ok " + seconds(time.Since(s.last)) + " ago", nil
+}
+
+// Start of the process, for the checks of the first events
+var startTime = time.Now()
+
+// Duration in whole seconds
+func seconds(d time.Duration) string {
+	return strconv.FormatInt(int64(d.Seconds()), 10) + "s"
+}
@@ -0,0 +1,66 @@
+// ----------------------------------------------------------------------------
+// SBS captures
+// Files of recorded lines, plain or gzip, and the time fields of the lines
+// Contact: Hugo Cruz - hugo.m.cruz@gmail.com
+// ----------------------------------------------------------------------------
+
+package sbs
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+//Open - Open a capture, "-" for stdin. Gzip files are detected by their first bytes.
+// Read the lines from the reader, close the file with the closer.
+func Open(name string) (io.Reader, io.Closer, error) {
+	file := os.Stdin
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		file = f
+	}
+
+	reader := bufio.NewReader(file)
+	if magic, err := reader.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+		return gz, file, nil
+	}
+	return reader, file, nil
+}
+
+//LineTime - Generated date and time of a line
+func LineTime(line string) (time.Time, bool) {
+	fields := strings.Split(line, ",")
+	if len(fields) < 8 {
+		return time.Time{}, false
+	}
+	t, err := time.ParseInLocation(DateLayout+"T"+TimeLayout, fields[6]+"T"+fields[7], time.UTC)
+	return t, err == nil
+}
+
+//Rewrite - Set the generated and logged date and time of a line. Lines
+// without time fields are returned as they are.
+func Rewrite(line string, t time.Time) string {
+	fields := strings.Split(line, ",")
+	if len(fields) < 10 {
+		return line
+	}
+	if _, ok := LineTime(line); !ok {
+		return line
+	}
+
+	date, clock := Timestamp(t)
+	fields[6], fields[7], fields[8], fields[9] = date, clock, date, clock
+	return strings.Join(fields, ",")
+}
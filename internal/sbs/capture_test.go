@@ -0,0 +1,90 @@
+package sbs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const sampleLine = "MSG,3,1,1,ABC123,1,2026/10/18,12:30:45.250,2026/10/18,12:30:45.300,,35000,,,10.8,106.6,,,0,0,0,0"
+
+func TestLineTime(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want string
+		ok   bool
+	}{
+		{"message", sampleLine, "2026-10-18T12:30:45.25Z", true},
+		{"short line", "MSG,3,1,1,ABC123,1,2026/10/18", "", false},
+		{"bad date", "MSG,3,1,1,ABC123,1,18/10/2026,12:30:45.250,,", "", false},
+		{"empty time", "MSG,3,1,1,ABC123,1,,,,", "", false},
+	}
+
+	for _, tt := range tests {
+		got, ok := LineTime(tt.line)
+		if ok != tt.ok || (ok && got.Format(time.RFC3339Nano) != tt.want) {
+			t.Errorf("%s: LineTime = %v %v, want %s %v", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	now := time.Date(2026, 11, 2, 8, 5, 1, 7e6, time.UTC)
+
+	tests := []struct {
+		name string
+		line string
+		want string
+	}{
+		{"message", sampleLine, "MSG,3,1,1,ABC123,1,2026/11/02,08:05:01.007,2026/11/02,08:05:01.007,,35000,,,10.8,106.6,,,0,0,0,0"},
+		{"short line", "MSG,3,1,1,ABC123,1,2026/10/18,12:30:45.250", "MSG,3,1,1,ABC123,1,2026/10/18,12:30:45.250"},
+		{"no time", "STA,,1,1,ABC123,1,,,,,RM", "STA,,1,1,ABC123,1,,,,,RM"},
+	}
+
+	for _, tt := range tests {
+		if got := Rewrite(tt.line, now); got != tt.want {
+			t.Errorf("%s: Rewrite = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestOpen(t *testing.T) {
+	content := sampleLine + "\n"
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write([]byte(content))
+	gz.Close()
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"plain", []byte(content)},
+		{"gzip", compressed.Bytes()},
+	}
+
+	for _, tt := range tests {
+		file := filepath.Join(t.TempDir(), "capture")
+		if err := ioutil.WriteFile(file, tt.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		reader, closer, err := Open(file)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		got, err := ioutil.ReadAll(reader)
+		closer.Close()
+		if err != nil || string(got) != content {
+			t.Errorf("%s: read %q (%v), want %q", tt.name, got, err, content)
+		}
+	}
+
+	if _, _, err := Open(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("no error for a missing capture")
+	}
+}
@@ -0,0 +1,212 @@
+// ----------------------------------------------------------------------------
+// SBS server
+// Serves BaseStation lines to the connected clients like the port 30003 of
+// dump1090. Used by the traffic generator and the replay server.
+// Contact: Hugo Cruz - hugo.m.cruz@gmail.com
+// ----------------------------------------------------------------------------
+
+package sbs
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Date and time layouts of the SBS fields
+const (
+	DateLayout = "2006/01/02"
+	TimeLayout = "15:04:05.000"
+)
+
+//Timestamp - Date and time fields of an SBS line
+func Timestamp(t time.Time) (string, string) {
+	return t.Format(DateLayout), t.Format(TimeLayout)
+}
+
+//Server - TCP server that sends every line to all the clients
+type Server struct {
+	listener  net.Listener
+	queueSize int
+	blocking  bool
+
+	mutex   sync.Mutex
+	clients map[*client]bool
+	dropped int64
+
+	closed    chan bool
+	closeOnce sync.Once
+}
+
+// Connected client with its queue of lines
+type client struct {
+	conn  net.Conn
+	lines chan string
+	done  chan bool
+}
+
+//Listen - Accept clients on address. A client keeps up to queueSize lines.
+// When blocking, Send waits for the slowest client, otherwise its lines are dropped.
+func Listen(address string, queueSize int, blocking bool) (*Server, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		listener:  listener,
+		queueSize: queueSize,
+		blocking:  blocking,
+		clients:   make(map[*client]bool),
+		closed:    make(chan bool),
+	}
+	log.Info("Serving SBS lines on ", listener.Addr().String())
+
+	go s.accept()
+	return s, nil
+}
+
+func (s *Server) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		c := &client{conn: conn, lines: make(chan string, s.queueSize), done: make(chan bool)}
+		s.mutex.Lock()
+		s.clients[c] = true
+		s.mutex.Unlock()
+
+		log.Info("Client connected: ", conn.RemoteAddr().String())
+		go s.write(c)
+		go s.read(c)
+	}
+}
+
+// Write the queued lines, flushed when the queue is empty
+func (s *Server) write(c *client) {
+	writer := bufio.NewWriter(c.conn)
+
+	for {
+		select {
+		case line := <-c.lines:
+			if _, err := writer.WriteString(line + "\r\n"); err != nil {
+				s.remove(c)
+				return
+			}
+			if len(c.lines) == 0 {
+				if err := writer.Flush(); err != nil {
+					s.remove(c)
+					return
+				}
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// Discard what the client sends and notice when it disconnects
+func (s *Server) read(c *client) {
+	io.Copy(ioutil.Discard, c.conn)
+	s.remove(c)
+}
+
+func (s *Server) remove(c *client) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.clients[c] {
+		return
+	}
+	delete(s.clients, c)
+	close(c.done)
+	c.conn.Close()
+	log.Info("Client disconnected: ", c.conn.RemoteAddr().String())
+}
+
+//Send - Queue a line, without CR LF, for all the clients. When blocking,
+// it returns when the server is closed even if a client stopped reading.
+func (s *Server) Send(line string) {
+	s.mutex.Lock()
+	clients := make([]*client, 0, len(s.clients))
+	for c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.mutex.Unlock()
+
+	for _, c := range clients {
+		if s.blocking {
+			select {
+			case c.lines <- line:
+			case <-c.done:
+			case <-s.closed:
+				return
+			}
+			continue
+		}
+
+		select {
+		case c.lines <- line:
+		default:
+			atomic.AddInt64(&s.dropped, 1)
+		}
+	}
+}
+
+//Clients - Number of connected clients
+func (s *Server) Clients() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.clients)
+}
+
+//Dropped - Lines dropped because a client did not keep up
+func (s *Server) Dropped() int64 {
+	return atomic.LoadInt64(&s.dropped)
+}
+
+//Drain - Wait until the clients have written their queued lines, at most timeout
+func (s *Server) Drain(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+
+	for time.Now().Before(deadline) {
+		queued := 0
+		s.mutex.Lock()
+		for c := range s.clients {
+			queued += len(c.lines)
+		}
+		s.mutex.Unlock()
+
+		if queued == 0 {
+			// Last write in progress
+			time.Sleep(100 * time.Millisecond)
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+//Close - Stop accepting clients and disconnect them. Lines still queued are lost.
+func (s *Server) Close() {
+	s.closeOnce.Do(func() { close(s.closed) })
+	s.listener.Close()
+
+	s.mutex.Lock()
+	clients := make([]*client, 0, len(s.clients))
+	for c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.mutex.Unlock()
+
+	for _, c := range clients {
+		s.remove(c)
+	}
+}
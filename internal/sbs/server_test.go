@@ -0,0 +1,113 @@
+package sbs
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+// Connect to the server and wait until it counts the client
+func dial(t *testing.T, s *Server, clients int) net.Conn {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", s.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(2 * time.Second); s.Clients() < clients; {
+		if time.Now().After(deadline) {
+			t.Fatal("client not accepted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return conn
+}
+
+func TestSend(t *testing.T) {
+	tests := []struct {
+		name     string
+		blocking bool
+	}{
+		{"blocking", true},
+		{"dropping", false},
+	}
+
+	for _, tt := range tests {
+		s, err := Listen("127.0.0.1:0", 10, tt.blocking)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn := dial(t, s, 1)
+		s.Send("line 1")
+		s.Send("line 2")
+
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		reader := bufio.NewReader(conn)
+		for _, want := range []string{"line 1\r\n", "line 2\r\n"} {
+			if got, err := reader.ReadString('\n'); err != nil || got != want {
+				t.Errorf("%s: read %q (%v), want %q", tt.name, got, err, want)
+			}
+		}
+
+		conn.Close()
+		s.Close()
+	}
+}
+
+func TestSendDropsForSlowClient(t *testing.T) {
+	s, err := Listen("127.0.0.1:0", 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	conn := dial(t, s, 1)
+	defer conn.Close()
+
+	// The client never reads: the socket buffers fill, then the queue
+	line := string(make([]byte, 64*1024))
+	for i := 0; i < 200 && s.Dropped() == 0; i++ {
+		s.Send(line)
+	}
+	if s.Dropped() == 0 {
+		t.Error("no line dropped for a client that does not read")
+	}
+}
+
+func TestCloseUnblocksSend(t *testing.T) {
+	s, err := Listen("127.0.0.1:0", 1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := dial(t, s, 1)
+	defer conn.Close()
+
+	// The client never reads, so Send blocks once the socket buffers are full
+	sent := make(chan bool)
+	go func() {
+		line := string(make([]byte, 64*1024))
+		for i := 0; i < 1000; i++ {
+			s.Send(line)
+		}
+		close(sent)
+	}()
+
+	select {
+	case <-sent:
+		t.Fatal("Send did not block for a client that does not read")
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	s.Close()
+	select {
+	case <-sent:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Send still blocked after Close")
+	}
+
+	// Closing again is harmless
+	s.Close()
+}
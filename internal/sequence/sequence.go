@@ -0,0 +1,289 @@
+// ----------------------------------------------------------------------------
+// Batch sequence numbers
+// With SequenceHeader the publisher starts each batch with a header line:
+// station, stream, run, sequence number, window and record count. The
+// subscribers track the gaps, duplicates and reordered batches of each stream.
+// Contact: Hugo Cruz - hugo.m.cruz@gmail.com
+// ----------------------------------------------------------------------------
+
+package sequence
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Prefix of the header line. Records always start with a digit.
+const prefix = "#batch "
+
+// Missing batches remembered per stream to detect the late ones
+const maxMissing = 10000
+
+//Header - Header of a batch. Seq starts at 1 for every stream and run. Run
+// is the start time of the publisher, Start and End the batch window (Unix seconds).
+type Header struct {
+	Station string
+	Stream  string
+	Run     int64
+	Seq     uint64
+	Start   int64
+	End     int64
+	Count   int
+}
+
+//Line - Header line, without the line break
+func (h Header) Line() string {
+	return prefix + "station=" + value(h.Station) +
+		" stream=" + value(h.Stream) +
+		" run=" + strconv.FormatInt(h.Run, 10) +
+		" seq=" + strconv.FormatUint(h.Seq, 10) +
+		" start=" + strconv.FormatInt(h.Start, 10) +
+		" end=" + strconv.FormatInt(h.End, 10) +
+		" count=" + strconv.Itoa(h.Count)
+}
+
+// Names with spaces would split the fields of the header
+func value(name string) string {
+	return strings.Join(strings.Fields(name), "_")
+}
+
+//Split - Header and records of a decoded batch. ok is false for batches
+// without header, from publishers without SequenceHeader, returned as they are.
+func Split(data []byte) (Header, []byte, bool, error) {
+	if !bytes.HasPrefix(data, []byte(prefix)) {
+		return Header{}, data, false, nil
+	}
+
+	end := bytes.IndexByte(data, '\n')
+	if end < 0 {
+		end = len(data)
+	}
+	h, err := parse(string(data[len(prefix):end]))
+	if err != nil {
+		return Header{}, data, false, err
+	}
+	if end < len(data) {
+		end++
+	}
+	return h, data[end:], true, nil
+}
+
+func parse(line string) (Header, error) {
+	h := Header{}
+	var err error
+
+	for _, field := range strings.Fields(line) {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return h, errors.New("malformed batch header field " + field)
+		}
+		switch kv[0] {
+		case "station":
+			h.Station = kv[1]
+		case "stream":
+			h.Stream = kv[1]
+		case "run":
+			h.Run, err = strconv.ParseInt(kv[1], 10, 64)
+		case "seq":
+			h.Seq, err = strconv.ParseUint(kv[1], 10, 64)
+		case "start":
+			h.Start, err = strconv.ParseInt(kv[1], 10, 64)
+		case "end":
+			h.End, err = strconv.ParseInt(kv[1], 10, 64)
+		case "count":
+			h.Count, err = strconv.Atoi(kv[1])
+		}
+		if err != nil {
+			return h, errors.New("malformed batch header field " + field)
+		}
+	}
+	if h.Seq == 0 {
+		return h, errors.New("batch header without sequence number")
+	}
+	return h, nil
+}
+
+//Gap - Batches From to To (inclusive) missing in a stream
+type Gap struct {
+	Station string
+	Stream  string
+	Topic   string
+	Run     int64
+	From    uint64
+	To      uint64
+}
+
+//Size - Number of missing batches
+func (g Gap) Size() uint64 {
+	return g.To - g.From + 1
+}
+
+//Result - What a batch revealed. Gap is set when batches before it are missing.
+type Result struct {
+	Gap       *Gap
+	Duplicate bool
+	Reordered bool
+}
+
+//Stats - Counters of a stream, as served in JSON
+type Stats struct {
+	Station    string  `json:"station"`
+	Stream     string  `json:"stream"`
+	Topic      string  `json:"topic"`
+	Run        int64   `json:"run"`
+	FirstSeq   uint64  `json:"firstSeq"`
+	LastSeq    uint64  `json:"lastSeq"`
+	Batches    int64   `json:"batches"`
+	Records    int64   `json:"records"`
+	Missing    int64   `json:"missing"`
+	Recovered  int64   `json:"recovered"`
+	Duplicates int64   `json:"duplicates"`
+	Reordered  int64   `json:"reordered"`
+	Restarts   int64   `json:"restarts"`
+	LossRatio  float64 `json:"lossRatio"`
+	LastEnd    int64   `json:"lastEnd"`
+}
+
+// State of one stream: station, stream and topic
+type stream struct {
+	stats   Stats
+	missing map[uint64]bool
+}
+
+//Tracker - Sequence numbers of the received batches per stream
+type Tracker struct {
+	mutex   sync.Mutex
+	streams map[string]*stream
+}
+
+//NewTracker - Empty tracker
+func NewTracker() *Tracker {
+	return &Tracker{streams: make(map[string]*stream)}
+}
+
+//Track - Account a batch received on a topic. Gaps, duplicates and reordered
+// batches are logged. A new run of the publisher starts the stream again.
+func (t *Tracker) Track(h Header, topicName string) Result {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	key := h.Station + " " + h.Stream + " " + topicName
+	s, ok := t.streams[key]
+	if !ok || h.Run > s.stats.Run {
+		if ok {
+			log.Info("Station ", h.Station, " stream ", h.Stream, " restarted (run ", h.Run, ")")
+		}
+		restarts := int64(0)
+		if ok {
+			restarts = s.stats.Restarts + 1
+		}
+		s = &stream{
+			stats:   Stats{Station: h.Station, Stream: h.Stream, Topic: topicName, Run: h.Run, FirstSeq: h.Seq, LastSeq: h.Seq, Restarts: restarts},
+			missing: make(map[uint64]bool),
+		}
+		t.streams[key] = s
+		s.received(h)
+		return Result{}
+	}
+
+	result := Result{}
+	switch {
+	case h.Run < s.stats.Run:
+		// Late batch of the previous run, e.g. replayed from the spool
+		result.Reordered = true
+		s.stats.Reordered++
+		log.Warn("Station ", h.Station, " stream ", h.Stream, ": batch ", h.Seq, " of a previous run received late")
+
+	case h.Seq == s.stats.LastSeq+1:
+		// Next batch, nothing missing
+
+	case h.Seq > s.stats.LastSeq:
+		gap := &Gap{Station: h.Station, Stream: h.Stream, Topic: topicName, Run: h.Run, From: s.stats.LastSeq + 1, To: h.Seq - 1}
+		for seq := gap.From; seq <= gap.To && len(s.missing) < maxMissing; seq++ {
+			s.missing[seq] = true
+		}
+		s.stats.Missing += int64(gap.Size())
+		result.Gap = gap
+		log.Warn("Station ", h.Station, " stream ", h.Stream, ": ", gap.Size(), " batches missing (", gap.From, "-", gap.To, ")")
+
+	case s.missing[h.Seq]:
+		delete(s.missing, h.Seq)
+		s.stats.Missing--
+		s.stats.Recovered++
+		s.stats.Reordered++
+		result.Reordered = true
+		log.Warn("Station ", h.Station, " stream ", h.Stream, ": batch ", h.Seq, " received out of order")
+
+	default:
+		s.stats.Duplicates++
+		result.Duplicate = true
+		log.Warn("Station ", h.Station, " stream ", h.Stream, ": duplicate batch ", h.Seq)
+		return result
+	}
+
+	if h.Run == s.stats.Run && h.Seq > s.stats.LastSeq {
+		s.stats.LastSeq = h.Seq
+	}
+	s.received(h)
+	return result
+}
+
+// Count a received batch
+func (s *stream) received(h Header) {
+	s.stats.Batches++
+	s.stats.Records += int64(h.Count)
+	if h.End > s.stats.LastEnd {
+		s.stats.LastEnd = h.End
+	}
+
+	expected := s.stats.LastSeq - s.stats.FirstSeq + 1
+	s.stats.LossRatio = float64(s.stats.Missing) / float64(expected)
+}
+
+//Stats - Counters of all the streams, by station, stream and topic
+func (t *Tracker) Stats() []Stats {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	list := make([]Stats, 0, len(t.streams))
+	for _, s := range t.streams {
+		list = append(list, s.stats)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Station != list[j].Station {
+			return list[i].Station < list[j].Station
+		}
+		if list[i].Stream != list[j].Stream {
+			return list[i].Stream < list[j].Stream
+		}
+		return list[i].Topic < list[j].Topic
+	})
+	return list
+}
+
+//Check - Health check with the missing batches. Never fails.
+func (t *Tracker) Check() (string, error) {
+	var batches, missing, duplicates int64
+	for _, s := range t.Stats() {
+		batches += s.Batches
+		missing += s.Missing
+		duplicates += s.Duplicates
+	}
+
+	return strconv.FormatInt(batches, 10) + " batches, " + strconv.FormatInt(missing, 10) + " missing, " +
+		strconv.FormatInt(duplicates, 10) + " duplicates", nil
+}
+
+// Answer the counters of the streams in JSON
+func (t *Tracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t.Stats())
+}
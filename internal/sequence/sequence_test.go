@@ -0,0 +1,136 @@
+package sequence
+
+import (
+	"testing"
+)
+
+func TestLineSplit(t *testing.T) {
+	h := Header{Station: "sgn1", Stream: "positions", Run: 1792345327, Seq: 42, Start: 1792345320, End: 1792345325, Count: 2}
+	line := h.Line()
+	if want := "#batch station=sgn1 stream=positions run=1792345327 seq=42 start=1792345320 end=1792345325 count=2"; line != want {
+		t.Fatalf("Line = %q, want %q", line, want)
+	}
+
+	got, records, ok, err := Split([]byte(line + "\n3,1000\n3,1001\n"))
+	if err != nil || !ok || got != h || string(records) != "3,1000\n3,1001\n" {
+		t.Errorf("Split = %+v %q %v %v, want the header and the records", got, records, ok, err)
+	}
+}
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		ok      bool
+		err     bool
+		records string
+	}{
+		{"without header", "3,1000\n", false, false, "3,1000\n"},
+		{"header only", "#batch seq=1", true, false, ""},
+		{"names with spaces", "#batch station=a_b seq=7 count=0\n", true, false, ""},
+		{"unknown fields ignored", "#batch seq=3 extra=1\nx\n", true, false, "x\n"},
+		{"no sequence number", "#batch station=sgn1\n3,1000\n", false, true, "#batch station=sgn1\n3,1000\n"},
+		{"bad number", "#batch seq=x\n", false, true, "#batch seq=x\n"},
+		{"malformed field", "#batch seq=1 broken\n", false, true, "#batch seq=1 broken\n"},
+	}
+
+	for _, tt := range tests {
+		_, records, ok, err := Split([]byte(tt.data))
+		if ok != tt.ok || (err != nil) != tt.err || string(records) != tt.records {
+			t.Errorf("%s: ok %v error %v records %q, want %v %v %q", tt.name, ok, err, records, tt.ok, tt.err, tt.records)
+		}
+	}
+}
+
+func TestLineSpaces(t *testing.T) {
+	h, _, ok, err := Split([]byte(Header{Station: "station 1", Stream: "my  route", Seq: 1}.Line()))
+	if !ok || err != nil || h.Station != "station_1" || h.Stream != "my_route" {
+		t.Errorf("names with spaces read back as %q %q (%v %v)", h.Station, h.Stream, ok, err)
+	}
+}
+
+func TestTrack(t *testing.T) {
+	type batch struct {
+		run int64
+		seq uint64
+	}
+
+	tests := []struct {
+		name      string
+		batches   []batch
+		gap       *Gap
+		duplicate bool
+		reordered bool
+		stats     Stats
+	}{
+		{
+			name:    "in order",
+			batches: []batch{{1, 1}, {1, 2}, {1, 3}},
+			stats:   Stats{FirstSeq: 1, LastSeq: 3, Batches: 3},
+		},
+		{
+			name:    "gap",
+			batches: []batch{{1, 1}, {1, 5}},
+			gap:     &Gap{Station: "sgn1", Stream: "s", Topic: "t", Run: 1, From: 2, To: 4},
+			stats:   Stats{FirstSeq: 1, LastSeq: 5, Batches: 2, Missing: 3, LossRatio: 0.6},
+		},
+		{
+			name:      "late batch fills the gap",
+			batches:   []batch{{1, 1}, {1, 3}, {1, 2}},
+			reordered: true,
+			stats:     Stats{FirstSeq: 1, LastSeq: 3, Batches: 3, Recovered: 1, Reordered: 1},
+		},
+		{
+			name:      "duplicate",
+			batches:   []batch{{1, 1}, {1, 2}, {1, 2}},
+			duplicate: true,
+			stats:     Stats{FirstSeq: 1, LastSeq: 2, Batches: 2, Duplicates: 1},
+		},
+		{
+			name:    "new run",
+			batches: []batch{{1, 1}, {1, 2}, {2, 1}},
+			stats:   Stats{Run: 2, FirstSeq: 1, LastSeq: 1, Batches: 1, Restarts: 1},
+		},
+		{
+			name:      "previous run",
+			batches:   []batch{{2, 1}, {1, 9}},
+			reordered: true,
+			stats:     Stats{Run: 2, FirstSeq: 1, LastSeq: 1, Batches: 2, Reordered: 1},
+		},
+	}
+
+	for _, tt := range tests {
+		tracker := NewTracker()
+
+		var result Result
+		for _, b := range tt.batches {
+			result = tracker.Track(Header{Station: "sgn1", Stream: "s", Run: b.run, Seq: b.seq}, "t")
+		}
+
+		if (result.Gap == nil) != (tt.gap == nil) || (result.Gap != nil && *result.Gap != *tt.gap) {
+			t.Errorf("%s: gap %+v, want %+v", tt.name, result.Gap, tt.gap)
+		}
+		if result.Duplicate != tt.duplicate || result.Reordered != tt.reordered {
+			t.Errorf("%s: duplicate %v reordered %v, want %v %v", tt.name, result.Duplicate, result.Reordered, tt.duplicate, tt.reordered)
+		}
+
+		stats := tracker.Stats()
+		if len(stats) != 1 {
+			t.Fatalf("%s: %d streams, want 1", tt.name, len(stats))
+		}
+		want := tt.stats
+		want.Station, want.Stream, want.Topic = "sgn1", "s", "t"
+		if want.Run == 0 {
+			want.Run = 1
+		}
+		if stats[0] != want {
+			t.Errorf("%s: stats %+v, want %+v", tt.name, stats[0], want)
+		}
+	}
+}
+
+func TestGapSize(t *testing.T) {
+	if size := (Gap{From: 2, To: 4}).Size(); size != 3 {
+		t.Errorf("Size = %d, want 3", size)
+	}
+}
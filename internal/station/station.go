@@ -0,0 +1,211 @@
+// ----------------------------------------------------------------------------
+// Station status
+// Birth, heartbeat and last will messages of the publishers, and the
+// registry the subscribers use to follow the liveness of the stations
+// Contact: Hugo Cruz - hugo.m.cruz@gmail.com
+// ----------------------------------------------------------------------------
+
+package station
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hugomcruz/dump1090-mqtt/internal/topic"
+	log "github.com/sirupsen/logrus"
+)
+
+// Events of the status messages
+const (
+	Birth     = "birth"
+	Heartbeat = "heartbeat"
+	Shutdown  = "shutdown"
+	Lost      = "lost"
+)
+
+// Stations are stale after this number of missed heartbeats
+const missedHeartbeats = 3
+
+//Status - Retained message on the status topic of a station
+type Status struct {
+	Station           string           `json:"station"`
+	Online            bool             `json:"online"`
+	Event             string           `json:"event"`
+	Version           string           `json:"version,omitempty"`
+	Timestamp         int64            `json:"timestamp,omitempty"`
+	Uptime            int64            `json:"uptime,omitempty"`
+	HeartbeatInterval int              `json:"heartbeatInterval,omitempty"`
+	Input             string           `json:"input,omitempty"`
+	Receiver          *Receiver        `json:"receiver,omitempty"`
+	Config            interface{}      `json:"config,omitempty"`
+	Rates             *Rates           `json:"rates,omitempty"`
+	BatchWindows      map[string]int64 `json:"batchWindows,omitempty"`
+}
+
+//Receiver - Location of the receiver
+type Receiver struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Altitude  float64 `json:"altitude"`
+}
+
+//Rates - Message rates per second since the previous heartbeat
+type Rates struct {
+	Lines   float64 `json:"lines"`
+	Records float64 `json:"records"`
+	Batches float64 `json:"batches"`
+	Bytes   float64 `json:"bytes"`
+}
+
+//Liveness - What a subscriber knows about a station
+type Liveness struct {
+	Station   string    `json:"station"`
+	Online    bool      `json:"online"`
+	Alive     bool      `json:"alive"`
+	Event     string    `json:"event"`
+	Version   string    `json:"version,omitempty"`
+	Uptime    int64     `json:"uptime"`
+	LastSeen  time.Time `json:"lastSeen"`
+	heartbeat time.Duration
+}
+
+//Registry - Stations seen on the status topic
+type Registry struct {
+	mutex    sync.Mutex
+	template topic.Template
+	stations map[string]*Liveness
+}
+
+//NewRegistry - Registry for a status topic template, e.g. adsb/{station}/status
+func NewRegistry(statusTopic string) *Registry {
+	return &Registry{
+		template: topic.Parse(statusTopic),
+		stations: make(map[string]*Liveness),
+	}
+}
+
+//Filter - Subscription filter of the status topic
+func (r *Registry) Filter() string {
+	return r.template.Filter()
+}
+
+//Update - Update the registry with a status message and log the changes
+func (r *Registry) Update(topicName string, payload []byte, now time.Time) {
+	var status Status
+	if err := json.Unmarshal(payload, &status); err != nil {
+		log.Warn("Invalid station status on ", topicName, ": ", err.Error())
+		return
+	}
+
+	id := status.Station
+	if values, ok := r.template.Match(topicName); ok && values[topic.Station] != "" {
+		id = values[topic.Station]
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	station, ok := r.stations[id]
+	if !ok {
+		station = &Liveness{Station: id}
+		r.stations[id] = station
+	}
+
+	if station.Online != status.Online || !ok {
+		if status.Online {
+			log.Info("Station ", id, " is online (", status.Event, ", version ", status.Version, ")")
+		} else {
+			log.Warn("Station ", id, " is offline (", status.Event, ")")
+		}
+	}
+
+	station.Online = status.Online
+	station.Alive = status.Online
+	station.Event = status.Event
+	station.Uptime = status.Uptime
+	station.LastSeen = now
+	if status.Version != "" {
+		station.Version = status.Version
+	}
+	if status.HeartbeatInterval > 0 {
+		station.heartbeat = time.Duration(status.HeartbeatInterval) * time.Second
+	}
+}
+
+//Check - Mark the online stations that missed their heartbeats and log them
+func (r *Registry) Check(now time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, station := range r.stations {
+		if !station.Online || station.heartbeat == 0 {
+			continue
+		}
+
+		alive := now.Sub(station.LastSeen) < missedHeartbeats*station.heartbeat
+		if station.Alive && !alive {
+			log.Warn("Station ", station.Station, " missed its heartbeats, last seen ", station.LastSeen.Format(time.RFC3339))
+		}
+		station.Alive = alive
+	}
+}
+
+//Stations - Snapshot of the stations, sorted by ID
+func (r *Registry) Stations() []Liveness {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	stations := make([]Liveness, 0, len(r.stations))
+	for _, station := range r.stations {
+		stations = append(stations, *station)
+	}
+	sort.Slice(stations, func(i, j int) bool { return stations[i].Station < stations[j].Station })
+	return stations
+}
+
+//Summary - Health check with the stations alive, offline and stale. Informational, it never fails.
+func (r *Registry) Summary() (string, error) {
+	var alive, offline, stale []string
+	for _, station := range r.Stations() {
+		switch {
+		case !station.Online:
+			offline = append(offline, station.Station)
+		case !station.Alive:
+			stale = append(stale, station.Station)
+		default:
+			alive = append(alive, station.Station)
+		}
+	}
+
+	return strconv.Itoa(len(alive)) + " alive" + names(alive) + ", " + strconv.Itoa(len(offline)) + " offline" + names(offline) +
+		", " + strconv.Itoa(len(stale)) + " missing heartbeats" + names(stale), nil
+}
+
+// Station IDs in parentheses, empty without stations
+func names(ids []string) string {
+	if len(ids) == 0 {
+		return ""
+	}
+	return " (" + strings.Join(ids, ", ") + ")"
+}
+
+// Answer the stations in JSON
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(r.Stations())
+}
+
+//Monitor - Check the heartbeats periodically in a goroutine
+func (r *Registry) Monitor(interval time.Duration) {
+	go func() {
+		for {
+			time.Sleep(interval)
+			r.Check(time.Now())
+		}
+	}()
+}
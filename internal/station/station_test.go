@@ -0,0 +1,101 @@
+package station
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Status message received on a topic
+type update struct {
+	topic   string
+	payload []byte
+}
+
+func status(station string, online bool, event string, heartbeat int) []byte {
+	payload, _ := json.Marshal(Status{Station: station, Online: online, Event: event, HeartbeatInterval: heartbeat})
+	return payload
+}
+
+func TestRegistry(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		updates []update
+		check   time.Duration
+		summary string
+	}{
+		{
+			name:    "no stations",
+			summary: "0 alive, 0 offline, 0 missing heartbeats",
+		},
+		{
+			name:    "birth",
+			updates: []update{{"adsb/sgn1/status", status("sgn1", true, "birth", 60)}},
+			summary: "1 alive (sgn1), 0 offline, 0 missing heartbeats",
+		},
+		{
+			name:    "station of the topic",
+			updates: []update{{"adsb/han1/status", status("other", true, "birth", 60)}},
+			summary: "1 alive (han1), 0 offline, 0 missing heartbeats",
+		},
+		{
+			name: "last will",
+			updates: []update{
+				{"adsb/sgn1/status", status("sgn1", true, "birth", 60)},
+				{"adsb/sgn1/status", status("sgn1", false, "will", 0)},
+			},
+			summary: "0 alive, 1 offline (sgn1), 0 missing heartbeats",
+		},
+		{
+			name: "missed heartbeats",
+			updates: []update{
+				{"adsb/sgn1/status", status("sgn1", true, "birth", 60)},
+				{"adsb/han1/status", status("han1", true, "birth", 600)},
+			},
+			check:   3 * time.Minute,
+			summary: "1 alive (han1), 0 offline, 1 missing heartbeats (sgn1)",
+		},
+		{
+			name:    "invalid status ignored",
+			updates: []update{{"adsb/sgn1/status", []byte("{")}},
+			summary: "0 alive, 0 offline, 0 missing heartbeats",
+		},
+	}
+
+	for _, tt := range tests {
+		r := NewRegistry("adsb/{station}/status")
+		for _, u := range tt.updates {
+			r.Update(u.topic, u.payload, now)
+		}
+		r.Check(now.Add(tt.check))
+
+		if summary, err := r.Summary(); err != nil || summary != tt.summary {
+			t.Errorf("%s: Summary = %q (%v), want %q", tt.name, summary, err, tt.summary)
+		}
+	}
+}
+
+func TestRegistryHTTP(t *testing.T) {
+	r := NewRegistry("adsb/{station}/status")
+	if r.Filter() != "adsb/+/status" {
+		t.Errorf("Filter = %q", r.Filter())
+	}
+
+	now := time.Now()
+	r.Update("adsb/sgn1/status", status("sgn1", true, "birth", 60), now)
+	r.Update("adsb/han1/status", status("han1", false, "shutdown", 60), now)
+
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, httptest.NewRequest("GET", "/stations", nil))
+
+	var stations []Liveness
+	if err := json.Unmarshal(recorder.Body.Bytes(), &stations); err != nil {
+		t.Fatal(err)
+	}
+	if len(stations) != 2 || stations[0].Station != "han1" || stations[0].Online || !stations[1].Alive || stations[1].Event != "birth" {
+		t.Errorf("stations %+v, want han1 offline then sgn1 alive", stations)
+	}
+}
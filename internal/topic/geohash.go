@@ -0,0 +1,52 @@
+// ----------------------------------------------------------------------------
+// Geohash encoding for the {geohash} placeholder
+//
+// Contact: Hugo Cruz - hugo.m.cruz@gmail.com
+// ----------------------------------------------------------------------------
+
+package topic
+
+// Geohash base32 alphabet
+const geohashBase32 = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+//EncodeGeohash - Geohash of a position with the given number of characters
+func EncodeGeohash(latitude float64, longitude float64, precision int) string {
+	latRange := [2]float64{-90.0, 90.0}
+	lonRange := [2]float64{-180.0, 180.0}
+
+	hash := make([]byte, 0, precision)
+	bit := 0
+	ch := 0
+	even := true
+
+	for len(hash) < precision {
+		if even {
+			mid := (lonRange[0] + lonRange[1]) / 2
+			if longitude >= mid {
+				ch |= 1 << uint(4-bit)
+				lonRange[0] = mid
+			} else {
+				lonRange[1] = mid
+			}
+		} else {
+			mid := (latRange[0] + latRange[1]) / 2
+			if latitude >= mid {
+				ch |= 1 << uint(4-bit)
+				latRange[0] = mid
+			} else {
+				latRange[1] = mid
+			}
+		}
+		even = !even
+
+		if bit < 4 {
+			bit++
+		} else {
+			hash = append(hash, geohashBase32[ch])
+			bit = 0
+			ch = 0
+		}
+	}
+
+	return string(hash)
+}
@@ -0,0 +1,117 @@
+// ----------------------------------------------------------------------------
+// MQTT topic templates
+// Topics with {placeholder} levels, e.g. adsb/{station}/{source}/{type}
+// Contact: Hugo Cruz - hugo.m.cruz@gmail.com
+// ----------------------------------------------------------------------------
+
+package topic
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Placeholder names known by the publisher
+const (
+	Station = "station"
+	Source  = "source"
+	Type    = "type"
+	Geohash = "geohash"
+)
+
+// Value used when a placeholder has no value
+const unknown = "unknown"
+
+var placeholderRegexp = regexp.MustCompile(`\{([a-z]+)\}`)
+
+//Template - Parsed MQTT topic template
+type Template struct {
+	raw     string
+	names   []string
+	matcher *regexp.Regexp
+}
+
+//Parse - Parse a topic template. A topic without placeholders is a valid template.
+func Parse(template string) Template {
+	t := Template{raw: template}
+
+	for _, m := range placeholderRegexp.FindAllStringSubmatch(template, -1) {
+		t.names = append(t.names, m[1])
+	}
+
+	// Build the matcher: literal parts are quoted, placeholders take a full level part
+	pattern := ""
+	last := 0
+	for _, idx := range placeholderRegexp.FindAllStringIndex(template, -1) {
+		pattern += regexp.QuoteMeta(template[last:idx[0]]) + "([^/]+)"
+		last = idx[1]
+	}
+	pattern += regexp.QuoteMeta(template[last:])
+	t.matcher = regexp.MustCompile("^" + pattern + "$")
+
+	return t
+}
+
+//String - The template as configured
+func (t Template) String() string {
+	return t.raw
+}
+
+//Has - Check if the template uses the placeholder
+func (t Template) Has(name string) bool {
+	for _, n := range t.names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+//Expand - Replace the placeholders with the values. Missing values expand to "unknown".
+func (t Template) Expand(values map[string]string) string {
+	if len(t.names) == 0 {
+		return t.raw
+	}
+
+	return placeholderRegexp.ReplaceAllStringFunc(t.raw, func(p string) string {
+		value := values[p[1:len(p)-1]]
+		if value == "" {
+			return unknown
+		}
+		return sanitize(value)
+	})
+}
+
+//Filter - MQTT subscription filter for the template. Levels with placeholders become "+".
+func (t Template) Filter() string {
+	if len(t.names) == 0 {
+		return t.raw
+	}
+
+	levels := strings.Split(t.raw, "/")
+	for i, level := range levels {
+		if placeholderRegexp.MatchString(level) {
+			levels[i] = "+"
+		}
+	}
+	return strings.Join(levels, "/")
+}
+
+//Match - Extract the placeholder values from a received topic
+func (t Template) Match(topic string) (map[string]string, bool) {
+	m := t.matcher.FindStringSubmatch(topic)
+	if m == nil {
+		return nil, false
+	}
+
+	values := make(map[string]string, len(t.names))
+	for i, name := range t.names {
+		values[name] = m[i+1]
+	}
+	return values, true
+}
+
+// Values must not create new levels or wildcards
+func sanitize(value string) string {
+	return strings.NewReplacer("/", "_", "+", "_", "#", "_").Replace(value)
+}
@@ -0,0 +1,98 @@
+package topic
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExpand(t *testing.T) {
+	tests := []struct {
+		template string
+		values   map[string]string
+		want     string
+	}{
+		{"adsb/all", map[string]string{Station: "sgn1"}, "adsb/all"},
+		{"adsb/{station}/{type}", map[string]string{Station: "sgn1", Type: "3"}, "adsb/sgn1/3"},
+		{"adsb/{station}/{source}", map[string]string{Station: "sgn1"}, "adsb/sgn1/unknown"},
+		{"adsb/{station}/{geohash}", map[string]string{Station: "a/b+c#", Geohash: "w3gv"}, "adsb/a_b_c_/w3gv"},
+		{"adsb/{station}-{type}", map[string]string{Station: "sgn1", Type: "3"}, "adsb/sgn1-3"},
+	}
+
+	for _, tt := range tests {
+		if got := Parse(tt.template).Expand(tt.values); got != tt.want {
+			t.Errorf("Expand(%q) = %q, want %q", tt.template, got, tt.want)
+		}
+	}
+}
+
+func TestFilter(t *testing.T) {
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{"adsb/all", "adsb/all"},
+		{"adsb/{station}/{type}", "adsb/+/+"},
+		{"adsb/{station}-raw/data", "adsb/+/data"},
+	}
+
+	for _, tt := range tests {
+		if got := Parse(tt.template).Filter(); got != tt.want {
+			t.Errorf("Filter(%q) = %q, want %q", tt.template, got, tt.want)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		template string
+		topic    string
+		values   map[string]string
+		ok       bool
+	}{
+		{"adsb/{station}/{type}", "adsb/sgn1/3", map[string]string{Station: "sgn1", Type: "3"}, true},
+		{"adsb/{station}-raw", "adsb/sgn1-raw", map[string]string{Station: "sgn1"}, true},
+		{"adsb/all", "adsb/all", map[string]string{}, true},
+		{"adsb/{station}/{type}", "adsb/sgn1", nil, false},
+		{"adsb/{station}", "adsb/sgn1/3", nil, false},
+		{"adsb.{station}", "adsbxsgn1", nil, false},
+	}
+
+	for _, tt := range tests {
+		values, ok := Parse(tt.template).Match(tt.topic)
+		if ok != tt.ok || (ok && !reflect.DeepEqual(values, tt.values)) {
+			t.Errorf("Match(%q, %q) = %v %v, want %v %v", tt.template, tt.topic, values, ok, tt.values, tt.ok)
+		}
+	}
+}
+
+func TestHas(t *testing.T) {
+	template := Parse("adsb/{station}/{geohash}")
+	if !template.Has(Geohash) || template.Has(Type) {
+		t.Errorf("Has: geohash %v, type %v", template.Has(Geohash), template.Has(Type))
+	}
+	if template.String() != "adsb/{station}/{geohash}" {
+		t.Errorf("String = %q", template.String())
+	}
+}
+
+func TestEncodeGeohash(t *testing.T) {
+	tests := []struct {
+		latitude  float64
+		longitude float64
+		precision int
+		want      string
+	}{
+		{57.64911, 10.40744, 11, "u4pruydqqvj"},
+		{0, 0, 5, "s0000"},
+		{-90, -180, 5, "00000"},
+		{90, 180, 5, "zzzzz"},
+		{57.64911, 10.40744, 1, "u"},
+		{57.64911, 10.40744, 0, ""},
+	}
+
+	for _, tt := range tests {
+		if got := EncodeGeohash(tt.latitude, tt.longitude, tt.precision); got != tt.want {
+			t.Errorf("EncodeGeohash(%v, %v, %d) = %q, want %q", tt.latitude, tt.longitude, tt.precision, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+// ----------------------------------------------------------------------------
+// Aircraft tracking
+// Keeps the last known state of each aircraft heard by dump1090
+// Contact: Hugo Cruz - hugo.m.cruz@gmail.com
+// ----------------------------------------------------------------------------
+
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/hugomcruz/dump1090-mqtt/internal/topic"
+)
+
+// Aircraft not heard for this long are removed from the table
+const aircraftExpiry = 5 * time.Minute
+
+// Last known state of an aircraft
+type aircraftState struct {
+	hexIdent    string
+	callSign    string
+	latitude    float64
+	longitude   float64
+	hasPosition bool
+	altitude    int64
+	hasAltitude bool
+	firstSeen   time.Time
+	lastSeen    time.Time
+}
+
+// Reduced record ready to be batched, with the aircraft state at the time
+type record struct {
+	recordType  string
+	hexIdent    string
+	line        string
+	source      string
+	latitude    float64
+	longitude   float64
+	hasPosition bool
+}
+
+// Aircraft table indexed by ICAO hex address
+var aircraftTable = make(map[string]*aircraftState)
+
+// Update the aircraft table with a dump1090 line
+func trackAircraft(radarData radarRawLine, now time.Time) *aircraftState {
+	if radarData.hexIdent == "" {
+		return nil
+	}
+
+	aircraft, ok := aircraftTable[radarData.hexIdent]
+	if !ok {
+		aircraft = &aircraftState{hexIdent: radarData.hexIdent, firstSeen: now}
+		aircraftTable[radarData.hexIdent] = aircraft
+	}
+	aircraft.lastSeen = now
+
+	if radarData.callSign != "" {
+		aircraft.callSign = radarData.callSign
+	}
+	if radarData.hasPosition {
+		aircraft.latitude = radarData.latitude
+		aircraft.longitude = radarData.longitude
+		aircraft.hasPosition = true
+	}
+	if radarData.hasAltitude {
+		aircraft.altitude = radarData.altitude
+		aircraft.hasAltitude = true
+	}
+
+	return aircraft
+}
+
+// Remove the aircraft that were not heard for a while
+func expireAircraft(now time.Time) {
+	for hexIdent, aircraft := range aircraftTable {
+		if now.Sub(aircraft.lastSeen) > aircraftExpiry {
+			delete(aircraftTable, hexIdent)
+		}
+	}
+}
+
+// Create the record from a decoded line, using the last known
+// position of the aircraft when the line has none
+func newRecord(line string, aircraft *aircraftState) record {
+	rec := record{line: line}
+
+	// Decoded records start with type, timestamp and hex address
+	fields := strings.SplitN(line, ",", 4)
+	rec.recordType = fields[0]
+	if len(fields) > 2 {
+		rec.hexIdent = fields[2]
+	}
+
+	if aircraft != nil && aircraft.hasPosition {
+		rec.latitude = aircraft.latitude
+		rec.longitude = aircraft.longitude
+		rec.hasPosition = true
+	}
+
+	return rec
+}
+
+// Placeholder values to expand the topic template of a record
+func topicValues(rec record) map[string]string {
+	values := map[string]string{
+		topic.Station: configuration.StationID,
+		topic.Source:  configuration.Source,
+		topic.Type:    rec.recordType,
+	}
+
+	// Connection accepted in listen mode
+	if rec.source != "" {
+		values[topic.Source] = rec.source
+	}
+
+	if rec.hasPosition {
+		values[topic.Geohash] = topic.EncodeGeohash(rec.latitude, rec.longitude, configuration.GeohashPrecision)
+	}
+
+	return values
+}
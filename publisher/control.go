@@ -0,0 +1,363 @@
+// ----------------------------------------------------------------------------
+// Remote control
+// Commands received on the station command topic, authenticated with HMAC
+// Contact: Hugo Cruz - hugo.m.cruz@gmail.com
+// ----------------------------------------------------------------------------
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/hugomcruz/dump1090-mqtt/internal/codec"
+	"github.com/hugomcruz/dump1090-mqtt/internal/config"
+	"github.com/hugomcruz/dump1090-mqtt/internal/topic"
+	log "github.com/sirupsen/logrus"
+)
+
+// Commands older or newer than this are rejected
+const controlMaxSkew = time.Minute
+
+// Command received on the control topic. The signature is the hex HMAC-SHA256
+// with the shared secret of: topic + "\n" + id + "\n" + command + "\n" + args + "\n" + timestamp,
+// where topic is the control topic of the station, so a command signed for
+// one station is rejected by the others sharing the secret
+type controlCommand struct {
+	ID        string          `json:"id"`
+	Command   string          `json:"command"`
+	Args      json.RawMessage `json:"args,omitempty"`
+	Timestamp int64           `json:"timestamp"`
+	Signature string          `json:"signature"`
+}
+
+// Reply sent to the reply topic
+type controlReply struct {
+	ID        string      `json:"id"`
+	Command   string      `json:"command"`
+	OK        bool        `json:"ok"`
+	Error     string      `json:"error,omitempty"`
+	Result    interface{} `json:"result,omitempty"`
+	Timestamp int64       `json:"timestamp"`
+}
+
+// Result of the status command
+type statusResult struct {
+	Station        string        `json:"station"`
+	Uptime         int64         `json:"uptime"`
+	Paused         bool          `json:"paused"`
+	Dump1090       bool          `json:"dump1090Connected"`
+	Codec          string        `json:"codec"`
+	LogLevel       string        `json:"logLevel"`
+	Aircraft       int           `json:"aircraft"`
+	LinesRead      int64         `json:"linesRead"`
+	RecordsBatched int64         `json:"recordsBatched"`
+	BatchesSent    int64         `json:"batchesSent"`
+	Routes         []routeStatus `json:"routes"`
+}
+
+// Route in the status result
+type routeStatus struct {
+	Name       string `json:"name"`
+	TimeWindow int64  `json:"batchTimeWindow"`
+	Topic      string `json:"topic"`
+	QoS        byte   `json:"qos"`
+}
+
+// Authenticated commands, executed by the main loop
+var commands = make(chan controlCommand, 10)
+
+// Commands already received, to reject replays
+var seenCommands = make(map[string]time.Time)
+var seenCommandsMutex sync.Mutex
+
+// Expand a station topic template (control, status, coverage)
+func stationTopic(template string) string {
+	return topic.Parse(template).Expand(map[string]string{
+		topic.Station: configuration.StationID,
+		topic.Source:  configuration.Source,
+	})
+}
+
+// Settings of the command handlers. They run on the goroutine of the MQTT
+// client, so they get a copy made by the main loop.
+type controlSettings struct {
+	topic      string
+	replyTopic string
+	secret     string
+}
+
+func newControlSettings() controlSettings {
+	settings := controlSettings{
+		topic:  stationTopic(configuration.ControlTopic),
+		secret: configuration.ControlSecret,
+	}
+	if configuration.ControlReplyTopic != "" {
+		settings.replyTopic = stationTopic(configuration.ControlReplyTopic)
+	}
+	return settings
+}
+
+// Handler that subscribes to the command topic on every connection to MQTT
+func subscribeControl(settings controlSettings) mqtt.OnConnectHandler {
+	return func(client mqtt.Client) {
+		if token := client.Subscribe(settings.topic, 1, settings.onMessage); token.Wait() && token.Error() != nil {
+			log.Error("Error subscribing to the command topic: ", token.Error())
+			return
+		}
+		quota.account(subscribeOverhead(settings.topic))
+		log.Info("Subscribed to the command topic: ", settings.topic)
+	}
+}
+
+// Callback for each command received
+func (settings controlSettings) onMessage(client mqtt.Client, message mqtt.Message) {
+	var cmd controlCommand
+
+	// Received bytes count in the quota too
+	quota.account(int64(len(message.Payload())) + publishOverhead(message.Topic(), len(message.Payload()), message.Qos()))
+
+	if err := json.Unmarshal(message.Payload(), &cmd); err != nil {
+		log.Warn("Invalid command received: ", err.Error())
+		return
+	}
+
+	if err := authenticate(cmd, settings.topic, settings.secret, time.Now()); err != nil {
+		log.Warn("Command ", cmd.ID, " rejected: ", err.Error())
+		return
+	}
+
+	log.Info("Command received: ", cmd.Command, " (", cmd.ID, ")")
+
+	// Never block the MQTT client: when the main loop is behind the command is dropped
+	select {
+	case commands <- cmd:
+	default:
+		log.Warn("Command ", cmd.ID, " dropped: too many commands waiting")
+		settings.busy(client, cmd)
+	}
+}
+
+// Reply to a command dropped by onMessage. Published directly, the pending
+// messages belong to the main loop.
+func (settings controlSettings) busy(client mqtt.Client, cmd controlCommand) {
+	if settings.replyTopic == "" {
+		return
+	}
+
+	payload, _ := json.Marshal(controlReply{ID: cmd.ID, Command: cmd.Command, Error: "busy", Timestamp: time.Now().Unix()})
+	if !quota.allow(settings.replyTopic, len(payload), 1, time.Now()) {
+		return
+	}
+	client.Publish(settings.replyTopic, 1, false, payload)
+}
+
+// Check the signature for the control topic, the timestamp and that the
+// command was not seen before
+func authenticate(cmd controlCommand, topic string, secret string, now time.Time) error {
+	expected := commandSignature(secret, topic, cmd)
+	signature, err := hex.DecodeString(cmd.Signature)
+	if err != nil || !hmac.Equal(signature, expected) {
+		return errors.New("invalid signature")
+	}
+
+	skew := now.Sub(time.Unix(cmd.Timestamp, 0))
+	if skew > controlMaxSkew || skew < -controlMaxSkew {
+		return errors.New("timestamp out of range")
+	}
+
+	seenCommandsMutex.Lock()
+	defer seenCommandsMutex.Unlock()
+
+	for id, seen := range seenCommands {
+		if now.Sub(seen) > 2*controlMaxSkew {
+			delete(seenCommands, id)
+		}
+	}
+	if _, ok := seenCommands[cmd.ID]; ok || cmd.ID == "" {
+		return errors.New("replayed command")
+	}
+	seenCommands[cmd.ID] = now
+
+	return nil
+}
+
+// HMAC-SHA256 of the control topic and the command fields
+func commandSignature(secret string, topic string, cmd controlCommand) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(topic + "\n" + cmd.ID + "\n" + cmd.Command + "\n" + string(cmd.Args) + "\n" + strconv.FormatInt(cmd.Timestamp, 10)))
+	return mac.Sum(nil)
+}
+
+// Execute a command in the main loop
+func handleCommand(cmd controlCommand, now time.Time) controlReply {
+	reply := controlReply{ID: cmd.ID, Command: cmd.Command, OK: true, Timestamp: now.Unix()}
+
+	var err error
+	switch cmd.Command {
+	case "status":
+		reply.Result = currentStatus(now)
+	case "set-batch-window":
+		err = setBatchWindow(cmd.Args)
+	case "set-filters":
+		err = setFilters(cmd.Args)
+	case "set-codec":
+		err = setCodec(cmd.Args)
+	case "set-log-level":
+		err = setLogLevelCommand(cmd.Args)
+	case "pause":
+		paused = true
+		log.Info("Publishing paused")
+	case "resume":
+		paused = false
+		log.Info("Publishing resumed")
+	case "reconnect-dump1090":
+		input.reconnect()
+	default:
+		err = errors.New("unknown command")
+	}
+
+	if err != nil {
+		reply.OK = false
+		reply.Error = err.Error()
+		log.Warn("Command ", cmd.Command, " failed: ", err.Error())
+	}
+
+	return reply
+}
+
+// Publish the reply of a command
+func sendReply(client transport, reply controlReply) {
+	if configuration.ControlReplyTopic == "" {
+		return
+	}
+
+	payload, err := json.Marshal(reply)
+	if err != nil {
+		log.Error("Error creating the command reply: ", err.Error())
+		return
+	}
+	send(client, stationTopic(configuration.ControlReplyTopic), 1, false, payload)
+}
+
+// Current status of the publisher
+func currentStatus(now time.Time) statusResult {
+	status := statusResult{
+		Station:        configuration.StationID,
+		Uptime:         int64(now.Sub(startTime).Seconds()),
+		Paused:         paused,
+		Dump1090:       input.connected(),
+		Codec:          configuration.Codec,
+		LogLevel:       configuration.LogLevel,
+		Aircraft:       len(aircraftTable),
+		LinesRead:      stats.linesRead,
+		RecordsBatched: stats.recordsBatched,
+		BatchesSent:    stats.batchesSent,
+		Routes:         make([]routeStatus, 0, len(routes)),
+	}
+
+	for _, r := range routes {
+		status.Routes = append(status.Routes, routeStatus{Name: r.name, TimeWindow: r.timeWindow, Topic: r.topic.String(), QoS: r.qos})
+	}
+
+	return status
+}
+
+// Args: {"seconds": 5} for all the routes or {"route": "positions", "seconds": 5}.
+// The window stays until the next reload, with the adaptive window
+// {"seconds": 0} gives the routes back to it.
+func setBatchWindow(args json.RawMessage) error {
+	var params struct {
+		Route   string `json:"route"`
+		Seconds int64  `json:"seconds"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return err
+	}
+	adaptive := configuration.AdaptiveWindow.TargetBytes > 0
+	if params.Seconds < 0 || (params.Seconds == 0 && !adaptive) {
+		return errors.New("seconds must be positive")
+	}
+
+	found := false
+	for _, r := range routes {
+		if params.Route == "" || params.Route == r.name {
+			found = true
+			if params.Seconds == 0 {
+				r.pinned = false
+				log.Info("Batch window of route ", r.name, " adaptive again")
+				continue
+			}
+			r.timeWindow = params.Seconds
+			r.pinned = true
+			log.Info("Batch window of route ", r.name, " set to ", params.Seconds, "s")
+		}
+	}
+	if !found {
+		return errors.New("unknown route " + params.Route)
+	}
+	return nil
+}
+
+// Args: the Filters object of the configuration
+func setFilters(args json.RawMessage) error {
+	var config FilterConfig
+	if err := json.Unmarshal(args, &config); err != nil {
+		return err
+	}
+
+	newFilters, err := newFilter(config, configuration)
+	if err != nil {
+		return err
+	}
+
+	filter = newFilters
+	configuration.Filters = config
+	log.Info("Filters replaced")
+	return nil
+}
+
+// Args: {"codec": "gzip"}
+func setCodec(args json.RawMessage) error {
+	var params struct {
+		Codec string `json:"codec"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return err
+	}
+	if !codec.Valid(params.Codec) {
+		return errors.New("unknown codec " + params.Codec)
+	}
+
+	configuration.Codec = params.Codec
+	log.Info("Codec set to ", params.Codec)
+	return nil
+}
+
+// Args: {"level": "DEBUG"}
+func setLogLevelCommand(args json.RawMessage) error {
+	var params struct {
+		Level string `json:"level"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return err
+	}
+
+	switch params.Level {
+	case "DEBUG", "INFO", "WARN", "ERROR":
+	default:
+		return errors.New("unknown log level " + params.Level)
+	}
+
+	configuration.LogLevel = params.Level
+	config.SetLogLevel(params.Level)
+	log.Info("Log level set to ", params.Level)
+	return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Control topic of the tests
+const testControlTopic = "adsb/sgn1/cmd"
+
+// Command signed with the secret for the control topic of the tests
+func signedCommand(id string, command string, timestamp time.Time, secret string) controlCommand {
+	return signedFor(testControlTopic, id, command, timestamp, secret)
+}
+
+// Command signed with the secret for a control topic
+func signedFor(topic string, id string, command string, timestamp time.Time, secret string) controlCommand {
+	cmd := controlCommand{ID: id, Command: command, Timestamp: timestamp.Unix()}
+	cmd.Signature = hex.EncodeToString(commandSignature(secret, topic, cmd))
+	return cmd
+}
+
+// Received MQTT message
+type fakeMQTTMessage struct {
+	topic   string
+	payload []byte
+}
+
+func (m fakeMQTTMessage) Duplicate() bool   { return false }
+func (m fakeMQTTMessage) Qos() byte         { return 1 }
+func (m fakeMQTTMessage) Retained() bool    { return false }
+func (m fakeMQTTMessage) Topic() string     { return m.topic }
+func (m fakeMQTTMessage) MessageID() uint16 { return 1 }
+func (m fakeMQTTMessage) Payload() []byte   { return m.payload }
+func (m fakeMQTTMessage) Ack()              {}
+
+// MQTT client of the callbacks, only Publish is used
+type fakeMQTTClient struct {
+	mqtt.Client
+	transport *fakeTransport
+}
+
+func (c fakeMQTTClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	c.transport.Publish(topic, qos, retained, payload.([]byte))
+	return &mqtt.DummyToken{}
+}
+
+func TestAuthenticate(t *testing.T) {
+	seenCommands = make(map[string]time.Time)
+	now := time.Now()
+
+	tests := []struct {
+		name string
+		cmd  controlCommand
+		err  string
+	}{
+		{"valid", signedCommand("c1", "status", now, "secret"), ""},
+		{"replayed", signedCommand("c1", "status", now, "secret"), "replayed command"},
+		{"other secret", signedCommand("c2", "status", now, "other"), "invalid signature"},
+		{"too old", signedCommand("c3", "status", now.Add(-controlMaxSkew-time.Second), "secret"), "timestamp out of range"},
+		{"in the future", signedCommand("c4", "status", now.Add(controlMaxSkew+time.Second), "secret"), "timestamp out of range"},
+		{"without ID", signedCommand("", "status", now, "secret"), "replayed command"},
+		{"other station", signedFor("adsb/sgn2/cmd", "c6", "status", now, "secret"), "invalid signature"},
+	}
+
+	for _, tt := range tests {
+		err := authenticate(tt.cmd, testControlTopic, "secret", now)
+		if (tt.err == "" && err != nil) || (tt.err != "" && (err == nil || err.Error() != tt.err)) {
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.err)
+		}
+	}
+
+	cmd := signedCommand("c5", "status", now, "secret")
+	cmd.Command = "pause"
+	if err := authenticate(cmd, testControlTopic, "secret", now); err == nil {
+		t.Error("command changed after the signature accepted")
+	}
+}
+
+func TestBusyCommands(t *testing.T) {
+	fake := setupPublisher(t)
+	settings := controlSettings{topic: testControlTopic, replyTopic: "adsb/sgn1/reply", secret: "secret"}
+	client := fakeMQTTClient{transport: fake}
+
+	seenCommands = make(map[string]time.Time)
+	commands = make(chan controlCommand, 2)
+	defer func() { commands = make(chan controlCommand, 10) }()
+
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		payload, _ := json.Marshal(signedCommand("busy-"+strconv.Itoa(i), "status", now, "secret"))
+		settings.onMessage(client, fakeMQTTMessage{topic: settings.topic, payload: payload})
+	}
+
+	if len(commands) != 2 {
+		t.Errorf("%d commands queued, want 2", len(commands))
+	}
+
+	messages := fake.published()
+	if len(messages) != 1 || messages[0].topic != settings.replyTopic {
+		t.Fatalf("replies %v, want one busy reply", messages)
+	}
+	var reply controlReply
+	if err := json.Unmarshal(messages[0].payload, &reply); err != nil || reply.Error != "busy" || reply.OK {
+		t.Errorf("reply %+v (%v), want the busy error", reply, err)
+	}
+}
+
+func TestCheckControlSecret(t *testing.T) {
+	checkChange(t, "without secret", func(c *Configuration) { c.ControlTopic = "adsb/{station}/cmd" }, "ControlSecret is required")
+	checkChange(t, "with secret", func(c *Configuration) { c.ControlTopic, c.ControlSecret = "adsb/{station}/cmd", "secret" }, "")
+}
@@ -0,0 +1,180 @@
+// ----------------------------------------------------------------------------
+// Receiver range, bearing and polar coverage statistics
+// Maximum range per bearing sector and altitude band, published as JSON
+// Contact: Hugo Cruz - hugo.m.cruz@gmail.com
+// ----------------------------------------------------------------------------
+
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Positions further than this are bad decodes and not counted
+const maxPlausibleRangeKm = 600.0
+
+// Polar coverage statistics since the start of the publisher
+type coverageStats struct {
+	sectors   int
+	bands     []int64
+	maxRange  [][]float64
+	overall   []float64
+	positions int64
+	since     time.Time
+	lastSent  time.Time
+	interval  time.Duration
+	topic     string
+}
+
+// Coverage document published to MQTT
+type coverageDocument struct {
+	Station    string         `json:"station"`
+	Receiver   receiverInfo   `json:"receiver"`
+	Since      int64          `json:"since"`
+	Timestamp  int64          `json:"timestamp"`
+	Positions  int64          `json:"positions"`
+	SectorSize float64        `json:"sectorSize"`
+	MaxRangeKm []float64      `json:"maxRangeKm"`
+	Bands      []coverageBand `json:"bands"`
+}
+
+// Receiver location
+type receiverInfo struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Altitude  float64 `json:"altitude"`
+}
+
+// Maximum range per sector of an altitude band
+type coverageBand struct {
+	MinAltitude int64     `json:"minAltitude"`
+	MaxAltitude int64     `json:"maxAltitude,omitempty"`
+	MaxRangeKm  []float64 `json:"maxRangeKm"`
+}
+
+var coverage *coverageStats
+
+// Check if the receiver location is configured
+func receiverKnown() bool {
+	return configuration.ReceiverLatitude != 0 || configuration.ReceiverLongitude != 0
+}
+
+// Create the coverage statistics from the configuration
+func newCoverage(configuration Configuration, now time.Time) *coverageStats {
+	c := &coverageStats{
+		sectors:  configuration.CoverageSectors,
+		bands:    configuration.CoverageAltitudeBands,
+		since:    now,
+		lastSent: now,
+		interval: time.Duration(configuration.CoverageInterval) * time.Second,
+		topic:    stationTopic(configuration.CoverageTopic),
+	}
+
+	c.overall = make([]float64, c.sectors)
+	c.maxRange = make([][]float64, len(c.bands))
+	for i := range c.maxRange {
+		c.maxRange[i] = make([]float64, c.sectors)
+	}
+
+	return c
+}
+
+// Append distance (km) and bearing (degrees) from the receiver to a position record
+func enrichPosition(line string, radarData radarRawLine) string {
+	if !radarData.hasPosition || !receiverKnown() {
+		return line + ",,"
+	}
+
+	distance := distanceKm(configuration.ReceiverLatitude, configuration.ReceiverLongitude, radarData.latitude, radarData.longitude)
+	bearing := bearingDegrees(configuration.ReceiverLatitude, configuration.ReceiverLongitude, radarData.latitude, radarData.longitude)
+
+	return line + "," + strconv.FormatFloat(distance, 'f', 1, 64) + "," + strconv.FormatFloat(bearing, 'f', 1, 64)
+}
+
+// Update the maximum ranges with a position
+func (c *coverageStats) add(radarData radarRawLine, aircraft *aircraftState) {
+	if c == nil || !radarData.hasPosition || !receiverKnown() {
+		return
+	}
+
+	distance := distanceKm(configuration.ReceiverLatitude, configuration.ReceiverLongitude, radarData.latitude, radarData.longitude)
+	if distance > maxPlausibleRangeKm {
+		return
+	}
+
+	bearing := bearingDegrees(configuration.ReceiverLatitude, configuration.ReceiverLongitude, radarData.latitude, radarData.longitude)
+	sector := int(bearing/(360/float64(c.sectors))) % c.sectors
+
+	c.positions++
+	c.overall[sector] = math.Max(c.overall[sector], distance)
+
+	if aircraft == nil || !aircraft.hasAltitude {
+		return
+	}
+
+	// Highest band with lower bound below the altitude
+	band := -1
+	for i, minAltitude := range c.bands {
+		if aircraft.altitude >= minAltitude {
+			band = i
+		}
+	}
+	if band >= 0 {
+		c.maxRange[band][sector] = math.Max(c.maxRange[band][sector], distance)
+	}
+}
+
+// Check if the coverage document must be published
+func (c *coverageStats) due(now time.Time) bool {
+	return c != nil && c.topic != "" && now.Sub(c.lastSent) >= c.interval
+}
+
+// Publish the coverage document (retained)
+func (c *coverageStats) publish(client transport, now time.Time) {
+	c.lastSent = now
+
+	document := coverageDocument{
+		Station: configuration.StationID,
+		Receiver: receiverInfo{
+			Latitude:  configuration.ReceiverLatitude,
+			Longitude: configuration.ReceiverLongitude,
+			Altitude:  configuration.ReceiverAltitude,
+		},
+		Since:      c.since.Unix(),
+		Timestamp:  now.Unix(),
+		Positions:  c.positions,
+		SectorSize: 360 / float64(c.sectors),
+		MaxRangeKm: roundRanges(c.overall),
+		Bands:      make([]coverageBand, len(c.bands)),
+	}
+
+	for i, minAltitude := range c.bands {
+		document.Bands[i] = coverageBand{MinAltitude: minAltitude, MaxRangeKm: roundRanges(c.maxRange[i])}
+		if i+1 < len(c.bands) {
+			document.Bands[i].MaxAltitude = c.bands[i+1] - 1
+		}
+	}
+
+	payload, err := json.Marshal(document)
+	if err != nil {
+		log.Error("Error creating the coverage document: ", err.Error())
+		return
+	}
+
+	log.Debug("Publishing coverage to ", c.topic, ": ", c.positions, " positions")
+	send(client, c.topic, 1, true, payload)
+}
+
+// Round the ranges to 0.1km for the document
+func roundRanges(ranges []float64) []float64 {
+	rounded := make([]float64, len(ranges))
+	for i, r := range ranges {
+		rounded[i] = math.Round(r*10) / 10
+	}
+	return rounded
+}
@@ -0,0 +1,258 @@
+// ----------------------------------------------------------------------------
+// Geofence and altitude filters
+// Drop the aircraft outside of the area of interest before batching
+// Contact: Hugo Cruz - hugo.m.cruz@gmail.com
+// ----------------------------------------------------------------------------
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//FilterConfig - Filters from the configuration
+type FilterConfig struct {
+	Areas               []AreaConfig
+	MinAltitude         int64
+	MaxAltitude         int64
+	PositionGracePeriod int `validate:"min=0"`
+}
+
+//AreaConfig - Circle (RadiusKm) or GeoJSON polygons area to include or exclude
+type AreaConfig struct {
+	Name      string
+	Mode      string  `validate:"oneof=include exclude"`
+	Latitude  float64 `validate:"min=-90,max=90"`
+	Longitude float64 `validate:"min=-180,max=180"`
+	RadiusKm  float64 `validate:"min=0"`
+	GeoJSON   string
+}
+
+// Area ready to be checked
+type area struct {
+	name      string
+	exclude   bool
+	latitude  float64
+	longitude float64
+	radiusKm  float64
+	polygons  [][][][]float64
+}
+
+// Compiled filters
+type recordFilter struct {
+	includes    []area
+	excludes    []area
+	minAltitude int64
+	maxAltitude int64
+	gracePeriod time.Duration
+}
+
+// GeoJSON object - only what is needed for polygons
+type geoJSON struct {
+	Type        string          `json:"type"`
+	Features    []geoJSON       `json:"features"`
+	Geometry    *geoJSON        `json:"geometry"`
+	Geometries  []geoJSON       `json:"geometries"`
+	Coordinates json.RawMessage `json:"coordinates"`
+}
+
+// Compile the filters from the configuration. Circles without a center are
+// around the receiver of that configuration.
+func newFilter(config FilterConfig, configuration Configuration) (*recordFilter, error) {
+	f := &recordFilter{
+		minAltitude: config.MinAltitude,
+		maxAltitude: config.MaxAltitude,
+		gracePeriod: time.Duration(config.PositionGracePeriod) * time.Second,
+	}
+
+	for _, ac := range config.Areas {
+		a := area{
+			name:      ac.Name,
+			latitude:  ac.Latitude,
+			longitude: ac.Longitude,
+			radiusKm:  ac.RadiusKm,
+		}
+
+		// Circles without a center are around the receiver
+		if ac.GeoJSON == "" && ac.Latitude == 0 && ac.Longitude == 0 {
+			if configuration.ReceiverLatitude == 0 && configuration.ReceiverLongitude == 0 {
+				return nil, errors.New("area " + ac.Name + ": needs a center or the receiver location")
+			}
+			a.latitude = configuration.ReceiverLatitude
+			a.longitude = configuration.ReceiverLongitude
+		}
+
+		switch ac.Mode {
+		case "", "include":
+		case "exclude":
+			a.exclude = true
+		default:
+			return nil, errors.New("area " + ac.Name + ": invalid mode " + ac.Mode + " (include or exclude)")
+		}
+
+		if ac.GeoJSON != "" {
+			polygons, err := loadPolygons(ac.GeoJSON)
+			if err != nil {
+				return nil, errors.New("area " + ac.Name + ": " + err.Error())
+			}
+			a.polygons = polygons
+		} else if ac.RadiusKm <= 0 {
+			return nil, errors.New("area " + ac.Name + ": needs RadiusKm or GeoJSON")
+		}
+
+		if a.exclude {
+			f.excludes = append(f.excludes, a)
+		} else {
+			f.includes = append(f.includes, a)
+		}
+
+		log.Info("Filter area ", ac.Name, ": ", ac.Mode, ", ", len(a.polygons), " polygons, radius ", ac.RadiusKm, "km")
+	}
+
+	return f, nil
+}
+
+// Read the polygons of a GeoJSON file
+func loadPolygons(filename string) ([][][][]float64, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var object geoJSON
+	if err := json.Unmarshal(data, &object); err != nil {
+		return nil, errors.New(filename + ": " + err.Error())
+	}
+
+	polygons := make([][][][]float64, 0)
+	if err := collectPolygons(object, &polygons); err != nil {
+		return nil, errors.New(filename + ": " + err.Error())
+	}
+	if len(polygons) == 0 {
+		return nil, errors.New(filename + ": no polygons found")
+	}
+
+	return polygons, nil
+}
+
+// Walk the GeoJSON object and collect the Polygon and MultiPolygon geometries
+func collectPolygons(object geoJSON, polygons *[][][][]float64) error {
+	switch object.Type {
+	case "FeatureCollection":
+		for _, feature := range object.Features {
+			if err := collectPolygons(feature, polygons); err != nil {
+				return err
+			}
+		}
+	case "Feature":
+		if object.Geometry != nil {
+			return collectPolygons(*object.Geometry, polygons)
+		}
+	case "GeometryCollection":
+		for _, geometry := range object.Geometries {
+			if err := collectPolygons(geometry, polygons); err != nil {
+				return err
+			}
+		}
+	case "Polygon":
+		var polygon [][][]float64
+		if err := json.Unmarshal(object.Coordinates, &polygon); err != nil {
+			return err
+		}
+		if err := checkPolygon(polygon); err != nil {
+			return err
+		}
+		*polygons = append(*polygons, polygon)
+	case "MultiPolygon":
+		var multiPolygon [][][][]float64
+		if err := json.Unmarshal(object.Coordinates, &multiPolygon); err != nil {
+			return err
+		}
+		for _, polygon := range multiPolygon {
+			if err := checkPolygon(polygon); err != nil {
+				return err
+			}
+		}
+		*polygons = append(*polygons, multiPolygon...)
+	}
+	return nil
+}
+
+// Check that the rings of a polygon have at least 4
+// positions with a longitude and a latitude
+func checkPolygon(polygon [][][]float64) error {
+	if len(polygon) == 0 {
+		return errors.New("polygon without rings")
+	}
+	for _, ring := range polygon {
+		if len(ring) < 4 {
+			return errors.New("polygon ring with less than 4 positions")
+		}
+		for _, position := range ring {
+			if len(position) < 2 {
+				return errors.New("position with less than 2 coordinates")
+			}
+		}
+	}
+	return nil
+}
+
+// Check if a position is inside the area
+func (a area) contains(lat float64, lon float64) bool {
+	if len(a.polygons) > 0 {
+		for _, polygon := range a.polygons {
+			if insidePolygon(lat, lon, polygon) {
+				return true
+			}
+		}
+		return false
+	}
+	return distanceKm(a.latitude, a.longitude, lat, lon) <= a.radiusKm
+}
+
+// Check if the records of the aircraft are forwarded.
+// Aircraft without a known position are forwarded during the grace period after first seen.
+func (f *recordFilter) accept(aircraft *aircraftState, now time.Time) bool {
+	if f == nil || aircraft == nil {
+		return true
+	}
+
+	// Altitude band. Unknown altitude is not filtered.
+	if aircraft.hasAltitude {
+		if f.minAltitude != 0 && aircraft.altitude < f.minAltitude {
+			return false
+		}
+		if f.maxAltitude != 0 && aircraft.altitude > f.maxAltitude {
+			return false
+		}
+	}
+
+	if len(f.includes) == 0 && len(f.excludes) == 0 {
+		return true
+	}
+
+	if !aircraft.hasPosition {
+		return now.Sub(aircraft.firstSeen) < f.gracePeriod
+	}
+
+	for _, a := range f.excludes {
+		if a.contains(aircraft.latitude, aircraft.longitude) {
+			return false
+		}
+	}
+
+	if len(f.includes) == 0 {
+		return true
+	}
+	for _, a := range f.includes {
+		if a.contains(aircraft.latitude, aircraft.longitude) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Square around Saigon with a hole in the middle, [longitude, latitude]
+const squareWithHole = `{"type":"FeatureCollection","features":[{"type":"Feature","geometry":{"type":"Polygon","coordinates":[
+	[[106,10],[107,10],[107,11],[106,11],[106,10]],
+	[[106.4,10.4],[106.6,10.4],[106.6,10.6],[106.4,10.6],[106.4,10.4]]]}}]}`
+
+func writeGeoJSON(t *testing.T, content string) string {
+	t.Helper()
+
+	file := filepath.Join(t.TempDir(), "area.geojson")
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestDistanceAndBearing(t *testing.T) {
+	tests := []struct {
+		name                string
+		lat1, lon1          float64
+		lat2, lon2          float64
+		distanceKm, bearing float64
+	}{
+		{"one degree north", 10, 106, 11, 106, 111.2, 0},
+		{"one degree east at the equator", 0, 106, 0, 107, 111.2, 90},
+		{"south", 11, 106, 10, 106, 111.2, 180},
+		{"west", 0, 107, 0, 106, 111.2, 270},
+		{"same position", 10, 106, 10, 106, 0, 0},
+	}
+
+	for _, tt := range tests {
+		if d := distanceKm(tt.lat1, tt.lon1, tt.lat2, tt.lon2); math.Abs(d-tt.distanceKm) > 0.1 {
+			t.Errorf("%s: distance %.1fkm, want %.1fkm", tt.name, d, tt.distanceKm)
+		}
+		if b := bearingDegrees(tt.lat1, tt.lon1, tt.lat2, tt.lon2); math.Abs(b-tt.bearing) > 0.01 {
+			t.Errorf("%s: bearing %.2f, want %.2f", tt.name, b, tt.bearing)
+		}
+	}
+}
+
+func TestInsidePolygon(t *testing.T) {
+	polygons, err := loadPolygons(writeGeoJSON(t, squareWithHole))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		lat, lon float64
+		inside   bool
+	}{
+		{"inside", 10.2, 106.2, true},
+		{"in the hole", 10.5, 106.5, false},
+		{"outside", 12, 106.5, false},
+		{"east", 10.5, 107.5, false},
+	}
+
+	for _, tt := range tests {
+		if got := insidePolygon(tt.lat, tt.lon, polygons[0]); got != tt.inside {
+			t.Errorf("%s: inside %v, want %v", tt.name, got, tt.inside)
+		}
+	}
+}
+
+func TestLoadPolygons(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		polygons int
+		err      string
+	}{
+		{"feature collection", squareWithHole, 1, ""},
+		{"multi polygon", `{"type":"MultiPolygon","coordinates":[[[[0,0],[1,0],[1,1],[0,0]]],[[[2,2],[3,2],[3,3],[2,2]]]]}`, 2, ""},
+		{"geometry collection", `{"type":"GeometryCollection","geometries":[{"type":"Point","coordinates":[0,0]},{"type":"Polygon","coordinates":[[[0,0],[1,0],[1,1],[0,0]]]}]}`, 1, ""},
+		{"no polygons", `{"type":"Point","coordinates":[0,0]}`, 0, "no polygons found"},
+		{"ring too short", `{"type":"Polygon","coordinates":[[[0,0],[1,0],[0,0]]]}`, 0, "less than 4 positions"},
+		{"position too short", `{"type":"Polygon","coordinates":[[[0,0],[1],[1,1],[0,0]]]}`, 0, "less than 2 coordinates"},
+		{"no rings", `{"type":"MultiPolygon","coordinates":[[]]}`, 0, "without rings"},
+		{"invalid JSON", `{"type":`, 0, "unexpected end"},
+	}
+
+	for _, tt := range tests {
+		polygons, err := loadPolygons(writeGeoJSON(t, tt.content))
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: error %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || len(polygons) != tt.polygons {
+			t.Errorf("%s: %d polygons (%v), want %d", tt.name, len(polygons), err, tt.polygons)
+		}
+	}
+}
+
+func TestNewFilter(t *testing.T) {
+	receiver := Configuration{ReceiverLatitude: 10.8, ReceiverLongitude: 106.6}
+
+	tests := []struct {
+		name          string
+		area          AreaConfig
+		configuration Configuration
+		err           string
+	}{
+		{"circle around the receiver", AreaConfig{Name: "local", RadiusKm: 100}, receiver, ""},
+		{"circle without center", AreaConfig{Name: "local", RadiusKm: 100}, Configuration{}, "needs a center"},
+		{"without radius", AreaConfig{Name: "local", Latitude: 10, Longitude: 106}, receiver, "needs RadiusKm or GeoJSON"},
+		{"invalid mode", AreaConfig{Name: "local", Mode: "around", RadiusKm: 100}, receiver, "invalid mode"},
+		{"missing file", AreaConfig{Name: "local", GeoJSON: filepath.Join(t.TempDir(), "missing")}, receiver, "area local"},
+	}
+
+	for _, tt := range tests {
+		_, err := newFilter(FilterConfig{Areas: []AreaConfig{tt.area}}, tt.configuration)
+		if (tt.err == "" && err != nil) || (tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err))) {
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestFilterAccept(t *testing.T) {
+	now := time.Now()
+	receiver := Configuration{ReceiverLatitude: 10.8, ReceiverLongitude: 106.6}
+
+	f, err := newFilter(FilterConfig{
+		Areas: []AreaConfig{
+			{Name: "local", RadiusKm: 250},
+			{Name: "base", Mode: "exclude", GeoJSON: writeGeoJSON(t, `{"type":"Polygon","coordinates":[[[106.9,10.9],[107.1,10.9],[107.1,11.1],[106.9,11.1],[106.9,10.9]]]}`)},
+		},
+		MinAltitude:         1000,
+		MaxAltitude:         40000,
+		PositionGracePeriod: 30,
+	}, receiver)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	position := func(lat, lon float64, altitude int64) *aircraftState {
+		return &aircraftState{latitude: lat, longitude: lon, hasPosition: true, altitude: altitude, hasAltitude: true, firstSeen: now}
+	}
+
+	tests := []struct {
+		name     string
+		aircraft *aircraftState
+		accept   bool
+	}{
+		{"near the receiver", position(10.9, 106.7, 30000), true},
+		{"too far", position(14, 106.6, 30000), false},
+		{"excluded area", position(11, 107, 30000), false},
+		{"below the band", position(10.9, 106.7, 500), false},
+		{"above the band", position(10.9, 106.7, 41000), false},
+		{"unknown altitude", &aircraftState{latitude: 10.9, longitude: 106.7, hasPosition: true, firstSeen: now}, true},
+		{"no position yet", &aircraftState{firstSeen: now.Add(-10 * time.Second)}, true},
+		{"no position after the grace period", &aircraftState{firstSeen: now.Add(-time.Minute)}, false},
+		{"no aircraft state", nil, true},
+	}
+
+	for _, tt := range tests {
+		if got := f.accept(tt.aircraft, now); got != tt.accept {
+			t.Errorf("%s: accept %v, want %v", tt.name, got, tt.accept)
+		}
+	}
+
+	var none *recordFilter
+	if !none.accept(position(0, 0, 0), now) {
+		t.Error("a nil filter must accept everything")
+	}
+}
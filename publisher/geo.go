@@ -0,0 +1,64 @@
+// ----------------------------------------------------------------------------
+// Geographic functions
+//
+// Contact: Hugo Cruz - hugo.m.cruz@gmail.com
+// ----------------------------------------------------------------------------
+
+package main
+
+import "math"
+
+// Mean earth radius in kilometers
+const earthRadiusKm = 6371.0
+
+// Great circle distance between two positions in kilometers (haversine)
+func distanceKm(lat1 float64, lon1 float64, lat2 float64, lon2 float64) float64 {
+	phi1 := lat1 * math.Pi / 180
+	phi2 := lat2 * math.Pi / 180
+	dPhi := (lat2 - lat1) * math.Pi / 180
+	dLambda := (lon2 - lon1) * math.Pi / 180
+
+	a := math.Sin(dPhi/2)*math.Sin(dPhi/2) + math.Cos(phi1)*math.Cos(phi2)*math.Sin(dLambda/2)*math.Sin(dLambda/2)
+	return earthRadiusKm * 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
+
+// Check if a position is inside a ring of [longitude, latitude] points (ray casting)
+func insideRing(lat float64, lon float64, ring [][]float64) bool {
+	inside := false
+	j := len(ring) - 1
+	for i := 0; i < len(ring); i++ {
+		xi, yi := ring[i][0], ring[i][1]
+		xj, yj := ring[j][0], ring[j][1]
+		if (yi > lat) != (yj > lat) && lon < (xj-xi)*(lat-yi)/(yj-yi)+xi {
+			inside = !inside
+		}
+		j = i
+	}
+	return inside
+}
+
+// Check if a position is inside a polygon: inside the outer ring and outside the holes
+func insidePolygon(lat float64, lon float64, polygon [][][]float64) bool {
+	if len(polygon) == 0 || !insideRing(lat, lon, polygon[0]) {
+		return false
+	}
+	for _, hole := range polygon[1:] {
+		if insideRing(lat, lon, hole) {
+			return false
+		}
+	}
+	return true
+}
+
+// Initial bearing from the first to the second position in degrees (0 to 360)
+func bearingDegrees(lat1 float64, lon1 float64, lat2 float64, lon2 float64) float64 {
+	phi1 := lat1 * math.Pi / 180
+	phi2 := lat2 * math.Pi / 180
+	dLambda := (lon2 - lon1) * math.Pi / 180
+
+	y := math.Sin(dLambda) * math.Cos(phi2)
+	x := math.Cos(phi1)*math.Sin(phi2) - math.Sin(phi1)*math.Cos(phi2)*math.Cos(dLambda)
+	bearing := math.Atan2(y, x) * 180 / math.Pi
+
+	return math.Mod(bearing+360, 360)
+}
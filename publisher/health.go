@@ -0,0 +1,111 @@
+// ----------------------------------------------------------------------------
+// Health and readiness checks
+// Served on /healthz and /readyz of the optional HTTP listener (HTTPListen)
+// Contact: Hugo Cruz - hugo.m.cruz@gmail.com
+// ----------------------------------------------------------------------------
+
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/hugomcruz/dump1090-mqtt/internal/health"
+)
+
+// The main loop is stalled when it does not run for this long
+const maxLoopStall = 10 * time.Second
+
+// State of the main loop, read by the HTTP handlers
+var lastLoop health.Activity
+var pendingDepth int64
+var mqttState atomic.Value
+var outputStates atomic.Value
+
+// Connection to the main broker, the URL changes on reload
+type brokerState struct {
+	connected bool
+	url       string
+}
+
+// Publish the state of the main loop for the checks
+func updateHealth(client transport, now time.Time) {
+	lastLoop.Mark(now)
+	atomic.StoreInt64(&pendingDepth, int64(len(pendingMessages)))
+	mqttState.Store(brokerState{connected: client.Connected(), url: configuration.MQTTServerURL})
+
+	states := make([]string, 0, len(outputs))
+	for _, o := range outputs {
+		states = append(states, o.state())
+	}
+	outputStates.Store(strings.Join(states, ", "))
+}
+
+// Liveness: the main loop runs. Readiness: connected to dump1090 and MQTT,
+// data received recently and the input queue is not full.
+func healthChecks() (*health.Checks, *health.Checks) {
+	live := &health.Checks{}
+	live.Add("loop", health.MaxAge(&lastLoop, "main loop run", maxLoopStall))
+
+	ready := &health.Checks{}
+	ready.Add("dump1090", checkDump1090)
+	ready.Add("data", health.MaxAge(&input.data, "data from dump1090", time.Duration(configuration.MaxDataAge)*time.Second))
+	ready.Add("mqtt", checkMQTT)
+	ready.Add("queue", checkQueue)
+	ready.Add("outputs", checkOutputs)
+	if input.kind == listenInput {
+		ready.Add("sources", checkSources)
+	}
+
+	return live, ready
+}
+
+func checkDump1090() (string, error) {
+	address := input.url()
+	if !input.connected() {
+		return "disconnected", errors.New("not connected to dump1090 at " + address)
+	}
+	return "connected to " + address, nil
+}
+
+// Connections accepted in listen mode. Never fails, dump1090 fails without connections.
+func checkSources() (string, error) {
+	states := input.sourceStates()
+	if len(states) == 0 {
+		return "no connection", nil
+	}
+	return strings.Join(states, ", "), nil
+}
+
+func checkMQTT() (string, error) {
+	state, _ := mqttState.Load().(brokerState)
+	if !state.connected {
+		return "disconnected", errors.New("not connected to " + state.url)
+	}
+	return "connected to " + state.url, nil
+}
+
+// Lines waiting for the main loop and messages waiting for the broker
+func checkQueue() (string, error) {
+	depth := len(input.lines)
+	state := "input " + strconv.Itoa(depth) + "/" + strconv.Itoa(cap(input.lines)) +
+		", pending messages " + strconv.FormatInt(atomic.LoadInt64(&pendingDepth), 10)
+
+	if depth >= cap(input.lines)*9/10 {
+		return state, errors.New("input queue almost full, the main loop does not keep up")
+	}
+	return state, nil
+}
+
+// State of the additional outputs. A slow or unreachable output does not
+// make the publisher unready, its messages wait in its own queue.
+func checkOutputs() (string, error) {
+	states, _ := outputStates.Load().(string)
+	if states == "" {
+		return "none", nil
+	}
+	return states, nil
+}
@@ -0,0 +1,107 @@
+// ----------------------------------------------------------------------------
+// HTTP POST output transport
+// Each batch is the body of one POST, the expanded topic is in X-Topic
+// Contact: Hugo Cruz - hugo.m.cruz@gmail.com
+// ----------------------------------------------------------------------------
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/hugomcruz/dump1090-mqtt/internal/envelope"
+)
+
+// Content-Encoding of the body by codec
+var contentEncodings = map[string]string{
+	"gzip": "gzip",
+	"zlib": "deflate",
+}
+
+// HTTP endpoint: http://host/path or https://host/path
+type httpTransport struct {
+	url      string
+	codec    string
+	username string
+	password string
+	headers  map[string]string
+	client   *http.Client
+	failed   int32
+}
+
+func newHTTPTransport(oc OutputConfig) *httpTransport {
+	return &httpTransport{
+		url:      oc.URL,
+		codec:    oc.Codec,
+		username: oc.Username,
+		password: oc.Password,
+		headers:  oc.Headers,
+		client:   &http.Client{Timeout: publishTimeout},
+	}
+}
+
+func (t *httpTransport) Connect() error {
+	return nil
+}
+
+// Any 2xx answer is a success. QoS does not apply to HTTP.
+func (t *httpTransport) Publish(topic string, qos byte, retained bool, payload []byte) delivery {
+	err := t.post(topic, payload)
+	if err != nil {
+		atomic.StoreInt32(&t.failed, 1)
+		return completed{err}
+	}
+	atomic.StoreInt32(&t.failed, 0)
+	return completed{}
+}
+
+func (t *httpTransport) post(topic string, payload []byte) error {
+	request, err := http.NewRequest(http.MethodPost, t.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+
+	// Sealed batches are opaque, the codec is inside the envelope
+	if envelope.IsSealed(payload) {
+		request.Header.Set("Content-Type", "application/octet-stream")
+	} else {
+		request.Header.Set("Content-Type", "text/plain")
+		if encoding, ok := contentEncodings[t.codec]; ok {
+			request.Header.Set("Content-Encoding", encoding)
+		}
+	}
+	request.Header.Set("X-Topic", topic)
+	for name, value := range t.headers {
+		request.Header.Set(name, value)
+	}
+	if t.username != "" {
+		request.SetBasicAuth(t.username, t.password)
+	}
+
+	response, err := t.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, response.Body)
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return errors.New("HTTP status " + strconv.Itoa(response.StatusCode) + " from " + t.url)
+	}
+	return nil
+}
+
+// Connected while the last batch was accepted
+func (t *httpTransport) Connected() bool {
+	return atomic.LoadInt32(&t.failed) == 0
+}
+
+func (t *httpTransport) Close() {
+	t.client.CloseIdleConnections()
+}
@@ -0,0 +1,463 @@
+// ----------------------------------------------------------------------------
+// Dump1090 input
+// Reads the lines from dump1090 and dials again when the connection is lost.
+// The lines can also come from stdin, a file (optionally gzip), UDP datagrams
+// or connections accepted from the stations that push their lines.
+// Contact: Hugo Cruz - hugo.m.cruz@gmail.com
+// ----------------------------------------------------------------------------
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hugomcruz/dump1090-mqtt/internal/health"
+	"github.com/hugomcruz/dump1090-mqtt/internal/sbs"
+	log "github.com/sirupsen/logrus"
+)
+
+// Maximum wait between two dials to dump1090
+const maxDialBackoff = time.Minute
+
+// Kinds of input
+const (
+	tcpInput    = "tcp"
+	udpInput    = "udp"
+	fileInput   = "file"
+	listenInput = "listen"
+)
+
+// Line read from the input. Source is set for the accepted connections.
+type inputLine struct {
+	source string
+	text   string
+}
+
+// Connection accepted in listen mode, with its counters
+type sourceConnection struct {
+	conn   net.Conn
+	source string
+	remote string
+	since  time.Time
+	lines  int64
+}
+
+// Connection to dump1090, UDP socket, listener or file
+type dump1090Input struct {
+	kind     string
+	address  string
+	pace     float64
+	names    map[string]string
+	lines    chan inputLine
+	finished chan bool
+	quit     chan bool
+	mutex    sync.Mutex
+	conn     io.Closer
+	reader   io.Reader
+	sources  map[*sourceConnection]bool
+	stopped  bool
+	data     health.Activity
+}
+
+func newDump1090Input(address string) *dump1090Input {
+	return &dump1090Input{
+		kind:     tcpInput,
+		address:  address,
+		lines:    make(chan inputLine, 1000),
+		finished: make(chan bool),
+		quit:     make(chan bool),
+		sources:  make(map[*sourceConnection]bool),
+	}
+}
+
+// Create the input from the Input setting: empty for the TCP connection to
+// dump1090 at address, "-" for stdin, udp://host:port, tcp://host:port,
+// listen://host:port or a file name. Files are paced by the time of their
+// lines when pace > 0. names maps the remote IP of the accepted connections
+// to their source, the IP is the source otherwise.
+func newInput(spec string, address string, pace float64, names map[string]string) *dump1090Input {
+	in := newDump1090Input(address)
+	in.names = names
+
+	switch {
+	case spec == "":
+	case strings.HasPrefix(spec, "tcp://"):
+		in.address = strings.TrimPrefix(spec, "tcp://")
+	case strings.HasPrefix(spec, "udp://"):
+		in.kind = udpInput
+		in.address = strings.TrimPrefix(spec, "udp://")
+	case strings.HasPrefix(spec, "listen://"):
+		in.kind = listenInput
+		in.address = strings.TrimPrefix(spec, "listen://")
+	default:
+		in.kind = fileInput
+		in.address = spec
+		in.pace = pace
+	}
+	return in
+}
+
+// Dial dump1090, listen on the UDP or TCP port, or open the file
+func (in *dump1090Input) dial() error {
+	address := in.currentAddress()
+
+	switch in.kind {
+	case listenInput:
+		log.Info("Accepting dump1090 connections on " + address)
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			return err
+		}
+		in.setConn(listener, nil)
+		return nil
+
+	case udpInput:
+		log.Info("Listening for dump1090 lines on UDP " + address)
+		conn, err := net.ListenPacket("udp", address)
+		if err != nil {
+			return err
+		}
+		in.setConn(conn, nil)
+		return nil
+
+	case fileInput:
+		return in.open(address)
+	}
+
+	log.Info("Connecting to dump1090: " + address)
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return err
+	}
+	in.setConn(conn, conn)
+
+	log.Info("Connection to DUMP1090 started...")
+	return nil
+}
+
+// Open stdin or a file, plain or gzip
+func (in *dump1090Input) open(name string) error {
+	log.Info("Reading dump1090 lines from " + in.url())
+
+	reader, file, err := sbs.Open(name)
+	if err != nil {
+		return err
+	}
+	in.setConn(file, reader)
+	return nil
+}
+
+func (in *dump1090Input) setConn(conn io.Closer, reader io.Reader) {
+	in.mutex.Lock()
+	in.conn = conn
+	in.reader = reader
+	in.mutex.Unlock()
+}
+
+// Read the lines into the channel and dial again when the connection is lost.
+// Runs in its own goroutine after the first dial. A file is read once.
+func (in *dump1090Input) run() {
+	if in.kind == fileInput {
+		in.readFile()
+		return
+	}
+
+	backoff := time.Second
+
+	for {
+		in.mutex.Lock()
+		conn := in.conn
+		reader := in.reader
+		in.mutex.Unlock()
+
+		if conn != nil {
+			switch in.kind {
+			case udpInput:
+				in.readPackets(conn.(net.PacketConn))
+			case listenInput:
+				in.accept(conn.(net.Listener))
+			default:
+				in.scan(conn, reader)
+			}
+			backoff = time.Second
+		}
+
+		time.Sleep(backoff)
+
+		if in.isStopped() {
+			return
+		}
+
+		if err := in.dial(); err != nil {
+			log.Warn("Error connecting to DUMP1090: ", err.Error())
+			in.setConn(nil, nil)
+
+			backoff = backoff * 2
+			if backoff > maxDialBackoff {
+				backoff = maxDialBackoff
+			}
+		} else {
+			dump1090Reconnects.Inc()
+		}
+	}
+}
+
+// Queue a line for the main loop
+func (in *dump1090Input) receive(source string, line string) {
+	in.data.Mark(time.Now())
+	recorder.record(line)
+	in.lines <- inputLine{source: source, text: line}
+}
+
+// Scan the lines of a connection until it is closed
+func (in *dump1090Input) scan(conn io.Closer, reader io.Reader) {
+	scanner := bufio.NewScanner(reader)
+	scanner.Split(ScanCRLF)
+
+	for scanner.Scan() {
+		in.receive("", scanner.Text())
+	}
+
+	// Connections closed by reconnect and stop are not errors
+	if err := scanner.Err(); err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Warn("Invalid input:" + err.Error())
+	}
+
+	conn.Close()
+	log.Warn("Connection to DUMP1090 closed")
+}
+
+// Read the datagrams until the socket is closed. A datagram has one or more lines.
+func (in *dump1090Input) readPackets(conn net.PacketConn) {
+	buffer := make([]byte, 65536)
+
+	for {
+		n, _, err := conn.ReadFrom(buffer)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Warn("Error reading UDP: " + err.Error())
+			}
+			break
+		}
+
+		for _, line := range strings.Split(string(buffer[:n]), "\n") {
+			line = strings.TrimRight(line, "\r")
+			if line != "" {
+				in.receive("", line)
+			}
+		}
+	}
+
+	conn.Close()
+	log.Warn("UDP socket closed")
+}
+
+// Accept the connections until the listener is closed, each one read in its own goroutine
+func (in *dump1090Input) accept(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Warn("Error accepting connections: " + err.Error())
+			}
+			break
+		}
+
+		remote := conn.RemoteAddr().String()
+		host, _, _ := net.SplitHostPort(remote)
+		source := in.names[host]
+		if source == "" {
+			source = host
+		}
+
+		sc := &sourceConnection{conn: conn, source: source, remote: remote, since: time.Now()}
+		in.mutex.Lock()
+		if in.stopped {
+			in.mutex.Unlock()
+			conn.Close()
+			break
+		}
+		in.sources[sc] = true
+		in.mutex.Unlock()
+		inputConnections.Inc()
+
+		log.Info("Connection from ", remote, " accepted, source ", source)
+		go in.readSource(sc)
+	}
+
+	listener.Close()
+	log.Warn("Listener on " + in.address + " closed")
+}
+
+// Read the lines of an accepted connection until it is closed
+func (in *dump1090Input) readSource(sc *sourceConnection) {
+	scanner := bufio.NewScanner(sc.conn)
+	scanner.Split(ScanCRLF)
+	counter := inputSourceLines.WithLabelValues(sc.source)
+
+	for scanner.Scan() {
+		atomic.AddInt64(&sc.lines, 1)
+		counter.Inc()
+		in.receive(sc.source, scanner.Text())
+	}
+
+	if err := scanner.Err(); err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Warn("Error reading from ", sc.remote, ": ", err.Error())
+	}
+
+	sc.conn.Close()
+	in.mutex.Lock()
+	delete(in.sources, sc)
+	in.mutex.Unlock()
+	inputConnections.Dec()
+
+	log.Info("Connection from ", sc.remote, " (source ", sc.source, ") closed after ",
+		time.Since(sc.since).Round(time.Second), ", ", atomic.LoadInt64(&sc.lines), " lines")
+}
+
+// Accepted connections with their source, remote address, age and lines read
+func (in *dump1090Input) sourceStates() []string {
+	in.mutex.Lock()
+	defer in.mutex.Unlock()
+
+	states := make([]string, 0, len(in.sources))
+	for sc := range in.sources {
+		states = append(states, sc.source+" ("+sc.remote+") "+time.Since(sc.since).Round(time.Second).String()+
+			", "+strconv.FormatInt(atomic.LoadInt64(&sc.lines), 10)+" lines")
+	}
+	sort.Strings(states)
+	return states
+}
+
+// Read the file to the end, CR LF or LF line endings, then end the input
+func (in *dump1090Input) readFile() {
+	in.mutex.Lock()
+	conn := in.conn
+	reader := in.reader
+	in.mutex.Unlock()
+
+	scanner := bufio.NewScanner(reader)
+	var first time.Time
+	var start time.Time
+
+	for scanner.Scan() && !in.isStopped() {
+		line := scanner.Text()
+
+		// Wait until the time of the line relative to the first one.
+		// Lines back in time start the pacing again.
+		if in.pace > 0 {
+			if t, ok := sbs.LineTime(line); ok {
+				if first.IsZero() || t.Before(first) {
+					first = t
+					start = time.Now()
+				}
+				wait := time.Duration(float64(t.Sub(first))/in.pace) - time.Since(start)
+				if wait > 0 {
+					select {
+					case <-time.After(wait):
+					case <-in.quit:
+					}
+				}
+			}
+		}
+
+		in.receive("", line)
+	}
+
+	if err := scanner.Err(); err != nil && !errors.Is(err, os.ErrClosed) {
+		log.Warn("Error reading " + in.address + ": " + err.Error())
+	}
+
+	conn.Close()
+	in.setConn(nil, nil)
+	log.Info("End of the input " + in.url())
+	close(in.finished)
+}
+
+// Check if there is a connection to dump1090. In listen mode at least one
+// connection must be accepted.
+func (in *dump1090Input) connected() bool {
+	in.mutex.Lock()
+	defer in.mutex.Unlock()
+
+	if in.kind == listenInput {
+		return in.conn != nil && len(in.sources) > 0
+	}
+	return in.conn != nil
+}
+
+// Close the current connection. The reader dials again. Files are not read again.
+// In listen mode the accepted connections are closed, the stations connect again.
+func (in *dump1090Input) reconnect() {
+	in.mutex.Lock()
+	defer in.mutex.Unlock()
+
+	for sc := range in.sources {
+		sc.conn.Close()
+	}
+	if in.conn != nil && in.kind != fileInput && in.kind != listenInput {
+		log.Info("Reconnecting to DUMP1090")
+		in.conn.Close()
+	}
+}
+
+// Address of dump1090
+func (in *dump1090Input) currentAddress() string {
+	in.mutex.Lock()
+	defer in.mutex.Unlock()
+	return in.address
+}
+
+// Input for the status: tcp://host:port, udp://host:port, the file name or stdin
+func (in *dump1090Input) url() string {
+	switch {
+	case in.kind == fileInput && in.address == "-":
+		return "stdin"
+	case in.kind == fileInput:
+		return in.address
+	}
+	return in.kind + "://" + in.currentAddress()
+}
+
+// Change the address of dump1090 and reconnect to it
+func (in *dump1090Input) setAddress(address string) {
+	in.mutex.Lock()
+	in.address = address
+	in.mutex.Unlock()
+
+	in.reconnect()
+}
+
+// Stop reading: close the connection and do not dial again
+func (in *dump1090Input) stop() {
+	in.mutex.Lock()
+	defer in.mutex.Unlock()
+
+	if !in.stopped {
+		close(in.quit)
+	}
+	in.stopped = true
+	if in.conn != nil {
+		in.conn.Close()
+	}
+	for sc := range in.sources {
+		sc.conn.Close()
+	}
+}
+
+func (in *dump1090Input) isStopped() bool {
+	in.mutex.Lock()
+	defer in.mutex.Unlock()
+	return in.stopped
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hugomcruz/dump1090-mqtt/internal/sbs"
+)
+
+// Position line generated at the time
+func timedLine(t time.Time, hexIdent string) string {
+	date, clock := sbs.Timestamp(t)
+	return "MSG,3,1,1," + hexIdent + ",1," + date + "," + clock + "," + date + "," + clock + ",,35000,,,10.8,106.6,,,0,0,0,0"
+}
+
+// Lines received from the input, with the time since the start
+type receivedLine struct {
+	line  inputLine
+	after time.Duration
+}
+
+// Read the input until it finishes
+func readInput(t *testing.T, in *dump1090Input) []receivedLine {
+	t.Helper()
+
+	if err := in.dial(); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	go in.run()
+
+	received := make([]receivedLine, 0)
+	for {
+		select {
+		case line := <-in.lines:
+			received = append(received, receivedLine{line, time.Since(start)})
+		case <-in.finished:
+			// Lines queued before the end
+			for len(in.lines) > 0 {
+				received = append(received, receivedLine{<-in.lines, time.Since(start)})
+			}
+			return received
+		case <-time.After(5 * time.Second):
+			t.Fatal("input not finished")
+		}
+	}
+}
+
+func TestInputSource(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(c *Configuration)
+		source string
+	}{
+		{"dump1090 server", func(c *Configuration) {}, "10.0.0.1"},
+		{"configured source", func(c *Configuration) { c.Source = "dump" }, "dump"},
+		{"input file", func(c *Configuration) { c.Dump1090Server, c.Input = "", "/data/capture.sbs.gz" }, "capture.sbs.gz"},
+		{"stdin", func(c *Configuration) { c.Dump1090Server, c.Input = "", "-" }, "stdin"},
+		{"UDP", func(c *Configuration) { c.Dump1090Server, c.Input = "", "udp://:30005" }, ":30005"},
+		{"listener", func(c *Configuration) { c.Dump1090Server, c.Input = "", "listen://:30004" }, ":30004"},
+	}
+
+	for _, tt := range tests {
+		if c := checkChange(t, tt.name, tt.change, ""); c.Source != tt.source {
+			t.Errorf("%s: source %q, want %q", tt.name, c.Source, tt.source)
+		}
+	}
+
+	checkChange(t, "no input", func(c *Configuration) { c.Dump1090Server = "" }, "Dump1090Server or Input is required")
+}
+
+func TestNewInput(t *testing.T) {
+	tests := []struct {
+		spec string
+		kind string
+		url  string
+	}{
+		{"", tcpInput, "tcp://10.0.0.1:30003"},
+		{"tcp://relay:30003", tcpInput, "tcp://relay:30003"},
+		{"udp://:30005", udpInput, "udp://:30005"},
+		{"listen://:30004", listenInput, "listen://:30004"},
+		{"capture.sbs.gz", fileInput, "capture.sbs.gz"},
+		{"-", fileInput, "stdin"},
+	}
+
+	for _, tt := range tests {
+		in := newInput(tt.spec, "10.0.0.1:30003", 0, nil)
+		if in.kind != tt.kind || in.url() != tt.url {
+			t.Errorf("%q: %s input %s, want %s %s", tt.spec, in.kind, in.url(), tt.kind, tt.url)
+		}
+	}
+}
+
+func TestFileInput(t *testing.T) {
+	first := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	lines := []string{
+		timedLine(first, "ABC123"),
+		"garbage without time",
+		timedLine(first.Add(400*time.Millisecond), "ABC123"),
+		timedLine(first.Add(800*time.Millisecond), "888123"),
+	}
+	name := filepath.Join(t.TempDir(), "capture.sbs")
+	if err := ioutil.WriteFile(name, []byte(strings.Join(lines, "\r\n")+"\r\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		pace float64
+		last time.Duration
+	}{
+		{"as fast as possible", 0, 0},
+		{"real time", 1, 800 * time.Millisecond},
+		{"twice as fast", 2, 400 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		in := newInput(name, "", tt.pace, nil)
+		received := readInput(t, in)
+
+		// Every line once in order, then the end of the input
+		if len(received) != len(lines) {
+			t.Fatalf("%s: %d lines, want %d", tt.name, len(received), len(lines))
+		}
+		for i, r := range received {
+			if r.line.text != lines[i] || r.line.source != "" {
+				t.Errorf("%s: line %d %q from %q", tt.name, i, r.line.text, r.line.source)
+			}
+		}
+		if last := received[len(received)-1].after; last < tt.last || last > tt.last+300*time.Millisecond {
+			t.Errorf("%s: last line after %v, want %v", tt.name, last, tt.last)
+		}
+		if in.connected() {
+			t.Errorf("%s: input still connected at the end of the file", tt.name)
+		}
+	}
+}
+
+func TestStdinInput(t *testing.T) {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdin := os.Stdin
+	os.Stdin = reader
+	defer func() { os.Stdin = stdin }()
+
+	first := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	go func() {
+		writer.Write([]byte(timedLine(first, "ABC123") + "\n"))
+		writer.Write([]byte(timedLine(first.Add(300*time.Millisecond), "ABC123") + "\n"))
+		writer.Close()
+	}()
+
+	received := readInput(t, newInput("-", "", 1, nil))
+	if len(received) != 2 {
+		t.Fatalf("%d lines from stdin, want 2", len(received))
+	}
+	if wait := received[1].after - received[0].after; wait < 250*time.Millisecond {
+		t.Errorf("second line %v after the first, want paced by 300ms", wait)
+	}
+}
+
+func TestUDPInput(t *testing.T) {
+	in := newInput("udp://127.0.0.1:0", "", 0, nil)
+	if err := in.dial(); err != nil {
+		t.Fatal(err)
+	}
+	finished := make(chan bool)
+	go func() {
+		in.readPackets(in.conn.(net.PacketConn))
+		close(finished)
+	}()
+
+	conn, err := net.Dial("udp", in.conn.(net.PacketConn).LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// One datagram with two lines, CR LF or LF
+	conn.Write([]byte("MSG,3,a\r\nMSG,3,b\n"))
+	for _, want := range []string{"MSG,3,a", "MSG,3,b"} {
+		select {
+		case line := <-in.lines:
+			// Tagged with the source of the configuration by the records
+			if line.text != want || line.source != "" {
+				t.Errorf("line %q from %q, want %q without source", line.text, line.source, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("line %q not received", want)
+		}
+	}
+
+	in.stop()
+	select {
+	case <-finished:
+	case <-time.After(2 * time.Second):
+		t.Error("UDP socket still read after stop")
+	}
+}
@@ -0,0 +1,94 @@
+// ----------------------------------------------------------------------------
+// Kafka output transport
+// The expanded topic with "." between levels is the Kafka topic
+// Contact: Hugo Cruz - hugo.m.cruz@gmail.com
+// ----------------------------------------------------------------------------
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl/plain"
+)
+
+// Kafka cluster reached through one bootstrap broker: kafka://host:9092,
+// or kafkas://host:9093 with TLS
+type kafkaTransport struct {
+	writer *kafka.Writer
+	failed int32
+}
+
+func newKafkaTransport(oc OutputConfig, clientID string) (*kafkaTransport, error) {
+	u, err := url.Parse(oc.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &kafka.Transport{ClientID: clientID}
+	switch u.Scheme {
+	case "kafka":
+	case "kafkas":
+		transport.TLS = &tls.Config{ServerName: u.Hostname()}
+	default:
+		return nil, errors.New("Kafka URL must be kafka://host:port or kafkas://host:port, got " + oc.URL)
+	}
+	if oc.Username != "" {
+		transport.SASL = plain.Mechanism{Username: oc.Username, Password: oc.Password}
+	}
+
+	// QoS 0 does not wait for the brokers, 1 waits for the leader, 2 for all the replicas
+	acks := kafka.RequireNone
+	switch *oc.QoS {
+	case 1:
+		acks = kafka.RequireOne
+	case 2:
+		acks = kafka.RequireAll
+	}
+
+	writer := &kafka.Writer{
+		Addr:                   kafka.TCP(u.Host),
+		Balancer:               &kafka.Hash{},
+		RequiredAcks:           acks,
+		BatchTimeout:           10 * time.Millisecond,
+		WriteTimeout:           publishTimeout,
+		AllowAutoTopicCreation: true,
+		Transport:              transport,
+	}
+	return &kafkaTransport{writer: writer}, nil
+}
+
+func (t *kafkaTransport) Connect() error {
+	// The writer connects on the first message
+	return nil
+}
+
+// The expanded topic is also the key, so the batches of a station and type
+// keep their order in one partition
+func (t *kafkaTransport) Publish(topic string, qos byte, retained bool, payload []byte) delivery {
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+
+	err := t.writer.WriteMessages(ctx, kafka.Message{Topic: dottedTopic(topic), Key: []byte(topic), Value: payload})
+	if err != nil {
+		atomic.StoreInt32(&t.failed, 1)
+		return completed{err}
+	}
+	atomic.StoreInt32(&t.failed, 0)
+	return completed{}
+}
+
+// Connected while the last message was written
+func (t *kafkaTransport) Connected() bool {
+	return atomic.LoadInt32(&t.failed) == 0
+}
+
+func (t *kafkaTransport) Close() {
+	t.writer.Close()
+}
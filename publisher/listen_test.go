@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hugomcruz/dump1090-mqtt/internal/codec"
+)
+
+// Connection to the listener from a local address
+func dialFrom(t *testing.T, local string, address string) net.Conn {
+	t.Helper()
+
+	dialer := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(local)}}
+	conn, err := dialer.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// Wait until the input has the number of accepted connections
+func waitSources(t *testing.T, in *dump1090Input, want int) {
+	t.Helper()
+
+	for end := time.Now().Add(2 * time.Second); time.Now().Before(end); time.Sleep(10 * time.Millisecond) {
+		if len(in.sourceStates()) == want {
+			return
+		}
+	}
+	t.Fatalf("connections %v, want %d", in.sourceStates(), want)
+}
+
+func TestListenSources(t *testing.T) {
+	setupReload(t, "")
+	configuration.MQTTTopic = "adsb/{source}"
+	routes = newRoutes(configuration, 100)
+
+	in := newInput("listen://127.0.0.1:0", "", 0, map[string]string{"127.0.0.1": "site-a"})
+	if err := in.dial(); err != nil {
+		t.Fatal(err)
+	}
+	defer in.stop()
+	go in.run()
+	address := in.conn.(net.Listener).Addr().String()
+
+	// Named by the InputSources of its IP, or the IP itself
+	named := dialFrom(t, "127.0.0.1", address)
+	defer named.Close()
+	other := dialFrom(t, "127.0.0.2", address)
+	defer other.Close()
+	waitSources(t, in, 2)
+	if !in.connected() {
+		t.Error("not connected with two stations")
+	}
+
+	now := time.Now()
+	named.Write([]byte(timedLine(now, "ABC123") + "\r\n"))
+	other.Write([]byte(timedLine(now, "888123") + "\r\n"))
+	for i := 0; i < 2; i++ {
+		select {
+		case line := <-in.lines:
+			processRadarLine(line, now)
+		case <-time.After(2 * time.Second):
+			t.Fatal("line not received")
+		}
+	}
+
+	topics := make([]string, 0)
+	for _, m := range routes[0].collect(102, codec.None) {
+		topics = append(topics, m.topic)
+	}
+	sort.Strings(topics)
+	if strings.Join(topics, " ") != "adsb/127.0.0.2 adsb/site-a" {
+		t.Errorf("topics %v, want one per source", topics)
+	}
+
+	states := in.sourceStates()
+	if len(states) != 2 || !strings.HasPrefix(states[0], "127.0.0.2 (") || !strings.HasSuffix(states[0], ", 1 lines") || !strings.HasSuffix(states[1], ", 1 lines") {
+		t.Errorf("connections %v, want both with one line", states)
+	}
+
+	// A station that disconnects leaves the others
+	other.Close()
+	waitSources(t, in, 1)
+	if states := in.sourceStates(); !strings.HasPrefix(states[0], "site-a (") {
+		t.Errorf("connections %v after a disconnect, want site-a", states)
+	}
+
+	named.Close()
+	waitSources(t, in, 0)
+	if in.connected() {
+		t.Error("connected without stations")
+	}
+
+	// The listener still accepts the stations that connect again
+	again := dialFrom(t, "127.0.0.1", address)
+	defer again.Close()
+	waitSources(t, in, 1)
+}
@@ -0,0 +1,255 @@
+// ----------------------------------------------------------------------------
+// Aircraft allow and deny lists
+// ICAO addresses, address ranges and callsign patterns loaded from files
+// Contact: Hugo Cruz - hugo.m.cruz@gmail.com
+// ----------------------------------------------------------------------------
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Aircraft list loaded from a file
+type aircraftList struct {
+	addresses map[uint32]bool
+	ranges    [][2]uint32
+	callsigns []string
+}
+
+// Allow and deny lists, replaced when the files change
+type listFilter struct {
+	mutex sync.RWMutex
+	allow *aircraftList
+	deny  *aircraftList
+}
+
+var lists = &listFilter{}
+
+// Stop functions of the list file watches
+var listWatches = make([]func(), 0)
+
+// Load the lists of the configuration. The current lists are not changed.
+func loadLists(configuration Configuration) (*listFilter, error) {
+	l := &listFilter{}
+	var err error
+
+	if configuration.AllowList != "" {
+		l.allow, err = loadAircraftList(configuration.AllowList)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if configuration.DenyList != "" {
+		l.deny, err = loadAircraftList(configuration.DenyList)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return l, nil
+}
+
+// Use new lists and watch their files for changes, instead of the files of
+// the current lists. A list is kept when its file becomes invalid.
+func useLists(l *listFilter, configuration Configuration) {
+	for _, stop := range listWatches {
+		stop()
+	}
+	listWatches = listWatches[:0]
+	lists = l
+
+	interval := time.Duration(configuration.ListReloadInterval) * time.Second
+
+	if configuration.AllowList != "" {
+		listWatches = append(listWatches, watchFile(configuration.AllowList, interval, func() {
+			l.reload(configuration.AllowList, &l.allow)
+		}))
+	}
+
+	if configuration.DenyList != "" {
+		listWatches = append(listWatches, watchFile(configuration.DenyList, interval, func() {
+			l.reload(configuration.DenyList, &l.deny)
+		}))
+	}
+}
+
+// Reload a list. The previous list is kept when the file is invalid.
+func (l *listFilter) reload(filename string, list **aircraftList) {
+	newList, err := loadAircraftList(filename)
+	if err != nil {
+		log.Error("Error reloading aircraft list, keeping the previous one: ", err.Error())
+		return
+	}
+
+	l.mutex.Lock()
+	*list = newList
+	l.mutex.Unlock()
+}
+
+// Check if the records of the aircraft are forwarded
+func (l *listFilter) accept(aircraft *aircraftState) bool {
+	if aircraft == nil {
+		return true
+	}
+
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	if l.deny != nil && l.deny.matches(aircraft) {
+		return false
+	}
+	if l.allow != nil && !l.allow.matches(aircraft) {
+		return false
+	}
+	return true
+}
+
+// Read a list file. One entry per line, # for comments:
+//
+//	icao:ABC123 or ABC123         - ICAO hex address
+//	icao:ABC000-ABCFFF            - ICAO hex address range
+//	callsign:TEST* or TEST*       - callsign pattern (* and ? wildcards)
+//
+// Entries without prefix are addresses when they are hex, callsigns otherwise.
+func loadAircraftList(filename string) (*aircraftList, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	list := &aircraftList{addresses: make(map[uint32]bool)}
+
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+
+		entry := scanner.Text()
+		if i := strings.Index(entry, "#"); i >= 0 {
+			entry = entry[:i]
+		}
+		entry = strings.ToUpper(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+
+		if err := list.add(entry); err != nil {
+			return nil, errors.New(filename + ":" + strconv.Itoa(lineNumber) + ": " + err.Error())
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	log.Info("Aircraft list ", filename, ": ", len(list.addresses), " addresses, ", len(list.ranges), " ranges, ", len(list.callsigns), " callsigns")
+
+	return list, nil
+}
+
+// Add an entry to the list
+func (l *aircraftList) add(entry string) error {
+	kind := ""
+	if i := strings.Index(entry, ":"); i >= 0 {
+		kind, entry = strings.TrimSpace(entry[:i]), strings.TrimSpace(entry[i+1:])
+	}
+
+	if kind == "" {
+		kind = "CALLSIGN"
+		if _, _, err := parseAddressRange(entry); err == nil {
+			kind = "ICAO"
+		}
+	}
+
+	switch kind {
+	case "ICAO":
+		first, last, err := parseAddressRange(entry)
+		if err != nil {
+			return err
+		}
+		if first == last {
+			l.addresses[first] = true
+		} else {
+			l.ranges = append(l.ranges, [2]uint32{first, last})
+		}
+	case "CALLSIGN":
+		if _, err := path.Match(entry, ""); err != nil {
+			return errors.New("invalid callsign pattern " + entry)
+		}
+		l.callsigns = append(l.callsigns, entry)
+	default:
+		return errors.New("unknown entry type " + kind)
+	}
+	return nil
+}
+
+// Parse an address (ABC123) or an address range (ABC000-ABCFFF)
+func parseAddressRange(entry string) (uint32, uint32, error) {
+	parts := strings.SplitN(entry, "-", 2)
+
+	first, err := parseAddress(parts[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(parts) == 1 {
+		return first, first, nil
+	}
+
+	last, err := parseAddress(parts[1])
+	if err != nil {
+		return 0, 0, err
+	}
+	if last < first {
+		return 0, 0, errors.New("invalid address range " + entry)
+	}
+	return first, last, nil
+}
+
+// Parse a 24 bit ICAO hex address
+func parseAddress(hexIdent string) (uint32, error) {
+	hexIdent = strings.TrimSpace(hexIdent)
+	if len(hexIdent) != 6 {
+		return 0, errors.New("invalid ICAO address " + hexIdent)
+	}
+	address, err := strconv.ParseUint(hexIdent, 16, 32)
+	if err != nil {
+		return 0, errors.New("invalid ICAO address " + hexIdent)
+	}
+	return uint32(address), nil
+}
+
+// Check if the aircraft is in the list
+func (l *aircraftList) matches(aircraft *aircraftState) bool {
+	if address, err := parseAddress(aircraft.hexIdent); err == nil {
+		if l.addresses[address] {
+			return true
+		}
+		for _, r := range l.ranges {
+			if address >= r[0] && address <= r[1] {
+				return true
+			}
+		}
+	}
+
+	if aircraft.callSign != "" {
+		callSign := strings.ToUpper(strings.TrimSpace(aircraft.callSign))
+		for _, pattern := range l.callsigns {
+			if ok, _ := path.Match(pattern, callSign); ok {
+				return true
+			}
+		}
+	}
+
+	return false
+}
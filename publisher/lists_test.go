@@ -0,0 +1,134 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeList(t *testing.T, content string) string {
+	t.Helper()
+
+	file := filepath.Join(t.TempDir(), "list.txt")
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestParseAddressRange(t *testing.T) {
+	tests := []struct {
+		entry       string
+		first, last uint32
+		err         bool
+	}{
+		{"ABC123", 0xABC123, 0xABC123, false},
+		{"ABC000-ABCFFF", 0xABC000, 0xABCFFF, false},
+		{" abc000 - abc0ff ", 0xABC000, 0xABC0FF, false},
+		{"ABCFFF-ABC000", 0, 0, true},
+		{"ABC12", 0, 0, true},
+		{"GHIJKL", 0, 0, true},
+		{"ABC000-XYZ", 0, 0, true},
+	}
+
+	for _, tt := range tests {
+		first, last, err := parseAddressRange(tt.entry)
+		if (err != nil) != tt.err || first != tt.first || last != tt.last {
+			t.Errorf("parseAddressRange(%q) = %06X-%06X %v, want %06X-%06X error %v", tt.entry, first, last, err, tt.first, tt.last, tt.err)
+		}
+	}
+}
+
+func TestLoadAircraftList(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{"entries and comments", "# military\nicao:ABC123\nABC000-ABCFFF # range\n\ncallsign:TEST*\nVJC1??\n", ""},
+		{"unknown type", "tail:VN-A123\n", "list.txt:1: unknown entry type TAIL"},
+		{"invalid address", "\nicao:ABC12\n", "list.txt:2: invalid ICAO address ABC12"},
+		{"invalid pattern", "callsign:[VJC\n", "invalid callsign pattern"},
+	}
+
+	for _, tt := range tests {
+		list, err := loadAircraftList(writeList(t, tt.content))
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: error %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if len(list.addresses) != 1 || len(list.ranges) != 1 || len(list.callsigns) != 2 {
+			t.Errorf("%s: %d addresses, %d ranges, %d callsigns, want 1, 1, 2", tt.name, len(list.addresses), len(list.ranges), len(list.callsigns))
+		}
+	}
+}
+
+func TestListAccept(t *testing.T) {
+	deny := writeList(t, "ABC123\nABD000-ABDFFF\ncallsign:TEST*\n")
+	allow := writeList(t, "callsign:VJC*\n888000-888FFF\n")
+
+	tests := []struct {
+		name     string
+		allow    string
+		deny     string
+		aircraft *aircraftState
+		accept   bool
+	}{
+		{"no lists", "", "", &aircraftState{hexIdent: "ABC123"}, true},
+		{"denied address", "", deny, &aircraftState{hexIdent: "ABC123"}, false},
+		{"denied range", "", deny, &aircraftState{hexIdent: "ABD555"}, false},
+		{"denied callsign", "", deny, &aircraftState{hexIdent: "111111", callSign: "test01  "}, false},
+		{"not denied", "", deny, &aircraftState{hexIdent: "111111", callSign: "VJC123"}, true},
+		{"allowed callsign", allow, "", &aircraftState{hexIdent: "111111", callSign: "VJC123"}, true},
+		{"allowed range", allow, "", &aircraftState{hexIdent: "888123"}, true},
+		{"not allowed", allow, "", &aircraftState{hexIdent: "111111", callSign: "HVN123"}, false},
+		{"deny wins", allow, deny, &aircraftState{hexIdent: "ABC123", callSign: "VJC123"}, false},
+		{"no aircraft state", allow, deny, nil, true},
+	}
+
+	for _, tt := range tests {
+		l, err := loadLists(Configuration{AllowList: tt.allow, DenyList: tt.deny})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := l.accept(tt.aircraft); got != tt.accept {
+			t.Errorf("%s: accept %v, want %v", tt.name, got, tt.accept)
+		}
+	}
+}
+
+func TestLoadListsInvalid(t *testing.T) {
+	if _, err := loadLists(Configuration{DenyList: filepath.Join(t.TempDir(), "missing.txt")}); err == nil {
+		t.Error("no error for a missing deny list")
+	}
+	if _, err := loadLists(Configuration{AllowList: writeList(t, "icao:XYZ\n")}); err == nil {
+		t.Error("no error for an invalid allow list")
+	}
+}
+
+func TestListReloadKeepsValidList(t *testing.T) {
+	file := writeList(t, "ABC123\n")
+	l, err := loadLists(Configuration{DenyList: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An invalid file keeps the previous list
+	ioutil.WriteFile(file, []byte("icao:XYZ\n"), 0644)
+	l.reload(file, &l.deny)
+	if l.accept(&aircraftState{hexIdent: "ABC123"}) {
+		t.Error("previous deny list lost on an invalid file")
+	}
+
+	ioutil.WriteFile(file, []byte("888123\n"), 0644)
+	l.reload(file, &l.deny)
+	if !l.accept(&aircraftState{hexIdent: "ABC123"}) || l.accept(&aircraftState{hexIdent: "888123"}) {
+		t.Error("deny list not replaced by the new file")
+	}
+}
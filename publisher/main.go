@@ -7,21 +7,45 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
-	"compress/gzip"
-	"net"
+	"errors"
+	"flag"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
+	"github.com/hugomcruz/dump1090-mqtt/internal/broker"
+	"github.com/hugomcruz/dump1090-mqtt/internal/codec"
+	"github.com/hugomcruz/dump1090-mqtt/internal/config"
+	"github.com/hugomcruz/dump1090-mqtt/internal/envelope"
 	log "github.com/sirupsen/logrus"
-	"github.com/tkanos/gonfig"
 )
 
 // Global variables
 var configuration Configuration
+var filter *recordFilter
+var routes []*batchRoute
+var input *dump1090Input
+var paused bool
+var startTime = time.Now()
+var stats publisherStats
+var embedded *broker.Broker
+var sealer *envelope.Sealer
+
+// Input and pacing from the command line, they override the configuration
+var inputFlag = flag.String("input", "", "read the lines from - (stdin), a file (.gz), udp://host:port, tcp://host:port or listen://host:port instead of dump1090")
+var paceFlag = flag.Float64("pace", 0, "pace a file by the time of its lines: 1 real time, 10 ten times faster")
+
+// Counters of the publisher since the start
+type publisherStats struct {
+	linesRead      int64
+	recordsBatched int64
+	batchesSent    int64
+	bytesSent      int64
+}
 
 //Plain Dump1090 port 30003 (default) structure
 type radarRawLine struct {
@@ -46,48 +70,66 @@ type radarRawLine struct {
 	emergency        string
 	spiIdent         string
 	isOnGround       string
+	hasAltitude      bool
+	hasPosition      bool
 }
 
-//Configuration Data
+//Configuration Data. Defaults and validation rules are applied by the config loader.
 type Configuration struct {
-	MQTTServerURL   string
-	MQTTClientID    string
-	MQTTTopic       string
-	MQTTQos         int
-	MQTTUsername    string
-	MQTTPassword    string
-	Dump1090Server  string
-	Dump1090Port    int
-	BatchTimeWindow int
-	LogLevel        string
+	config.MQTT
+	Dump1090Server        string
+	Dump1090Port          int `default:"30003" validate:"min=1,max=65535"`
+	Input                 string
+	InputPace             float64 `validate:"min=0"`
+	InputSources          map[string]string
+	BatchTimeWindow       int `default:"3" validate:"min=1"`
+	Routes                []RouteConfig
+	SequenceHeader        bool
+	StationID             string
+	Source                string
+	GeohashPrecision      int `default:"4" validate:"min=1,max=12"`
+	Filters               FilterConfig
+	AllowList             string
+	DenyList              string
+	ListReloadInterval    int     `default:"10" validate:"min=1"`
+	ReceiverLatitude      float64 `validate:"min=-90,max=90"`
+	ReceiverLongitude     float64 `validate:"min=-180,max=180"`
+	ReceiverAltitude      float64
+	RangeAndBearing       bool
+	CoverageTopic         string
+	CoverageInterval      int     `default:"300" validate:"min=1"`
+	CoverageSectors       int     `default:"36" validate:"min=1,max=360"`
+	CoverageAltitudeBands []int64 `default:"0,10000,20000,30000,40000"`
+	Codec                 string  `default:"gzip" validate:"oneof=gzip zlib none"`
+	ControlTopic          string
+	ControlReplyTopic     string
+	ControlSecret         string `secret:"true"`
+	HeartbeatInterval     int    `default:"60" validate:"min=1"`
+	SpoolDirectory        string
+	ShutdownTimeout       int `default:"10" validate:"min=1"`
+	AdaptiveWindow        AdaptiveConfig
+	Quota                 QuotaConfig
+	HTTPListen            string
+	MaxDataAge            int `default:"60" validate:"min=1"`
+	Outputs               []OutputConfig
+	Broker                broker.Config
+	Security              envelope.SealConfig
+	Recording             RecordingConfig
 }
 
 func main() {
 
-	// Setup the logger
-	log.SetFormatter(&log.TextFormatter{
-		DisableColors: false,
-		FullTimestamp: true,
-	})
-
-	// Set the log level
-	if configuration.LogLevel == "DEBUG" {
-		log.SetLevel(log.DebugLevel)
-	} else if configuration.LogLevel == "INFO" {
-		log.SetLevel(log.InfoLevel)
-	} else if configuration.LogLevel == "ERROR" {
-		log.SetLevel(log.ErrorLevel)
-	} else if configuration.LogLevel == "WARN" {
-		log.SetLevel(log.WarnLevel)
-	} else {
-		log.SetLevel(log.InfoLevel) // Make info default in case of missing config
-	}
+	// Setup the logger. The level is set once the configuration is read.
+	config.SetupLogging("")
+
+	configPath := config.PathFlag()
+	flag.Parse()
 
 	log.Info("Starting Dump1090 processor and Publisher to MQTT")
 
-	// Read the configuration file using gonfig package
+	// Read the configuration file, the environment overrides it
 	configuration = Configuration{}
-	err := gonfig.GetConf("config.json", &configuration)
+	err := config.Load(*configPath, "PUBLISHER", &configuration)
 
 	if err != nil {
 		log.Error("Error reading configuration file: " + err.Error())
@@ -96,6 +138,74 @@ func main() {
 
 	}
 
+	config.SetLogLevel(configuration.LogLevel)
+
+	applyFlags(&configuration)
+	err = checkConfiguration(&configuration)
+	if err != nil {
+		log.Error("Error in the configuration: " + err.Error())
+		log.Error("Exiting now.")
+		os.Exit(1)
+	}
+
+	filter, err = newFilter(configuration.Filters, configuration)
+	if err != nil {
+		log.Error("Error in the filters configuration: " + err.Error())
+		log.Error("Exiting now.")
+		os.Exit(1)
+	}
+
+	newLists, err := loadLists(configuration)
+	if err != nil {
+		log.Error("Error reading aircraft lists: " + err.Error())
+		log.Error("Exiting now.")
+		os.Exit(1)
+	}
+	useLists(newLists, configuration)
+
+	// Signature or encryption of the batches
+	sealer, err = envelope.NewSealer(configuration.Security)
+	if err != nil {
+		log.Error("Error in the security configuration: " + err.Error())
+		log.Error("Exiting now.")
+		os.Exit(1)
+	}
+
+	// Copy of the raw lines from dump1090
+	recorder, err = newRecorder(configuration.Recording, configuration.StationID)
+	if err != nil {
+		log.Error("Error in the recording configuration: " + err.Error())
+		log.Error("Exiting now.")
+		os.Exit(1)
+	}
+
+	// Data accounting of the current period
+	quota = newQuota(configuration.Quota, time.Now())
+
+	ip := configuration.Dump1090Server
+	port := strconv.Itoa(configuration.Dump1090Port)
+	input = newInput(configuration.Input, ip+":"+port, configuration.InputPace, configuration.InputSources)
+
+	registerConnectHandlers()
+
+	// Metrics and health checks
+	mqttState.Store(brokerState{url: configuration.MQTTServerURL})
+	startHTTP(configuration.HTTPListen)
+
+	// Embedded broker, started before connecting to it
+	if configuration.Broker.Enabled {
+		// Forwards of the bridge count against the data quota of the station
+		allow := func(topic string, size int, qos byte) bool {
+			return quota.allow(topic, size, qos, time.Now())
+		}
+		embedded, err = broker.Start(configuration.Broker, configuration.MQTTClientID+"-bridge", allow)
+		if err != nil {
+			log.Error("Error starting the embedded broker: " + err.Error())
+			log.Error("Exiting now.")
+			os.Exit(1)
+		}
+	}
+
 	//Connect to MQTT
 	client := connect(configuration)
 
@@ -105,103 +215,211 @@ func main() {
 		os.Exit(1)
 	}
 
-	ip := configuration.Dump1090Server
-	port := strconv.Itoa(configuration.Dump1090Port)
+	//Connect socket
+	err = input.dial()
 
-	log.Info("Connecting to dump1090: " + ip + ":" + port)
+	if err != nil {
+		disconnect(client)
+		log.Error("Error connecting to DUMP1090: ", err.Error())
+		log.Error("Exiting now...")
+		os.Exit(1)
+	}
 
-	//Connect socket
-	conn, err := net.Dial("tcp", ip+":"+port)
+	go input.run()
+
+	// Messages not published by the previous run
+	replaySpool(client)
 
+	// Stop cleanly on SIGINT and SIGTERM
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	// Reload the configuration on SIGHUP and when the file changes
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	watchConfiguration(*configPath)
+
+	// Initiate the batch routes with the first start time
+	routes = newRoutes(configuration, time.Now().Unix())
+	outputs, err = newOutputs(configuration, time.Now().Unix())
 	if err != nil {
 		disconnect(client)
-		log.Error("Error connecting to DUMP1090. Exiting now...")
+		log.Error("Error in the outputs configuration: " + err.Error())
+		log.Error("Exiting now.")
 		os.Exit(1)
 	}
+	coverage = newCoverage(configuration, time.Now())
+
+	// Check the time windows also when no lines are received
+	ticker := time.NewTicker(time.Second)
+
+	for {
+		select {
+		case line := <-input.lines:
+			now := time.Now()
+			processRadarLine(line, now)
+			checkWindows(client, now)
+
+		case now := <-ticker.C:
+			checkWindows(client, now)
+
+		case cmd := <-commands:
+			reply := handleCommand(cmd, time.Now())
+			sendReply(client, reply)
+			registerConnectHandlers()
+
+		case <-hangups:
+			log.Info("SIGHUP received, reloading the configuration")
+			client = reloadConfiguration(client, *configPath, time.Now())
+
+		case <-configChanges:
+			client = reloadConfiguration(client, *configPath, time.Now())
+
+		case sig := <-signals:
+			log.Info("Signal received: ", sig)
+			shutdown(client)
+			return
+
+		case <-input.finished:
+			// End of stdin or of the file
+			shutdown(client)
+			return
+		}
+	}
+}
 
-	log.Info("Connection to DUMP1090 started...")
+// Stop reading, publish the last batches and disconnect within the shutdown timeout
+func shutdown(client transport) {
+	deadline := time.Now().Add(time.Duration(configuration.ShutdownTimeout) * time.Second)
+
+	input.stop()
+	recorder.stop()
+
+	// Lines already read are still processed
+	now := time.Now()
+	for drained := false; !drained; {
+		select {
+		case line := <-input.lines:
+			processRadarLine(line, now)
+		default:
+			drained = true
+		}
+	}
 
-	//message, _ := bufio.NewReader(conn).ReadString('\n')
-	scanner := bufio.NewScanner(conn)
-	scanner.Split(ScanCRLF)
+	for _, route := range routes {
+		route.flush(client, now.Unix())
+	}
 
-	tmpMessageBuffer := make([]string, 0)
+	publishOffline(client)
+	stopOutputs(outputs, deadline)
 
-	timeWindow := int64(configuration.BatchTimeWindow)
+	waitPending(deadline)
+	spoolPending()
+	quota.flush(time.Now())
 
-	// Initiate the first start tme
-	startTime := time.Now().Unix()
+	client.Close()
 
-	for scanner.Scan() {
+	if embedded != nil {
+		embedded.Close(deadline)
+	}
 
-		if err := scanner.Err(); err != nil {
-			log.Warn("Invalid input:" + err.Error())
-			continue
-		}
+	log.Info("Publisher stopped")
+}
 
-		radarLine := scanner.Text()
+// Decode a dump1090 line and add the record to the batch routes
+func processRadarLine(line inputLine, now time.Time) {
+	stats.linesRead++
 
-		tmpMessageBuffer = append(tmpMessageBuffer, radarLine)
+	if err := checkLine(line.text); err != nil {
+		parseErrors.Inc()
+		log.Debug("Invalid line from dump1090: ", err.Error())
+		return
+	}
 
-		// Change to a variable - 3 seconds no
-		endTime := time.Now().Unix()
-		timeDelta := endTime - startTime
+	rawLine := processLine(line.text)
+	linesRead.WithLabelValues(rawLine.messageType, rawLine.transmissionType).Inc()
 
-		//log.Debug("Time Delta: ", timeDelta)
+	aircraft := trackAircraft(rawLine, now)
+	processedLine := decodeData(rawLine)
 
-		// Check if time window for batch is exceeded
-		if timeDelta >= timeWindow {
-			log.Debug("Batch window completed. Preparing to send data.")
-			// FUTURE: Change here to send to a multithreaded worker
+	// Distance and bearing from the receiver on position records
+	if configuration.RangeAndBearing && processedLine != "" && (rawLine.transmissionType == "2" || rawLine.transmissionType == "3") {
+		processedLine = enrichPosition(processedLine, rawLine)
+	}
+	coverage.add(rawLine, aircraft)
 
-			// Compress (GZIP) the batched message
-			compressedMessage := compress(tmpMessageBuffer)
+	if processedLine != "" && lists.accept(aircraft) {
+		rec := newRecord(processedLine, aircraft)
+		rec.source = line.source
 
-			topic := configuration.MQTTTopic
-			send(client, topic, compressedMessage)
+		// Low priority types are dropped when the quota is almost used
+		if quota.dropsType(rec.recordType) {
+			quota.dropRecords(1)
+			return
+		}
+		if filter.accept(aircraft, now) {
+			routeRecord(routes, rec)
+		}
 
-			// Reset variables for next time window batch
-			startTime = time.Now().Unix()
-			tmpMessageBuffer = make([]string, 0)
+		// Each output has its own filters
+		for _, o := range outputs {
+			o.add(rec, aircraft, now)
 		}
 	}
 }
 
-// Compress the message pyloading with GZIP
-func compress(messageList []string) []byte {
+// Check if the time window of each route is exceeded
+func checkWindows(client transport, now time.Time) {
+	endTime := now.Unix()
+	flushed := false
+	for _, route := range routes {
+		if route.due(endTime) {
+			// FUTURE: Change here to send to a multithreaded worker
+			route.flush(client, endTime)
+			flushed = true
+		}
+	}
 
-	decodedMessages := make([]string, 0)
+	for _, o := range outputs {
+		o.flush(endTime, false)
+	}
 
-	for _, s := range messageList {
-		rawLine := processLine(s)
-		processedLine := decodeData(rawLine)
+	if flushed {
+		expireAircraft(now)
+	}
+	aircraftCount.Set(float64(len(aircraftTable)))
 
-		if processedLine == "" {
-			continue
-		} else {
-			decodedMessages = append(decodedMessages, processedLine)
-		}
+	quota.tick(now, client.Connected())
+	if quota.due(now) {
+		quota.publish(client, now)
 	}
 
-	superString := ""
-	for _, s := range decodedMessages {
-		superString = superString + s + "\n"
+	updateHealth(client, now)
 
+	if coverage.due(now) {
+		coverage.publish(client, now)
 	}
 
-	var b bytes.Buffer
-	gz := gzip.NewWriter(&b)
-
-	if _, err := gz.Write([]byte(superString)); err != nil {
-		log.Fatal(err)
+	if heartbeatDue(now) {
+		publishHeartbeat(client, now)
 	}
-	if err := gz.Close(); err != nil {
+}
+
+// Compress the decoded records pyloading with the codec (default GZIP)
+func compress(records []string, codecName string, destination string) []byte {
+
+	superString := strings.Join(records, "\n") + "\n"
+
+	b, err := codec.Encode([]byte(superString), codecName)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	log.Debug("Batch original size: ", len(superString), ". Batch compressed size:", len(b.Bytes()))
+	log.Debug("Batch original size: ", len(superString), ". Batch compressed size:", len(b))
 
-	return b.Bytes()
+	compressionRatio.WithLabelValues(destination).Observe(float64(len(b)) / float64(len(superString)))
+
+	return b
 
 }
 
@@ -237,6 +455,20 @@ func decodeData(radarData radarRawLine) string {
 	return message
 }
 
+// SBS lines have at least 10 fields (AIR) and a known message type.
+// processLine reads the fields without checking them.
+func checkLine(line string) error {
+	fields := strings.Split(line, ",")
+	if len(fields) < 10 {
+		return errors.New(strconv.Itoa(len(fields)) + " fields: " + line)
+	}
+	switch fields[0] {
+	case "MSG", "AIR", "ID", "STA", "SEL", "CLK":
+		return nil
+	}
+	return errors.New("unknown message type: " + line)
+}
+
 func processLine(line string) radarRawLine {
 	stringArray := strings.Split(line, ",")
 
@@ -270,6 +502,7 @@ func processLine(line string) radarRawLine {
 			altitude = 0
 		}
 		rawline.altitude = altitude
+		rawline.hasAltitude = error == nil
 
 		// GROUND SPEED - Convert from String to Float64
 		groundSpeed, error := strconv.ParseFloat(stringArray[12], 64)
@@ -306,6 +539,7 @@ func processLine(line string) radarRawLine {
 			longitude = 0.0
 		}
 		rawline.longitude = longitude
+		rawline.hasPosition = error == nil && stringArray[14] != ""
 
 		// VERTICAL RATE - Convert from String to Float64
 		verticalRate, error := strconv.ParseInt(stringArray[16], 10, 64)
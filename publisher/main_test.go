@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCheckLine(t *testing.T) {
+	tests := []struct {
+		name  string
+		line  string
+		valid bool
+	}{
+		{"position", "MSG,3,1,1,ABC123,1,2026/10/18,12:00:00.000,2026/10/18,12:00:00.000,,35000,,,10.8,106.6,,,0,0,0,0", true},
+		{"new aircraft", "AIR,,1,1,ABC123,1,2026/10/18,12:00:00.000,2026/10/18,12:00:00.000", true},
+		{"truncated", "MSG,3,1,1,ABC123", false},
+		{"empty", "", false},
+		{"unknown message type", "XYZ,3,1,1,ABC123,1,2026/10/18,12:00:00.000,2026/10/18,12:00:00.000", false},
+	}
+
+	for _, tt := range tests {
+		if err := checkLine(tt.line); (err == nil) != tt.valid {
+			t.Errorf("%s: error %v, want valid %v", tt.name, err, tt.valid)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+// ----------------------------------------------------------------------------
+// Prometheus metrics
+// Exposed on /metrics of the optional HTTP listener (HTTPListen), with the health checks
+// Contact: Hugo Cruz - hugo.m.cruz@gmail.com
+// ----------------------------------------------------------------------------
+
+package main
+
+import (
+	"net/http"
+
+	"github.com/hugomcruz/dump1090-mqtt/internal/health"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "dump1090_publisher"
+
+var (
+	linesRead = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "lines_read_total",
+		Help:      "Lines read from dump1090 by SBS message and transmission type.",
+	}, []string{"message", "transmission"})
+
+	parseErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "parse_errors_total",
+		Help:      "Lines from dump1090 that are not SBS lines, dropped.",
+	})
+
+	recordsSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "records_sent_total",
+		Help:      "Records acknowledged by the main broker by record type.",
+	}, []string{"type"})
+
+	batchesSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "batches_sent_total",
+		Help:      "Batches acknowledged by the main broker by route.",
+	}, []string{"route"})
+
+	batchWindow = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "batch_window_seconds",
+		Help:      "Current batch window by route.",
+	}, []string{"route"})
+
+	batchRecords = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "batch_records",
+		Help:      "Records per acknowledged batch by destination, main for the main broker or the name of the output.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+	}, []string{"destination"})
+
+	batchBytes = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "batch_bytes",
+		Help:      "Size of the acknowledged batches after compression by destination.",
+		Buckets:   prometheus.ExponentialBuckets(64, 2, 14),
+	}, []string{"destination"})
+
+	compressionRatio = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "compression_ratio",
+		Help:      "Compressed size divided by the original size of the batches by destination.",
+		Buckets:   []float64{0.05, 0.1, 0.15, 0.2, 0.25, 0.3, 0.4, 0.5, 0.6, 0.8, 1},
+	}, []string{"destination"})
+
+	publishResults = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "mqtt_publish_total",
+		Help:      "MQTT publishes by result (success or failure).",
+	}, []string{"result"})
+
+	dump1090Reconnects = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "dump1090_reconnects_total",
+		Help:      "Connections to dump1090 opened again after the first one.",
+	})
+
+	aircraftCount = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "aircraft",
+		Help:      "Aircraft currently tracked.",
+	})
+
+	quotaUsed = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "quota_used_bytes",
+		Help:      "Bytes sent in the current quota period, payload and estimated overhead.",
+	})
+
+	quotaLevel = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "quota_level",
+		Help:      "Data reduction level of the quota (0 none, 3 maximum).",
+	})
+
+	outputPublishes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "output_publish_total",
+		Help:      "Publishes of the additional outputs by result (success, failure or dropped by the quota).",
+	}, []string{"output", "result"})
+
+	outputRecords = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "output_records_total",
+		Help:      "Records delivered by each output.",
+	}, []string{"output"})
+
+	outputBatches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "output_batches_total",
+		Help:      "Batches delivered by each output.",
+	}, []string{"output"})
+
+	outputBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "output_bytes_total",
+		Help:      "Payload bytes delivered by each output.",
+	}, []string{"output"})
+
+	outputQueue = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "output_queue",
+		Help:      "Messages waiting in the queue of each output.",
+	}, []string{"output"})
+
+	outputDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "output_dropped_total",
+		Help:      "Messages dropped because the queue of the output was full.",
+	}, []string{"output"})
+
+	inputConnections = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "input_connections",
+		Help:      "Connections accepted in listen mode currently open.",
+	})
+
+	inputSourceLines = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "input_source_lines_total",
+		Help:      "Lines read from the connections accepted in listen mode, by source.",
+	}, []string{"source"})
+
+	recordingLines = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "recording_lines_total",
+		Help:      "Raw lines written to the recording files.",
+	})
+
+	recordingDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "recording_dropped_total",
+		Help:      "Raw lines not recorded because the queue was full or the file could not be written.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(linesRead, parseErrors, recordsSent, batchesSent, batchWindow, batchRecords,
+		batchBytes, compressionRatio, publishResults, dump1090Reconnects, aircraftCount,
+		quotaUsed, quotaLevel, outputPublishes, outputRecords, outputBatches, outputBytes, outputQueue, outputDropped,
+		inputConnections, inputSourceLines, recordingLines, recordingDropped)
+}
+
+// Handlers of the HTTP listener
+var httpHandlers = http.NewServeMux()
+
+// Start the HTTP listener in a goroutine when it is configured
+func startHTTP(listen string) {
+	if listen == "" {
+		return
+	}
+
+	httpHandlers.Handle("/metrics", promhttp.Handler())
+
+	live, ready := healthChecks()
+	health.Register(httpHandlers, live, ready)
+
+	health.Listen(listen, httpHandlers)
+}
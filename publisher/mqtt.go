@@ -8,9 +8,11 @@ package main
 
 import (
 	"fmt"
+	"sync/atomic"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/hugomcruz/dump1090-mqtt/internal/connection"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -18,40 +20,78 @@ import (
 const keepalive = 2
 const pingTimeout = 1
 
+// Keepalive of the MQTT clients, also used for the reserve of the data quota
+const keepaliveInterval = keepalive * time.Second
+
+// Handlers called on every connection to MQTT, e.g. to subscribe again.
+// They run on the goroutine of the MQTT client: the main loop stores a new
+// slice instead of changing it, and the handlers get copies of what they need.
+var connectHandlers atomic.Value
+
 var f mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
 	fmt.Printf("TOPIC: %s\n", msg.Topic())
 	fmt.Printf("MSG: %s\n", msg.Payload())
 }
 
-func connect(configuration Configuration) mqtt.Client {
+// Connect to the main broker. Returns nil when the connection fails.
+func connect(configuration Configuration) transport {
 	log.Info("Connecting to MQTT: ", configuration.MQTTServerURL)
 
 	opts := mqtt.NewClientOptions().AddBroker(configuration.MQTTServerURL).SetClientID(configuration.MQTTClientID)
 	opts.SetUsername(configuration.MQTTUsername)
 	opts.SetPassword(configuration.MQTTPassword)
-	opts.SetKeepAlive(keepalive * time.Second)
+	opts.SetKeepAlive(keepaliveInterval)
 	//opts.SetDefaultPublishHandler(f)
 	opts.SetPingTimeout(pingTimeout * time.Second)
+	// Last will flips the station status to offline
+	will := ""
+	if configuration.StatusTopic != "" {
+		will = string(willPayload())
+		opts.SetWill(statusTopic(), will, 1, true)
+	}
+	connectBytes := connectOverhead(configuration.MQTTClientID, configuration.MQTTUsername, configuration.MQTTPassword, statusTopic(), len(will))
 
-	c := mqtt.NewClient(opts)
-	if token := c.Connect(); token.Wait() && token.Error() != nil {
-		//panic(token.Error())
-		log.Error("Error connecting to MQTT: ", token.Error())
+	// WebSocket headers and proxy
+	if err := connection.Configure(opts, configuration.MQTTHeaders, configuration.MQTTProxy); err != nil {
+		log.Error("Error in the MQTT settings: ", err.Error())
 		return nil
 	}
 
-	return c
+	opts.SetOnConnectHandler(func(c mqtt.Client) {
+		quota.account(connectBytes)
+
+		handlers, _ := connectHandlers.Load().([]mqtt.OnConnectHandler)
+		for _, handler := range handlers {
+			handler(c)
+		}
+	})
+
+	t := &mqttTransport{name: "main", url: configuration.MQTTServerURL, client: mqtt.NewClient(opts), main: true}
+	if err := t.Connect(); err != nil {
+		log.Error("Error connecting to MQTT: ", err)
+		return nil
+	}
+
+	return t
 }
 
-func send(client mqtt.Client, topic string, message []byte) {
+func send(client transport, topic string, qos byte, retained bool, message []byte) {
+	sendPending(client, pendingMessage{Topic: topic, Qos: qos, Retained: retained, Payload: message})
+}
 
-	client.Publish(topic, 0, false, message)
-	//token := c.Publish("go-mqtt/sample", 0, false, message)
-	//token.Wait()
+// Publish a message and keep it until it is acknowledged
+func sendPending(client transport, message pendingMessage) {
+
+	// Messages over the hard cap of the data quota are dropped
+	if !quota.allow(message.Topic, len(message.Payload), message.Qos, time.Now()) {
+		return
+	}
 
+	message.token = client.Publish(message.Topic, message.Qos, message.Retained, message.Payload)
+	trackPending(message)
 }
 
-func disconnect(c mqtt.Client) {
-	c.Disconnect(250)
+func disconnect(c transport) {
+	c.Close()
 
 }
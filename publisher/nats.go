@@ -0,0 +1,88 @@
+// ----------------------------------------------------------------------------
+// NATS output transport
+// The expanded topic with "." between levels is the NATS subject
+// Contact: Hugo Cruz - hugo.m.cruz@gmail.com
+// ----------------------------------------------------------------------------
+
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+)
+
+// NATS server: nats://host:4222, or tls://host:4222
+type natsTransport struct {
+	name     string
+	url      string
+	clientID string
+	username string
+	password string
+	conn     atomic.Value
+}
+
+func newNATSTransport(oc OutputConfig, clientID string) *natsTransport {
+	return &natsTransport{name: oc.Name, url: oc.URL, clientID: clientID, username: oc.Username, password: oc.Password}
+}
+
+func (t *natsTransport) Connect() error {
+	options := []nats.Option{
+		nats.Name(t.clientID),
+		nats.MaxReconnects(-1),
+		nats.ReconnectWait(time.Second),
+		nats.RetryOnFailedConnect(true),
+		nats.ConnectHandler(func(c *nats.Conn) {
+			log.Info("Output ", t.name, " connected to ", t.url)
+		}),
+		nats.ReconnectHandler(func(c *nats.Conn) {
+			log.Info("Output ", t.name, " connected to ", t.url)
+		}),
+		nats.DisconnectErrHandler(func(c *nats.Conn, err error) {
+			if err != nil {
+				log.Warn("Output ", t.name, " lost the connection: ", err.Error())
+			}
+		}),
+	}
+	if t.username != "" {
+		options = append(options, nats.UserInfo(t.username, t.password))
+	}
+
+	// Retried in the background until connected
+	conn, err := nats.Connect(t.url, options...)
+	if err != nil {
+		return err
+	}
+	t.conn.Store(conn)
+	return nil
+}
+
+// QoS 1 and 2 wait until the server has processed the message
+func (t *natsTransport) Publish(topic string, qos byte, retained bool, payload []byte) delivery {
+	conn, ok := t.conn.Load().(*nats.Conn)
+	if !ok || !conn.IsConnected() {
+		return completed{errors.New("not connected to " + t.url)}
+	}
+
+	if err := conn.Publish(dottedTopic(topic), payload); err != nil {
+		return completed{err}
+	}
+	if qos > 0 {
+		return completed{conn.FlushTimeout(publishTimeout)}
+	}
+	return completed{}
+}
+
+func (t *natsTransport) Connected() bool {
+	conn, ok := t.conn.Load().(*nats.Conn)
+	return ok && conn.IsConnected()
+}
+
+func (t *natsTransport) Close() {
+	if conn, ok := t.conn.Load().(*nats.Conn); ok {
+		conn.Close()
+	}
+}
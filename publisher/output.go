@@ -0,0 +1,241 @@
+// ----------------------------------------------------------------------------
+// Additional outputs
+// Each output has its own destination, topic, codec, filters, queue and retries
+// Contact: Hugo Cruz - hugo.m.cruz@gmail.com
+// ----------------------------------------------------------------------------
+
+package main
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Maximum wait between two attempts to publish a message
+const maxRetryBackoff = time.Minute
+
+//OutputConfig - Additional destination of the records
+type OutputConfig struct {
+	Name            string `validate:"required"`
+	Type            string `default:"mqtt" validate:"oneof=mqtt kafka nats http"`
+	URL             string `validate:"required,url"`
+	ClientID        string
+	Username        string
+	Password        string `secret:"true"`
+	Topic           string
+	QoS             *int   `validate:"min=0,max=2"`
+	Codec           string `default:"gzip" validate:"oneof=gzip zlib none"`
+	BatchTimeWindow int    `validate:"min=0"`
+	RecordTypes     []int
+	Filters         FilterConfig
+	QueueSize       int `default:"100" validate:"min=1"`
+	Headers         map[string]string
+	Proxy           string `secret:"true" validate:"url"`
+	SequenceHeader  bool
+}
+
+// Output with its batch, its queue and the goroutine that publishes the queue
+type output struct {
+	name      string
+	config    OutputConfig
+	filter    *recordFilter
+	route     *batchRoute
+	queue     chan batchMessage
+	transport transport
+	done      sync.WaitGroup
+	quit      chan bool
+}
+
+var outputs []*output
+
+// Create the outputs and start their goroutines
+func newOutputs(configuration Configuration, now int64) ([]*output, error) {
+	list := make([]*output, 0, len(configuration.Outputs))
+
+	for _, oc := range configuration.Outputs {
+		// QoS of the main broker when the output has none
+		if oc.QoS == nil {
+			qos := configuration.MQTTQos
+			oc.QoS = &qos
+		}
+
+		f, err := newFilter(oc.Filters, configuration)
+		if err != nil {
+			return nil, errors.New("output " + oc.Name + ": " + err.Error())
+		}
+
+		o := &output{
+			name:   oc.Name,
+			config: oc,
+			filter: f,
+			route: newRoute(routeDefaults(RouteConfig{
+				Name:            "output-" + oc.Name,
+				RecordTypes:     oc.RecordTypes,
+				BatchTimeWindow: oc.BatchTimeWindow,
+				MQTTTopic:       oc.Topic,
+				MQTTQos:         oc.QoS,
+				SequenceHeader:  oc.SequenceHeader,
+			}, configuration), now),
+			queue: make(chan batchMessage, oc.QueueSize),
+			quit:  make(chan bool),
+		}
+		o.route.destination = oc.Name
+		if dottedTransport(oc.Type) {
+			o.route.escape = dottedValue
+		}
+		list = append(list, o)
+	}
+
+	for i, o := range list {
+		if err := o.start(configuration.MQTTClientID); err != nil {
+			stopOutputs(list[:i], time.Now())
+			return nil, err
+		}
+	}
+	return list, nil
+}
+
+// Connect in the background and publish the queue. Without its own client
+// ID the output uses the one of the publisher with its name.
+func (o *output) start(publisherID string) error {
+	clientID := o.config.ClientID
+	if clientID == "" {
+		clientID = publisherID + "-" + o.name
+	}
+
+	t, err := newTransport(o.config, clientID)
+	if err == nil {
+		err = t.Connect()
+	}
+	if err != nil {
+		return errors.New("output " + o.name + ": " + err.Error())
+	}
+	o.transport = t
+
+	log.Info("Output ", o.name, ": ", o.config.Type, " ", o.config.URL, ", topic ", o.route.topic, ", codec ", o.config.Codec)
+
+	o.done.Add(1)
+	go o.run()
+	return nil
+}
+
+// Publish the queued messages in order. A message is tried again until it
+// is published, the queue of the output fills up meanwhile.
+func (o *output) run() {
+	defer o.done.Done()
+
+	for m := range o.queue {
+		// Accounted once, the retries are not counted again
+		if !quota.allow(m.topic, len(m.payload), byte(*o.config.QoS), time.Now()) {
+			outputPublishes.WithLabelValues(o.name, "dropped").Inc()
+			continue
+		}
+
+		backoff := time.Second
+		for {
+			err := wait(o.transport.Publish(m.topic, byte(*o.config.QoS), false, m.payload))
+			if err == nil {
+				outputPublishes.WithLabelValues(o.name, "success").Inc()
+				outputRecords.WithLabelValues(o.name).Add(float64(m.records))
+				outputBatches.WithLabelValues(o.name).Inc()
+				outputBytes.WithLabelValues(o.name).Add(float64(len(m.payload)))
+				batchRecords.WithLabelValues(o.name).Observe(float64(m.records))
+				batchBytes.WithLabelValues(o.name).Observe(float64(len(m.payload)))
+				break
+			}
+
+			outputPublishes.WithLabelValues(o.name, "failure").Inc()
+			log.Warn("Output ", o.name, ": error publishing, trying again in ", backoff, ": ", err.Error())
+			select {
+			case <-time.After(backoff):
+			case <-o.quit:
+				return
+			}
+
+			backoff = backoff * 2
+			if backoff > maxRetryBackoff {
+				backoff = maxRetryBackoff
+			}
+		}
+		outputQueue.WithLabelValues(o.name).Set(float64(len(o.queue)))
+	}
+}
+
+// Connection and queue of the output, for the health check
+func (o *output) state() string {
+	connection := "disconnected"
+	if o.transport.Connected() {
+		connection = "connected"
+	}
+	return o.name + " " + connection + " queue " + strconv.Itoa(len(o.queue)) + "/" + strconv.Itoa(cap(o.queue))
+}
+
+// Add a record when it passes the filters of the output
+func (o *output) add(rec record, aircraft *aircraftState, now time.Time) {
+	if o.route.accepts(rec.recordType) && o.filter.accept(aircraft, now) {
+		o.route.buffer = append(o.route.buffer, rec)
+	}
+}
+
+// Queue the batch when the window is over, or always when forced (shutdown)
+func (o *output) flush(now int64, force bool) {
+	if !force && !o.route.due(now) {
+		return
+	}
+
+	for _, m := range o.route.collect(now, o.config.Codec) {
+		o.enqueue(m)
+	}
+}
+
+// Add a message to the queue. The oldest message is dropped when the queue
+// is full, so a slow broker never blocks the main loop.
+func (o *output) enqueue(m batchMessage) {
+	for {
+		select {
+		case o.queue <- m:
+			outputQueue.WithLabelValues(o.name).Set(float64(len(o.queue)))
+			return
+		default:
+		}
+
+		select {
+		case <-o.queue:
+			outputDropped.WithLabelValues(o.name).Inc()
+			log.Warn("Output ", o.name, ": queue full, oldest message dropped")
+		default:
+		}
+	}
+}
+
+// Publish the last batch and the queue until the deadline, then disconnect
+func (o *output) stop(deadline time.Time) {
+	o.flush(time.Now().Unix(), true)
+	close(o.queue)
+
+	finished := make(chan bool)
+	go func() {
+		o.done.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+	case <-time.After(time.Until(deadline)):
+		log.Warn("Output ", o.name, ": ", len(o.queue), " messages not published")
+	}
+	close(o.quit)
+
+	o.transport.Close()
+}
+
+// Stop all the outputs
+func stopOutputs(list []*output, deadline time.Time) {
+	for _, o := range list {
+		o.stop(deadline)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Transport that fails the first publishes, with the time of each attempt
+type flakyTransport struct {
+	*fakeTransport
+	mutex    sync.Mutex
+	failures int
+	attempts []time.Time
+}
+
+func (t *flakyTransport) Publish(topic string, qos byte, retained bool, payload []byte) delivery {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.attempts = append(t.attempts, time.Now())
+	if len(t.attempts) <= t.failures {
+		return completed{errors.New("destination down")}
+	}
+	return t.fakeTransport.Publish(topic, qos, retained, payload)
+}
+
+func (t *flakyTransport) tries() []time.Time {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return append([]time.Time(nil), t.attempts...)
+}
+
+// Output publishing to the transport, its goroutine not started
+func newTestOutput(t transport, queueSize int) *output {
+	qos := 1
+	return &output{
+		name:      "test",
+		config:    OutputConfig{Name: "test", QoS: &qos, QueueSize: queueSize},
+		route:     newRoute(RouteConfig{Name: "output-test", BatchTimeWindow: 2, MQTTTopic: "adsb/{type}"}, 100),
+		queue:     make(chan batchMessage, queueSize),
+		transport: t,
+		quit:      make(chan bool),
+	}
+}
+
+func TestCheckDuplicateOutputs(t *testing.T) {
+	checkChange(t, "different names", func(c *Configuration) { c.Outputs = []OutputConfig{{Name: "a"}, {Name: "b"}} }, "")
+	checkChange(t, "same name", func(c *Configuration) { c.Outputs = []OutputConfig{{Name: "a"}, {Name: "a"}} }, "duplicate output name a")
+}
+
+func TestEnqueueDropsOldest(t *testing.T) {
+	setupPublisher(t)
+	o := newTestOutput(&fakeTransport{}, 2)
+
+	for _, topic := range []string{"a", "b", "c"} {
+		o.enqueue(batchMessage{topic: topic})
+	}
+
+	if len(o.queue) != 2 {
+		t.Fatalf("%d messages queued, want 2", len(o.queue))
+	}
+	if first, second := <-o.queue, <-o.queue; first.topic != "b" || second.topic != "c" {
+		t.Errorf("queue %s %s, want b c", first.topic, second.topic)
+	}
+}
+
+func TestOutputRetries(t *testing.T) {
+	setupPublisher(t)
+	flaky := &flakyTransport{fakeTransport: &fakeTransport{}, failures: 2}
+	o := newTestOutput(flaky, 10)
+
+	o.done.Add(1)
+	go o.run()
+	o.enqueue(batchMessage{topic: "adsb/3", payload: []byte("batch")})
+
+	for end := time.Now().Add(5 * time.Second); len(flaky.published()) == 0 && time.Now().Before(end); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	o.stop(time.Now().Add(time.Second))
+
+	if messages := flaky.published(); len(messages) != 1 || messages[0].topic != "adsb/3" {
+		t.Fatalf("published %v, want the batch once", messages)
+	}
+
+	// One second, then twice as long
+	attempts := flaky.tries()
+	if len(attempts) != 3 {
+		t.Fatalf("%d attempts, want 3", len(attempts))
+	}
+	for i, want := range []time.Duration{time.Second, 2 * time.Second} {
+		if wait := attempts[i+1].Sub(attempts[i]); wait < want-50*time.Millisecond || wait > want+time.Second {
+			t.Errorf("retry %d after %v, want %v", i+1, wait, want)
+		}
+	}
+}
+
+func TestOutputStopDeadline(t *testing.T) {
+	setupPublisher(t)
+	fake := &fakeTransport{fail: errors.New("destination down")}
+	o := newTestOutput(fake, 10)
+
+	o.done.Add(1)
+	go o.run()
+	o.enqueue(batchMessage{topic: "adsb/3", payload: []byte("batch")})
+
+	start := time.Now()
+	o.stop(start.Add(200 * time.Millisecond))
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > time.Second {
+		t.Errorf("stop returned after %v, want the deadline of 200ms", elapsed)
+	}
+
+	finished := make(chan bool)
+	go func() {
+		o.done.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Error("publishing goroutine still running after stop")
+	}
+	if !fake.closed {
+		t.Error("transport not closed")
+	}
+}
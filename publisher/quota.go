@@ -0,0 +1,407 @@
+// ----------------------------------------------------------------------------
+// Data quota
+// Accounts the bytes sent per monthly period and reduces the data as the quota runs out
+// Contact: Hugo Cruz - hugo.m.cruz@gmail.com
+// ----------------------------------------------------------------------------
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Estimated overhead of the network: IP and TCP headers per segment
+const tcpOverhead = 40
+const segmentSize = 1400
+
+// Interval to save the accounting to the state file
+const quotaSaveInterval = time.Minute
+
+//QuotaConfig - Monthly data quota
+type QuotaConfig struct {
+	MonthlyBytes     int64 `validate:"min=0"`
+	HardCapBytes     int64 `validate:"min=0"`
+	ResetDay         int   `default:"1" validate:"min=1,max=28"`
+	StateFile        string
+	Topic            string
+	Interval         int `default:"300" validate:"min=1"`
+	LowPriorityTypes []int
+}
+
+// Reduction levels by used fraction of the monthly quota:
+// 1 longer windows, 2 thinning of the records, 3 low priority types dropped
+var quotaThresholds = []float64{0.70, 0.85, 0.95}
+var quotaWindowFactors = []int64{1, 2, 4, 8}
+
+// Accounting of the current period, saved to the state file
+type quotaState struct {
+	PeriodStart     int64 `json:"periodStart"`
+	PayloadBytes    int64 `json:"payloadBytes"`
+	OverheadBytes   int64 `json:"overheadBytes"`
+	DroppedMessages int64 `json:"droppedMessages"`
+	DroppedRecords  int64 `json:"droppedRecords"`
+}
+
+// Quota status published to MQTT
+type quotaStatus struct {
+	Station         string  `json:"station"`
+	Timestamp       int64   `json:"timestamp"`
+	PeriodStart     int64   `json:"periodStart"`
+	PeriodEnd       int64   `json:"periodEnd"`
+	PayloadBytes    int64   `json:"payloadBytes"`
+	OverheadBytes   int64   `json:"overheadBytes"`
+	UsedBytes       int64   `json:"usedBytes"`
+	MonthlyBytes    int64   `json:"monthlyBytes,omitempty"`
+	HardCapBytes    int64   `json:"hardCapBytes,omitempty"`
+	UsedPercent     float64 `json:"usedPercent,omitempty"`
+	Level           int     `json:"level"`
+	WindowFactor    int64   `json:"windowFactor"`
+	DroppedMessages int64   `json:"droppedMessages"`
+	DroppedRecords  int64   `json:"droppedRecords"`
+}
+
+// Byte accounting and reduction level. Sends happen on the main loop, on
+// the outputs and on the MQTT goroutine (birth, connections and commands),
+// so the tracker has its own lock.
+type quotaTracker struct {
+	mutex         sync.Mutex
+	config        QuotaConfig
+	state         quotaState
+	level         int
+	lastSaved     time.Time
+	lastSent      time.Time
+	lastKeepalive time.Time
+	capLogged     bool
+}
+
+var quota *quotaTracker
+
+// Create the tracker and read the accounting of the current period
+func newQuota(config QuotaConfig, now time.Time) *quotaTracker {
+	q := &quotaTracker{config: config, lastSaved: now, lastSent: now, lastKeepalive: now}
+
+	if config.StateFile != "" {
+		data, err := ioutil.ReadFile(config.StateFile)
+		if err == nil {
+			err = json.Unmarshal(data, &q.state)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			log.Warn("Error reading the quota state, starting from zero: ", err.Error())
+		}
+	}
+
+	q.checkPeriod(now)
+	q.level = q.currentLevel()
+
+	log.Info("Data used in this period: ", q.state.PayloadBytes+q.state.OverheadBytes, " bytes, quota level ", q.level)
+	return q
+}
+
+// Replace the configuration, e.g. on reload
+func (q *quotaTracker) configure(config QuotaConfig) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.config = config
+	q.capLogged = false
+}
+
+// Start of the monthly period of a time
+func periodStart(now time.Time, resetDay int) time.Time {
+	now = now.UTC()
+	start := time.Date(now.Year(), now.Month(), resetDay, 0, 0, 0, 0, time.UTC)
+	if now.Before(start) {
+		start = start.AddDate(0, -1, 0)
+	}
+	return start
+}
+
+// Start a new accounting when the period changed. Called with the lock.
+func (q *quotaTracker) checkPeriod(now time.Time) {
+	start := periodStart(now, q.config.ResetDay).Unix()
+	if q.state.PeriodStart != start {
+		if q.state.PeriodStart != 0 {
+			log.Info("New quota period, ", q.state.PayloadBytes+q.state.OverheadBytes, " bytes used in the previous one")
+		}
+		q.state = quotaState{PeriodStart: start}
+		q.capLogged = false
+	}
+}
+
+// Reduction level from the used fraction of the monthly quota. Called with the lock.
+func (q *quotaTracker) currentLevel() int {
+	if q.config.MonthlyBytes <= 0 {
+		return 0
+	}
+
+	used := float64(q.state.PayloadBytes+q.state.OverheadBytes) / float64(q.config.MonthlyBytes)
+	level := 0
+	for i, threshold := range quotaThresholds {
+		if used >= threshold {
+			level = i + 1
+		}
+	}
+	return level
+}
+
+// Estimated protocol overhead of a publish: MQTT header, topic, packet id,
+// acknowledgements and the TCP/IP headers
+func publishOverhead(topic string, size int, qos byte) int64 {
+	remaining := 2 + len(topic) + size
+	if qos > 0 {
+		remaining += 2
+	}
+
+	header := 2
+	for n := remaining; n > 127; n = n / 128 {
+		header++
+	}
+
+	segments := (header+remaining)/segmentSize + 1
+	overhead := header + 2 + len(topic) + segments*tcpOverhead
+	if qos > 0 {
+		overhead += 2
+	}
+
+	// PUBACK, or PUBREC, PUBREL and PUBCOMP
+	switch qos {
+	case 1:
+		overhead += 4 + tcpOverhead
+	case 2:
+		overhead += 3 * (4 + tcpOverhead)
+	}
+
+	return int64(overhead)
+}
+
+// Estimated bytes of a connection: TCP handshake and close, CONNECT with
+// the will and the credentials, CONNACK
+func connectOverhead(clientID, username, password, willTopic string, willSize int) int64 {
+	remaining := 10 + 2 + len(clientID)
+	if willTopic != "" {
+		remaining += 2 + len(willTopic) + 2 + willSize
+	}
+	if username != "" {
+		remaining += 2 + len(username)
+	}
+	if password != "" {
+		remaining += 2 + len(password)
+	}
+
+	header := 2
+	for n := remaining; n > 127; n = n / 128 {
+		header++
+	}
+
+	// SYN, SYN-ACK, ACK, CONNECT, CONNACK and two FIN with their ACK
+	return int64(header+remaining+4) + 9*tcpOverhead
+}
+
+// Estimated bytes of the subscription to a topic: SUBSCRIBE and SUBACK
+func subscribeOverhead(topic string) int64 {
+	return int64(2+2+2+len(topic)+1+5) + 2*tcpOverhead
+}
+
+// Keepalive overhead per interval: PINGREQ and PINGRESP
+func keepaliveOverhead() int64 {
+	return 2 * (2 + tcpOverhead)
+}
+
+// Keepalive bytes until the end of the period, reserved under the hard cap.
+// The client only pings when nothing else was sent, so this is the maximum.
+func (q *quotaTracker) keepaliveReserve(now time.Time) int64 {
+	end := time.Unix(q.state.PeriodStart, 0).AddDate(0, 1, 0)
+	intervals := int64(end.Sub(now) / keepaliveInterval)
+	return intervals * keepaliveOverhead()
+}
+
+// Account bytes that cannot be dropped: connections, subscriptions and the
+// received commands. They count against the hard cap of the next messages.
+func (q *quotaTracker) account(overhead int64) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.checkPeriod(time.Now())
+	q.state.OverheadBytes += overhead
+}
+
+// Account a message before publishing it. False when it would exceed the hard cap.
+func (q *quotaTracker) allow(topic string, size int, qos byte, now time.Time) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.checkPeriod(now)
+
+	overhead := publishOverhead(topic, size, qos)
+	if q.config.HardCapBytes > 0 {
+		used := q.state.PayloadBytes + q.state.OverheadBytes + q.keepaliveReserve(now)
+		if used+int64(size)+overhead > q.config.HardCapBytes {
+			q.state.DroppedMessages++
+			if !q.capLogged {
+				log.Warn("Hard cap of the data quota reached, messages are dropped until the next period")
+				q.capLogged = true
+			}
+			return false
+		}
+	}
+
+	q.state.PayloadBytes += int64(size)
+	q.state.OverheadBytes += overhead
+	return true
+}
+
+// Account the records removed to save data
+func (q *quotaTracker) dropRecords(count int) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.state.DroppedRecords += int64(count)
+}
+
+// Multiplier of the batch windows at the current level
+func (q *quotaTracker) windowFactor() int64 {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return quotaWindowFactors[q.level]
+}
+
+// Check if the batches are thinned at the current level
+func (q *quotaTracker) thinning() bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.level >= 2
+}
+
+// Check if the records of this type are dropped at the current level
+func (q *quotaTracker) dropsType(recordType string) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.level < 3 {
+		return false
+	}
+	for _, t := range q.config.LowPriorityTypes {
+		if strconv.Itoa(t) == recordType {
+			return true
+		}
+	}
+	return false
+}
+
+// Account the keepalive, update the level and save the state. Called every second.
+func (q *quotaTracker) tick(now time.Time, connected bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.checkPeriod(now)
+
+	if connected {
+		intervals := int64(now.Sub(q.lastKeepalive) / keepaliveInterval)
+		if intervals > 0 {
+			q.state.OverheadBytes += intervals * keepaliveOverhead()
+			q.lastKeepalive = q.lastKeepalive.Add(time.Duration(intervals) * keepaliveInterval)
+		}
+	} else {
+		q.lastKeepalive = now
+	}
+
+	level := q.currentLevel()
+	if level != q.level {
+		log.Warn("Data quota level changed from ", q.level, " to ", level, ": window x", quotaWindowFactors[level])
+		q.level = level
+	}
+
+	quotaUsed.Set(float64(q.state.PayloadBytes + q.state.OverheadBytes))
+	quotaLevel.Set(float64(q.level))
+
+	if now.Sub(q.lastSaved) >= quotaSaveInterval {
+		q.save(now)
+	}
+}
+
+// Write the accounting to the state file. Called with the lock.
+func (q *quotaTracker) save(now time.Time) {
+	q.lastSaved = now
+	if q.config.StateFile == "" {
+		return
+	}
+
+	data, _ := json.Marshal(q.state)
+	temporary := q.config.StateFile + ".tmp"
+	if err := ioutil.WriteFile(temporary, data, 0644); err != nil {
+		log.Error("Error saving the quota state: ", err.Error())
+		return
+	}
+	if err := os.Rename(temporary, q.config.StateFile); err != nil {
+		log.Error("Error saving the quota state: ", err.Error())
+	}
+}
+
+// Save the accounting, e.g. at shutdown
+func (q *quotaTracker) flush(now time.Time) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.save(now)
+}
+
+// Check if the quota status must be published
+func (q *quotaTracker) due(now time.Time) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.config.Topic != "" && now.Sub(q.lastSent) >= time.Duration(q.config.Interval)*time.Second
+}
+
+// Publish the quota status (retained)
+func (q *quotaTracker) publish(client transport, now time.Time) {
+	q.mutex.Lock()
+	q.lastSent = now
+
+	used := q.state.PayloadBytes + q.state.OverheadBytes
+	status := quotaStatus{
+		Station:         configuration.StationID,
+		Timestamp:       now.Unix(),
+		PeriodStart:     q.state.PeriodStart,
+		PeriodEnd:       time.Unix(q.state.PeriodStart, 0).AddDate(0, 1, 0).Unix(),
+		PayloadBytes:    q.state.PayloadBytes,
+		OverheadBytes:   q.state.OverheadBytes,
+		UsedBytes:       used,
+		MonthlyBytes:    q.config.MonthlyBytes,
+		HardCapBytes:    q.config.HardCapBytes,
+		Level:           q.level,
+		WindowFactor:    quotaWindowFactors[q.level],
+		DroppedMessages: q.state.DroppedMessages,
+		DroppedRecords:  q.state.DroppedRecords,
+	}
+	if q.config.MonthlyBytes > 0 {
+		status.UsedPercent = float64(int64(float64(used)/float64(q.config.MonthlyBytes)*10000)) / 100
+	}
+	topic := stationTopic(q.config.Topic)
+	q.mutex.Unlock()
+
+	payload, err := json.Marshal(status)
+	if err != nil {
+		log.Error("Error creating the quota status: ", err.Error())
+		return
+	}
+	send(client, topic, 1, true, payload)
+}
+
+// Keep the last record per aircraft and type, in the order of the batch
+func thinRecords(records []record) []record {
+	last := make(map[string]int)
+	for i, rec := range records {
+		last[rec.hexIdent+","+rec.recordType] = i
+	}
+
+	thinned := make([]record, 0, len(last))
+	for i, rec := range records {
+		if last[rec.hexIdent+","+rec.recordType] == i {
+			thinned = append(thinned, rec)
+		}
+	}
+	return thinned
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPeriodStart(t *testing.T) {
+	tests := []struct {
+		now      string
+		resetDay int
+		want     string
+	}{
+		{"2026-10-18T12:00:00Z", 1, "2026-10-01T00:00:00Z"},
+		{"2026-10-18T12:00:00Z", 20, "2026-09-20T00:00:00Z"},
+		{"2026-10-20T00:00:00Z", 20, "2026-10-20T00:00:00Z"},
+		{"2026-01-05T08:00:00Z", 10, "2025-12-10T00:00:00Z"},
+	}
+
+	for _, tt := range tests {
+		now, _ := time.Parse(time.RFC3339, tt.now)
+		if got := periodStart(now, tt.resetDay).Format(time.RFC3339); got != tt.want {
+			t.Errorf("periodStart(%s, %d) = %s, want %s", tt.now, tt.resetDay, got, tt.want)
+		}
+	}
+}
+
+func TestPublishOverhead(t *testing.T) {
+	tests := []struct {
+		name  string
+		topic string
+		size  int
+		qos   byte
+		want  int64
+	}{
+		// 2 bytes header, 2+4 topic, one segment
+		{"qos 0", "adsb", 10, 0, 2 + 2 + 4 + tcpOverhead},
+		// Packet id and PUBACK
+		{"qos 1", "adsb", 10, 1, 2 + 2 + 4 + 2 + tcpOverhead + 4 + tcpOverhead},
+		// PUBREC, PUBREL and PUBCOMP
+		{"qos 2", "adsb", 10, 2, 2 + 2 + 4 + 2 + tcpOverhead + 3*(4+tcpOverhead)},
+		// 3 bytes header over 127 bytes, two segments over 1400 bytes
+		{"large", "adsb", 2000, 0, 3 + 2 + 4 + 2*tcpOverhead},
+	}
+
+	for _, tt := range tests {
+		if got := publishOverhead(tt.topic, tt.size, tt.qos); got != tt.want {
+			t.Errorf("%s: publishOverhead = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestConnectOverhead(t *testing.T) {
+	base := connectOverhead("sgn1", "", "", "", 0)
+	if want := int64(2+10+2+4+4) + 9*tcpOverhead; base != want {
+		t.Fatalf("connectOverhead without will and credentials = %d, want %d", base, want)
+	}
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+		will     string
+		willSize int
+		extra    int64
+	}{
+		{"credentials", "user", "secret", "", 0, 2 + 4 + 2 + 6},
+		{"will", "", "", "adsb/sgn1/status", 50, 2 + 16 + 2 + 50},
+	}
+
+	for _, tt := range tests {
+		if got := connectOverhead("sgn1", tt.username, tt.password, tt.will, tt.willSize) - base; got != tt.extra {
+			t.Errorf("%s: %d bytes more than the plain CONNECT, want %d", tt.name, got, tt.extra)
+		}
+	}
+}
+
+func TestQuotaHardCap(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	end := time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC)
+	reserve := int64(end.Sub(now)/keepaliveInterval) * keepaliveOverhead()
+	message := 1000 + publishOverhead("adsb", 1000, 1)
+
+	tests := []struct {
+		name  string
+		cap   int64
+		used  int64
+		allow bool
+	}{
+		{"no cap", 0, 1 << 40, true},
+		{"room for the message", reserve + message, 0, true},
+		{"reserve of the keepalive", reserve + message - 1, 0, false},
+		{"connections and commands", reserve + message, 1, false},
+	}
+
+	for _, tt := range tests {
+		q := newQuota(QuotaConfig{HardCapBytes: tt.cap, ResetDay: 1}, now)
+		q.state.OverheadBytes = tt.used
+
+		if got := q.allow("adsb", 1000, 1, now); got != tt.allow {
+			t.Errorf("%s: allow = %v, want %v", tt.name, got, tt.allow)
+		}
+
+		want := tt.used
+		if tt.allow {
+			want += message
+		} else if q.state.DroppedMessages != 1 {
+			t.Errorf("%s: dropped message not counted", tt.name)
+		}
+		if used := q.state.PayloadBytes + q.state.OverheadBytes; used != want {
+			t.Errorf("%s: %d bytes used, want %d", tt.name, used, want)
+		}
+	}
+}
+
+func TestQuotaLevel(t *testing.T) {
+	tests := []struct {
+		used   int64
+		level  int
+		factor int64
+		thin   bool
+		drops  bool
+	}{
+		{0, 0, 1, false, false},
+		{699, 0, 1, false, false},
+		{700, 1, 2, false, false},
+		{850, 2, 4, true, false},
+		{950, 3, 8, true, true},
+	}
+
+	now := time.Now()
+	for _, tt := range tests {
+		q := newQuota(QuotaConfig{MonthlyBytes: 1000, ResetDay: 1, LowPriorityTypes: []int{8}}, now)
+		q.state.PayloadBytes = tt.used
+		q.tick(now, false)
+
+		if q.level != tt.level || q.windowFactor() != tt.factor || q.thinning() != tt.thin || q.dropsType("8") != tt.drops {
+			t.Errorf("%d bytes used: level %d, window x%d, thinning %v, drops type 8 %v; want %d, x%d, %v, %v",
+				tt.used, q.level, q.windowFactor(), q.thinning(), q.dropsType("8"), tt.level, tt.factor, tt.thin, tt.drops)
+		}
+		if q.dropsType("3") {
+			t.Errorf("%d bytes used: type 3 is not low priority and must not be dropped", tt.used)
+		}
+	}
+}
+
+func TestQuotaKeepalive(t *testing.T) {
+	now := time.Now()
+	q := newQuota(QuotaConfig{ResetDay: 1}, now)
+
+	q.tick(now.Add(10*keepaliveInterval), true)
+	if want := 10 * keepaliveOverhead(); q.state.OverheadBytes != want {
+		t.Errorf("connected: %d overhead bytes, want %d", q.state.OverheadBytes, want)
+	}
+
+	q.tick(now.Add(20*keepaliveInterval), false)
+	q.tick(now.Add(21*keepaliveInterval), true)
+	if want := 11 * keepaliveOverhead(); q.state.OverheadBytes != want {
+		t.Errorf("after a disconnection: %d overhead bytes, want %d", q.state.OverheadBytes, want)
+	}
+}
+
+func TestThinRecords(t *testing.T) {
+	records := []record{
+		{recordType: "3", hexIdent: "ABC123", line: "a"},
+		{recordType: "3", hexIdent: "888123", line: "b"},
+		{recordType: "1", hexIdent: "ABC123", line: "c"},
+		{recordType: "3", hexIdent: "ABC123", line: "d"},
+	}
+
+	got := ""
+	for _, rec := range thinRecords(records) {
+		got += rec.line
+	}
+	if got != "bcd" {
+		t.Errorf("thinRecords kept %q, want the last record per aircraft and type (bcd)", got)
+	}
+}
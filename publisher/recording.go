@@ -0,0 +1,250 @@
+// ----------------------------------------------------------------------------
+// Raw SBS recording
+// Copy of the lines received from dump1090 in hourly gzip files, removed
+// after the retention time or when the directory exceeds its size limit
+// Contact: Hugo Cruz - hugo.m.cruz@gmail.com
+// ----------------------------------------------------------------------------
+
+package main
+
+import (
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Interval of the flush of the file in progress and of the rotation check
+const recordingFlushInterval = 10 * time.Second
+
+//RecordingConfig - Raw lines saved to Directory, disabled without Directory
+type RecordingConfig struct {
+	Directory      string
+	RetentionHours int `default:"48" validate:"min=1"`
+	MaxMegabytes   int `validate:"min=0"`
+	QueueSize      int `default:"10000" validate:"min=1"`
+}
+
+// Recorder of the raw lines. A nil recorder records nothing.
+type rawRecorder struct {
+	config  RecordingConfig
+	station string
+	lines   chan string
+	quit    chan bool
+	done    chan bool
+
+	hour   time.Time
+	path   string
+	file   *os.File
+	writer *gzip.Writer
+}
+
+// The recorder of the publisher, nil when disabled
+var recorder *rawRecorder
+
+// Start the recorder goroutine, nil when the recording is disabled
+func newRecorder(rc RecordingConfig, station string) (*rawRecorder, error) {
+	if rc.Directory == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(rc.Directory, 0755); err != nil {
+		return nil, err
+	}
+
+	r := &rawRecorder{
+		config:  rc,
+		station: station,
+		lines:   make(chan string, rc.QueueSize),
+		quit:    make(chan bool),
+		done:    make(chan bool),
+	}
+
+	// Files left by a publisher stopped without closing them
+	if names, err := filepath.Glob(filepath.Join(rc.Directory, "sbs-*.sbs.gz.tmp")); err == nil {
+		for _, name := range names {
+			os.Rename(name, strings.TrimSuffix(name, ".tmp"))
+		}
+	}
+
+	log.Info("Recording the raw lines to ", rc.Directory, ", kept ", rc.RetentionHours, " hours")
+	r.cleanup(time.Now())
+	go r.run()
+	return r, nil
+}
+
+// Queue a line for the recording. Lines are dropped when the disk is too slow.
+func (r *rawRecorder) record(line string) {
+	if r == nil {
+		return
+	}
+	select {
+	case r.lines <- line:
+	default:
+		recordingDropped.Inc()
+	}
+}
+
+// Write the queued lines, rotate the file every hour and flush it regularly
+func (r *rawRecorder) run() {
+	ticker := time.NewTicker(recordingFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case line := <-r.lines:
+			r.write(line, time.Now())
+
+		case <-r.quit:
+			for {
+				select {
+				case line := <-r.lines:
+					r.write(line, time.Now())
+				default:
+					r.close()
+					close(r.done)
+					return
+				}
+			}
+
+		case now := <-ticker.C:
+			if r.file != nil && !now.UTC().Truncate(time.Hour).Equal(r.hour) {
+				r.close()
+				r.cleanup(now)
+			} else if r.writer != nil {
+				r.writer.Flush()
+			}
+		}
+	}
+}
+
+// Write a line with the CR LF of dump1090
+func (r *rawRecorder) write(line string, now time.Time) {
+	hour := now.UTC().Truncate(time.Hour)
+	if r.file != nil && !hour.Equal(r.hour) {
+		r.close()
+		r.cleanup(now)
+	}
+
+	if r.file == nil {
+		if err := r.open(hour); err != nil {
+			log.Error("Error opening the recording file: ", err.Error())
+			recordingDropped.Inc()
+			return
+		}
+	}
+
+	if _, err := r.writer.Write([]byte(line + "\r\n")); err != nil {
+		log.Error("Error writing the recording file: ", err.Error())
+		recordingDropped.Inc()
+		return
+	}
+	recordingLines.Inc()
+}
+
+// Open the file of the hour: sbs-<station>-<date>_<hour>00.sbs.gz, written as .tmp
+func (r *rawRecorder) open(hour time.Time) error {
+	prefix := "sbs-"
+	if r.station != "" {
+		prefix = prefix + r.station + "-"
+	}
+	r.path = filepath.Join(r.config.Directory, prefix+hour.Format("20060102_1504")+".sbs.gz")
+
+	// Appended to the file of the same hour of a previous run, gzip allows several members
+	if _, err := os.Stat(r.path); err == nil {
+		os.Rename(r.path, r.path+".tmp")
+	}
+
+	file, err := os.OpenFile(r.path+".tmp", os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	r.hour = hour
+	r.file = file
+	r.writer = gzip.NewWriter(file)
+	log.Debug("Recording to ", r.path)
+	return nil
+}
+
+// Close the file of the hour and rename it to its final name
+func (r *rawRecorder) close() {
+	if r.file == nil {
+		return
+	}
+
+	r.writer.Close()
+	r.file.Close()
+	if err := os.Rename(r.path+".tmp", r.path); err != nil {
+		log.Error("Error closing the recording file: ", err.Error())
+	}
+	r.file = nil
+	r.writer = nil
+}
+
+// Remove the files older than the retention time, then the oldest ones while
+// the directory is over MaxMegabytes
+func (r *rawRecorder) cleanup(now time.Time) {
+	names, err := filepath.Glob(filepath.Join(r.config.Directory, "sbs-*.sbs.gz"))
+	if err != nil {
+		return
+	}
+	// Date and hour at the end of the name
+	sort.Slice(names, func(i, j int) bool {
+		return recordingTime(names[i]) < recordingTime(names[j])
+	})
+
+	retention := time.Duration(r.config.RetentionHours) * time.Hour
+	var total int64
+	kept := make([]os.FileInfo, 0, len(names))
+	keptNames := make([]string, 0, len(names))
+
+	for _, name := range names {
+		info, err := os.Stat(name)
+		if err != nil {
+			continue
+		}
+		if now.Sub(info.ModTime()) > retention {
+			r.remove(name)
+			continue
+		}
+		kept = append(kept, info)
+		keptNames = append(keptNames, name)
+		total += info.Size()
+	}
+
+	limit := int64(r.config.MaxMegabytes) * 1024 * 1024
+	for i := 0; limit > 0 && total > limit && i < len(kept); i++ {
+		r.remove(keptNames[i])
+		total -= kept[i].Size()
+	}
+}
+
+func (r *rawRecorder) remove(name string) {
+	if err := os.Remove(name); err != nil {
+		log.Warn("Error removing the recording file: ", err.Error())
+		return
+	}
+	log.Info("Recording file removed: ", filepath.Base(name))
+}
+
+// Date and hour of a recording file name
+func recordingTime(name string) string {
+	name = strings.TrimSuffix(filepath.Base(name), ".sbs.gz")
+	if len(name) < len("20060102_1504") {
+		return name
+	}
+	return name[len(name)-len("20060102_1504"):]
+}
+
+// Write the lines still queued and close the file
+func (r *rawRecorder) stop() {
+	if r == nil {
+		return
+	}
+	close(r.quit)
+	<-r.done
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Lines of a recording file
+func recordedLines(t *testing.T, name string) []string {
+	t.Helper()
+
+	file, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\r\n"), "\r\n")
+}
+
+func TestRecordingRotation(t *testing.T) {
+	directory := t.TempDir()
+	r := &rawRecorder{config: RecordingConfig{Directory: directory, RetentionHours: 48}, station: "sgn1"}
+
+	hour := time.Now().UTC().Truncate(time.Hour)
+	r.write("MSG,3,a", hour.Add(10*time.Minute))
+	r.write("MSG,3,b", hour.Add(50*time.Minute))
+
+	first := filepath.Join(directory, "sbs-sgn1-"+hour.Format("20060102_1504")+".sbs.gz")
+	if _, err := os.Stat(first + ".tmp"); err != nil {
+		t.Fatalf("file of the hour in progress: %v", err)
+	}
+
+	// The next hour closes the file and starts a new one
+	r.write("MSG,3,c", hour.Add(65*time.Minute))
+	if got := recordedLines(t, first); strings.Join(got, "|") != "MSG,3,a|MSG,3,b" {
+		t.Errorf("first hour %q, want a and b", got)
+	}
+
+	r.close()
+	second := filepath.Join(directory, "sbs-sgn1-"+hour.Add(time.Hour).Format("20060102_1504")+".sbs.gz")
+	if got := recordedLines(t, second); strings.Join(got, "|") != "MSG,3,c" {
+		t.Errorf("second hour %q, want c", got)
+	}
+
+	// A new run appends to the file of the same hour
+	r.write("MSG,3,d", hour.Add(70*time.Minute))
+	r.close()
+	if got := recordedLines(t, second); strings.Join(got, "|") != "MSG,3,c|MSG,3,d" {
+		t.Errorf("second hour after a restart %q, want c and d", got)
+	}
+}
+
+func TestRecordingRetention(t *testing.T) {
+	hour := time.Now().UTC().Truncate(time.Hour)
+
+	tests := []struct {
+		name         string
+		retention    int
+		maxMegabytes int
+		kept         []int
+	}{
+		// Files of 0, 1, 2 and 3 hours ago, of 400 kB each
+		{"retention", 2, 0, []int{0, 1}},
+		{"size limit", 48, 1, []int{0, 1}},
+		{"both", 1, 1, []int{0}},
+		{"nothing to remove", 48, 0, []int{0, 1, 2, 3}},
+	}
+
+	for _, tt := range tests {
+		directory := t.TempDir()
+		names := make([]string, 4)
+		for age := range names {
+			start := hour.Add(-time.Duration(age) * time.Hour)
+			names[age] = filepath.Join(directory, "sbs-sgn1-"+start.Format("20060102_1504")+".sbs.gz")
+			if err := ioutil.WriteFile(names[age], make([]byte, 400*1024), 0644); err != nil {
+				t.Fatal(err)
+			}
+			// Last written at the end of its hour
+			modified := start.Add(time.Hour - time.Minute)
+			os.Chtimes(names[age], modified, modified)
+		}
+
+		r := &rawRecorder{config: RecordingConfig{Directory: directory, RetentionHours: tt.retention, MaxMegabytes: tt.maxMegabytes}}
+		// At the rotation to the next hour
+		r.cleanup(hour.Add(time.Hour))
+
+		kept := make([]int, 0)
+		for age, name := range names {
+			if _, err := os.Stat(name); err == nil {
+				kept = append(kept, age)
+			}
+		}
+		if fmt.Sprint(kept) != fmt.Sprint(tt.kept) {
+			t.Errorf("%s: files of %v hours ago kept, want %v", tt.name, kept, tt.kept)
+		}
+	}
+}
@@ -0,0 +1,289 @@
+// ----------------------------------------------------------------------------
+// Configuration reload
+// SIGHUP or a change of the file applies the new configuration without a restart
+// Contact: Hugo Cruz - hugo.m.cruz@gmail.com
+// ----------------------------------------------------------------------------
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/hugomcruz/dump1090-mqtt/internal/config"
+	"github.com/hugomcruz/dump1090-mqtt/internal/envelope"
+	log "github.com/sirupsen/logrus"
+)
+
+// Interval of the configuration file watch
+const configWatchInterval = 5 * time.Second
+
+// Changes of the configuration file, handled by the main loop
+var configChanges = make(chan bool, 1)
+
+// Input and pacing given on the command line
+func applyFlags(c *Configuration) {
+	if *inputFlag != "" {
+		c.Input = *inputFlag
+	}
+	if *paceFlag > 0 {
+		c.InputPace = *paceFlag
+	}
+}
+
+// Checks across fields, not covered by the validation rules
+func checkConfiguration(c *Configuration) error {
+	if c.Dump1090Server == "" && c.Input == "" {
+		return errors.New("Dump1090Server or Input is required")
+	}
+
+	// Source used in the topics when not configured
+	if c.Source == "" {
+		c.Source = c.Dump1090Server
+	}
+	if c.Source == "" {
+		c.Source = inputSource(c.Input)
+	}
+
+	if c.AdaptiveWindow.MinWindow > c.AdaptiveWindow.MaxWindow {
+		return errors.New("AdaptiveWindow.MinWindow is greater than AdaptiveWindow.MaxWindow")
+	}
+
+	// Lower bounds of the bands, an aircraft is in the last band below its altitude
+	for i := 1; i < len(c.CoverageAltitudeBands); i++ {
+		if c.CoverageAltitudeBands[i] <= c.CoverageAltitudeBands[i-1] {
+			return errors.New("CoverageAltitudeBands must be sorted in increasing order without duplicates")
+		}
+	}
+
+	names := make(map[string]bool)
+	for _, o := range c.Outputs {
+		if names[o.Name] {
+			return errors.New("duplicate output name " + o.Name)
+		}
+		names[o.Name] = true
+	}
+
+	// Remote control needs the shared secret to authenticate the commands
+	if c.ControlTopic != "" && c.ControlSecret == "" {
+		return errors.New("ControlSecret is required with ControlTopic")
+	}
+	return nil
+}
+
+// Source of an input without dump1090 server, usable as a topic level
+func inputSource(spec string) string {
+	if spec == "-" {
+		return "stdin"
+	}
+	for _, scheme := range []string{"udp://", "tcp://", "listen://"} {
+		spec = strings.TrimPrefix(spec, scheme)
+	}
+	return filepath.Base(spec)
+}
+
+// Handlers called on every connection to MQTT for the current configuration.
+// Called again when the configuration changes, for the next connections.
+func registerConnectHandlers() {
+	handlers := make([]mqtt.OnConnectHandler, 0)
+
+	if configuration.ControlTopic != "" {
+		handlers = append(handlers, subscribeControl(newControlSettings()))
+	}
+	if configuration.StatusTopic != "" {
+		handlers = append(handlers, publishBirth(statusTopic(), birthStatus(time.Now())))
+	}
+	connectHandlers.Store(handlers)
+}
+
+// Watch the configuration file. Changes are coalesced until the main loop reloads.
+func watchConfiguration(path string) {
+	watchFile(path, configWatchInterval, func() {
+		select {
+		case configChanges <- true:
+		default:
+		}
+	})
+}
+
+// Read the configuration again and apply it. An invalid configuration is
+// rejected and the current one kept. Returns the MQTT client to use from now on.
+func reloadConfiguration(client transport, path string, now time.Time) transport {
+	next := Configuration{}
+	err := config.Load(path, "PUBLISHER", &next)
+	if err == nil {
+		applyFlags(&next)
+		err = checkConfiguration(&next)
+	}
+	if err != nil {
+		log.Error("Configuration rejected, keeping the current one: ", err.Error())
+		return client
+	}
+
+	// The embedded broker keeps running with its first settings
+	if !reflect.DeepEqual(configuration.Broker, next.Broker) {
+		log.Warn("Embedded broker settings changed, restart the publisher to apply them")
+		next.Broker = configuration.Broker
+	}
+
+	// The recording keeps its first settings too
+	if !reflect.DeepEqual(configuration.Recording, next.Recording) {
+		log.Warn("Recording settings changed, restart the publisher to apply them")
+		next.Recording = configuration.Recording
+	}
+
+	// The input is opened once
+	if configuration.Input != next.Input || configuration.InputPace != next.InputPace ||
+		!reflect.DeepEqual(configuration.InputSources, next.InputSources) {
+		log.Warn("Input settings changed, restart the publisher to apply them")
+		next.Input = configuration.Input
+		next.InputPace = configuration.InputPace
+		next.InputSources = configuration.InputSources
+	}
+
+	// Build everything first: a configuration rejected here changes nothing
+	newFilters, err := newFilter(next.Filters, next)
+	var newLists *listFilter
+	if err == nil {
+		newLists, err = loadLists(next)
+	}
+	var newSealer *envelope.Sealer
+	if err == nil {
+		newSealer, err = envelope.NewSealer(next.Security)
+	}
+	outputsChanged := !reflect.DeepEqual(configuration.Outputs, next.Outputs)
+	var newList []*output
+	if err == nil && outputsChanged {
+		// Last, the outputs start connecting when created
+		newList, err = newOutputs(next, now.Unix())
+	}
+	if err != nil {
+		log.Error("Configuration rejected, keeping the current one: ", err.Error())
+		return client
+	}
+
+	previous := configuration
+	configuration = next
+
+	if outputsChanged {
+		stopOutputs(outputs, now.Add(time.Duration(next.ShutdownTimeout)*time.Second))
+		outputs = newList
+	}
+
+	filter = newFilters
+	useLists(newLists, next)
+	sealer = newSealer
+	quota.configure(next.Quota)
+	config.SetLogLevel(next.LogLevel)
+	routes = rebuildRoutes(routes, now.Unix())
+
+	if coverageChanged(previous, next) {
+		coverage = newCoverage(next, now)
+		log.Info("Coverage statistics restarted with the new settings")
+	}
+
+	address := next.Dump1090Server + ":" + strconv.Itoa(next.Dump1090Port)
+	if next.Input == "" && address != input.currentAddress() {
+		input.setAddress(address)
+	}
+
+	if mqttChanged(previous, next) {
+		client = reconnectMQTT(client, previous)
+	}
+
+	registerConnectHandlers()
+	log.Info("Configuration reloaded from ", path)
+	return client
+}
+
+// New routes from the configuration. The records of the batches in progress
+// move to the new routes, so a reload does not drop them.
+func rebuildRoutes(current []*batchRoute, now int64) []*batchRoute {
+	next := newRoutes(configuration, now)
+
+	for _, route := range current {
+		for _, rec := range route.buffer {
+			routeRecord(next, rec)
+		}
+	}
+	return next
+}
+
+// Check if the coverage statistics must start again
+func coverageChanged(previous Configuration, next Configuration) bool {
+	return previous.ReceiverLatitude != next.ReceiverLatitude ||
+		previous.ReceiverLongitude != next.ReceiverLongitude ||
+		previous.ReceiverAltitude != next.ReceiverAltitude ||
+		previous.CoverageTopic != next.CoverageTopic ||
+		previous.CoverageInterval != next.CoverageInterval ||
+		previous.CoverageSectors != next.CoverageSectors ||
+		!reflect.DeepEqual(previous.CoverageAltitudeBands, next.CoverageAltitudeBands) ||
+		previous.StationID != next.StationID ||
+		previous.Source != next.Source
+}
+
+// Check if the connection to MQTT must be opened again: broker, credentials,
+// and the topics set up at connection time (last will, commands)
+func mqttChanged(previous Configuration, next Configuration) bool {
+	return previous.MQTTServerURL != next.MQTTServerURL ||
+		previous.MQTTClientID != next.MQTTClientID ||
+		previous.MQTTUsername != next.MQTTUsername ||
+		previous.MQTTPassword != next.MQTTPassword ||
+		previous.MQTTProxy != next.MQTTProxy ||
+		!reflect.DeepEqual(previous.MQTTHeaders, next.MQTTHeaders) ||
+		previous.StatusTopic != next.StatusTopic ||
+		previous.ControlTopic != next.ControlTopic ||
+		previous.StationID != next.StationID ||
+		previous.Source != next.Source
+}
+
+// Close the connection cleanly and connect with the current configuration.
+// The messages still pending are published again on the new connection.
+// When the new settings do not connect, the previous MQTT settings are restored.
+func reconnectMQTT(client transport, previous Configuration) transport {
+	log.Info("MQTT settings changed, reconnecting")
+
+	// The offline status goes to the previous station topic
+	current := configuration
+	configuration = previous
+	publishOffline(client)
+	configuration = current
+
+	waitPending(time.Now().Add(time.Duration(configuration.ShutdownTimeout) * time.Second))
+	pending := takePending()
+	client.Close()
+
+	registerConnectHandlers()
+	newClient := connect(configuration)
+
+	if newClient == nil {
+		log.Error("Error connecting with the new MQTT settings, restoring the previous ones")
+
+		configuration.MQTTServerURL = previous.MQTTServerURL
+		configuration.MQTTClientID = previous.MQTTClientID
+		configuration.MQTTUsername = previous.MQTTUsername
+		configuration.MQTTPassword = previous.MQTTPassword
+		configuration.MQTTHeaders = previous.MQTTHeaders
+		configuration.MQTTProxy = previous.MQTTProxy
+		configuration.StatusTopic = previous.StatusTopic
+		configuration.StationID = previous.StationID
+		configuration.Source = previous.Source
+		configuration.ControlTopic = previous.ControlTopic
+
+		registerConnectHandlers()
+		newClient = connect(configuration)
+		if newClient == nil {
+			log.Error("Error connecting to MQTT with the previous settings. Exiting now...")
+			os.Exit(1)
+		}
+	}
+
+	resendPending(newClient, pending)
+	return newClient
+}
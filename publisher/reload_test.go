@@ -0,0 +1,190 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hugomcruz/dump1090-mqtt/internal/codec"
+	"github.com/hugomcruz/dump1090-mqtt/internal/config"
+	"github.com/hugomcruz/dump1090-mqtt/internal/sequence"
+)
+
+// Configuration that passes checkConfiguration
+func checkedConfiguration() Configuration {
+	return Configuration{
+		Dump1090Server:        "10.0.0.1",
+		CoverageAltitudeBands: []int64{0, 10000, 20000},
+		AdaptiveWindow:        AdaptiveConfig{MinWindow: 1, MaxWindow: 30},
+	}
+}
+
+// Check the configuration after a change, err is a part of the expected error
+func checkChange(t *testing.T, name string, change func(c *Configuration), err string) Configuration {
+	t.Helper()
+
+	c := checkedConfiguration()
+	change(&c)
+
+	got := checkConfiguration(&c)
+	if (err == "" && got != nil) || (err != "" && (got == nil || !strings.Contains(got.Error(), err))) {
+		t.Errorf("%s: error %v, want %q", name, got, err)
+	}
+	return c
+}
+
+func TestCheckAltitudeBands(t *testing.T) {
+	tests := []struct {
+		name  string
+		bands []int64
+		err   string
+	}{
+		{"sorted", []int64{0, 10000, 20000}, ""},
+		{"not sorted", []int64{0, 20000, 10000}, "CoverageAltitudeBands"},
+		{"duplicate band", []int64{0, 10000, 10000}, "CoverageAltitudeBands"},
+	}
+
+	for _, tt := range tests {
+		checkChange(t, tt.name, func(c *Configuration) { c.CoverageAltitudeBands = tt.bands }, tt.err)
+	}
+}
+
+// Configuration file of the reload tests with more settings
+func writeSettings(t *testing.T, path string, settings string) {
+	t.Helper()
+
+	content := `{"MQTTServerURL":"tcp://127.0.0.1:1883", "MQTTClientID":"sgn1", "MQTTTopic":"adsb/{station}/{type}",
+		"Dump1090Server":"10.0.0.1", "StationID":"sgn1", "Codec":"none", "BatchTimeWindow":2` + settings + `}`
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Publisher started with the settings, as the main function does. Returns
+// the main broker and the configuration file.
+func setupReload(t *testing.T, settings string) (*fakeTransport, string) {
+	t.Helper()
+
+	fake := setupPublisher(t)
+	path := filepath.Join(t.TempDir(), "config.json")
+	writeSettings(t, path, settings)
+
+	configuration = Configuration{}
+	if err := config.Load(path, "PUBLISHER", &configuration); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkConfiguration(&configuration); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	filter, _ = newFilter(configuration.Filters, configuration)
+	l, _ := loadLists(configuration)
+	useLists(l, configuration)
+	input = newInput("", "10.0.0.1:30003", 0, nil)
+	coverage = newCoverage(configuration, now)
+	routes = newRoutes(configuration, now.Unix())
+
+	var err error
+	if outputs, err = newOutputs(configuration, now.Unix()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		stopOutputs(outputs, time.Now())
+		outputs = nil
+	})
+	return fake, path
+}
+
+// Sequence number of the next batch of the first route
+func nextSequence(t *testing.T, now int64) uint64 {
+	t.Helper()
+
+	routeRecord(routes, record{recordType: "3", hexIdent: "ABC123", line: "3,1000,ABC123"})
+	messages := routes[0].collect(now, codec.None)
+	if len(messages) != 1 {
+		t.Fatalf("%d messages, want 1", len(messages))
+	}
+	h, _, ok, err := sequence.Split(messages[0].payload)
+	if !ok || err != nil {
+		t.Fatalf("batch without header (%v)", err)
+	}
+	return h.Seq
+}
+
+func TestReloadKeepsBatchSequence(t *testing.T) {
+	fake, path := setupReload(t, `, "SequenceHeader":true`)
+
+	if seq := nextSequence(t, time.Now().Unix()); seq != 1 {
+		t.Fatalf("first batch %d, want 1", seq)
+	}
+
+	writeSettings(t, path, `, "SequenceHeader":true, "BatchTimeWindow":5`)
+	if client := reloadConfiguration(fake, path, time.Now()); client != fake {
+		t.Error("connection to MQTT replaced without MQTT changes")
+	}
+	if routes[0].timeWindow != 5 {
+		t.Fatalf("window %ds after the reload, want 5s", routes[0].timeWindow)
+	}
+
+	// The subscribers see a new run only when the publisher restarts
+	if seq := nextSequence(t, time.Now().Unix()); seq != 2 {
+		t.Errorf("first batch after the reload %d, want 2", seq)
+	}
+}
+
+func TestReloadInvalidKeepsConfiguration(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings string
+	}{
+		{"unknown field", `, "BatchTimeWindow":9, "Unknown":1`},
+		{"check across fields", `, "BatchTimeWindow":9, "CoverageAltitudeBands":[0, 20000, 10000]`},
+		{"area file missing", `, "BatchTimeWindow":9, "Filters":{"Areas":[{"Name":"x", "Mode":"include", "GeoJSON":"/nonexistent.geojson"}]}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, path := setupReload(t, "")
+			current := routes[0]
+
+			writeSettings(t, path, tt.settings)
+			reloadConfiguration(fake, path, time.Now())
+
+			if configuration.BatchTimeWindow != 2 || routes[0] != current || current.timeWindow != 2 {
+				t.Errorf("window %ds, routes rebuilt %v, want the current configuration kept", configuration.BatchTimeWindow, routes[0] != current)
+			}
+		})
+	}
+}
+
+func TestReloadRestartsOutputs(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	output := `, "Outputs":[{"Name":"web", "Type":"http", "URL":"` + server.URL + `", "Topic":"%s"}]`
+	fake, path := setupReload(t, strings.Replace(output, "%s", "adsb/a", 1))
+	first := outputs[0]
+
+	// Outputs not changed keep running
+	writeSettings(t, path, strings.Replace(output, "%s", "adsb/a", 1)+`, "BatchTimeWindow":5`)
+	reloadConfiguration(fake, path, time.Now())
+	if len(outputs) != 1 || outputs[0] != first {
+		t.Fatal("output restarted without changes")
+	}
+
+	writeSettings(t, path, strings.Replace(output, "%s", "adsb/b", 1))
+	reloadConfiguration(fake, path, time.Now())
+	if len(outputs) != 1 || outputs[0] == first || outputs[0].route.topic.String() != "adsb/b" {
+		t.Fatalf("outputs %v after a change, want the output with the new topic", outputs)
+	}
+	select {
+	case <-first.quit:
+	default:
+		t.Error("previous output still running")
+	}
+}
@@ -0,0 +1,300 @@
+// ----------------------------------------------------------------------------
+// Batch routing
+// Maps each record type to its own batch window, topic and QoS
+// Contact: Hugo Cruz - hugo.m.cruz@gmail.com
+// ----------------------------------------------------------------------------
+
+package main
+
+import (
+	"strconv"
+
+	"github.com/hugomcruz/dump1090-mqtt/internal/sequence"
+	"github.com/hugomcruz/dump1090-mqtt/internal/topic"
+	log "github.com/sirupsen/logrus"
+)
+
+//RouteConfig - Routing table entry from the configuration
+type RouteConfig struct {
+	Name            string
+	RecordTypes     []int
+	BatchTimeWindow int `validate:"min=0"`
+	MQTTTopic       string
+	MQTTQos         *int `validate:"min=0,max=2"`
+	SequenceHeader  bool
+}
+
+//AdaptiveConfig - Batch window adjusted to the traffic, disabled without TargetBytes
+type AdaptiveConfig struct {
+	TargetBytes int `validate:"min=0"`
+	MinWindow   int `default:"1" validate:"min=1"`
+	MaxWindow   int `default:"30" validate:"min=1"`
+}
+
+// Compressed batch of records for one topic
+type batchMessage struct {
+	topic   string
+	route   string
+	records int
+	types   map[string]int
+	payload []byte
+}
+
+// Last sequence number per route and topic. Kept when the routes are
+// rebuilt by a reload so that the subscribers see no gap.
+var batchSequence = make(map[string]uint64)
+
+// Weight of the last window in the observed byte rate
+const adaptiveSmoothing = 0.3
+
+// Batch route with its own buffer and time window
+type batchRoute struct {
+	name        string
+	types       map[string]bool
+	timeWindow  int64
+	topic       topic.Template
+	qos         byte
+	header      bool
+	startTime   int64
+	buffer      []record
+	byteRate    float64
+	pinned      bool
+	escape      func(string) string
+	destination string
+}
+
+// Destination label of the metrics for the main broker, the outputs use their name
+const mainDestination = "main"
+
+// Create the batch routes from the configuration.
+// Without a routing table all record types share the global window and topic.
+func newRoutes(configuration Configuration, now int64) []*batchRoute {
+
+	routeConfigs := configuration.Routes
+	if len(routeConfigs) == 0 {
+		routeConfigs = []RouteConfig{{
+			Name:            "default",
+			BatchTimeWindow: configuration.BatchTimeWindow,
+			MQTTTopic:       configuration.MQTTTopic,
+		}}
+	}
+
+	routes := make([]*batchRoute, 0, len(routeConfigs))
+
+	for i, rc := range routeConfigs {
+		if rc.Name == "" {
+			rc.Name = "route-" + strconv.Itoa(i)
+		}
+		if configuration.SequenceHeader {
+			rc.SequenceHeader = true
+		}
+		routes = append(routes, newRoute(routeDefaults(rc, configuration), now))
+	}
+
+	return routes
+}
+
+// Window, topic and QoS of the configuration for a route without them
+func routeDefaults(rc RouteConfig, configuration Configuration) RouteConfig {
+	if rc.BatchTimeWindow <= 0 {
+		rc.BatchTimeWindow = configuration.BatchTimeWindow
+	}
+	if rc.MQTTTopic == "" {
+		rc.MQTTTopic = configuration.MQTTTopic
+	}
+	if rc.MQTTQos == nil {
+		qos := configuration.MQTTQos
+		rc.MQTTQos = &qos
+	}
+	return rc
+}
+
+// Create a batch route
+func newRoute(rc RouteConfig, now int64) *batchRoute {
+	route := &batchRoute{
+		name:        rc.Name,
+		types:       make(map[string]bool),
+		timeWindow:  int64(rc.BatchTimeWindow),
+		header:      rc.SequenceHeader,
+		startTime:   now,
+		buffer:      make([]record, 0),
+		destination: mainDestination,
+	}
+
+	route.topic = topic.Parse(rc.MQTTTopic)
+	if rc.MQTTQos != nil {
+		route.qos = byte(*rc.MQTTQos)
+	}
+
+	for _, t := range rc.RecordTypes {
+		route.types[strconv.Itoa(t)] = true
+	}
+
+	log.Info("Route ", route.name, ": types ", rc.RecordTypes, ", window ", route.timeWindow, "s, topic ", route.topic, ", QoS ", route.qos)
+	batchWindow.WithLabelValues(route.name).Set(float64(route.timeWindow))
+
+	return route
+}
+
+// Check if the route takes this record type. No types configured means all types.
+func (r *batchRoute) accepts(recordType string) bool {
+	if len(r.types) == 0 {
+		return true
+	}
+	return r.types[recordType]
+}
+
+// Check if the time window for the batch is exceeded
+func (r *batchRoute) due(now int64) bool {
+	return now-r.startTime >= r.timeWindow*quota.windowFactor()
+}
+
+// Compress and publish the batched records and start a new time window.
+func (r *batchRoute) flush(client transport, now int64) {
+	for _, m := range r.collect(now, configuration.Codec) {
+		batch := m
+		sendPending(client, pendingMessage{Topic: m.topic, Qos: r.qos, Payload: m.payload, batch: &batch})
+	}
+}
+
+// Account a batch acknowledged by the main broker
+func countBatch(m *batchMessage) {
+	for t, n := range m.types {
+		recordsSent.WithLabelValues(t).Add(float64(n))
+	}
+	batchesSent.WithLabelValues(m.route).Inc()
+	batchRecords.WithLabelValues(mainDestination).Observe(float64(m.records))
+	batchBytes.WithLabelValues(mainDestination).Observe(float64(len(m.payload)))
+
+	stats.recordsBatched += int64(m.records)
+	stats.batchesSent++
+	stats.bytesSent += int64(len(m.payload))
+}
+
+// Take the records of the time window and start a new one. Records are
+// grouped by their expanded topic and compressed, one message per topic.
+func (r *batchRoute) collect(now int64, codecName string) []batchMessage {
+	messages := make([]batchMessage, 0)
+	sentBytes := 0
+
+	// Records of a paused publisher are dropped
+	if len(r.buffer) > 0 && !paused {
+		log.Debug("Batch window completed for route ", r.name, ". Preparing to send data.")
+
+		// Only the last record per aircraft and type when the quota runs out
+		if quota.thinning() {
+			before := len(r.buffer)
+			r.buffer = thinRecords(r.buffer)
+			quota.dropRecords(before - len(r.buffer))
+		}
+
+		topics := make([]string, 0)
+		groups := make(map[string][]string)
+		types := make(map[string]map[string]int)
+
+		for _, rec := range r.buffer {
+			values := topicValues(rec)
+			if r.escape != nil {
+				for name, value := range values {
+					values[name] = r.escape(value)
+				}
+			}
+			t := r.topic.Expand(values)
+			if _, ok := groups[t]; !ok {
+				topics = append(topics, t)
+				types[t] = make(map[string]int)
+			}
+			groups[t] = append(groups[t], rec.line)
+			types[t][rec.recordType]++
+		}
+
+		for _, t := range topics {
+			lines := groups[t]
+			if r.header {
+				lines = append([]string{r.sequenceHeader(t, len(groups[t]), now).Line()}, lines...)
+			}
+
+			// Compress (GZIP) the batched records
+			compressedMessage := compress(lines, codecName, r.destination)
+			messages = append(messages, batchMessage{topic: t, route: r.name, records: len(groups[t]), types: types[t], payload: sealer.Seal(compressedMessage)})
+
+			sentBytes += len(compressedMessage)
+		}
+	}
+
+	if configuration.AdaptiveWindow.TargetBytes > 0 && !paused {
+		r.adapt(len(messages), sentBytes, now)
+	}
+
+	// Reset variables for next time window batch
+	r.startTime = now
+	r.buffer = make([]record, 0)
+
+	return messages
+}
+
+// Header line with the next sequence number of the route and topic
+func (r *batchRoute) sequenceHeader(t string, count int, now int64) sequence.Header {
+	batchSequence[r.name+" "+t]++
+	return sequence.Header{
+		Station: configuration.StationID,
+		Stream:  r.name,
+		Run:     startTime.Unix(),
+		Seq:     batchSequence[r.name+" "+t],
+		Start:   r.startTime,
+		End:     now,
+		Count:   count,
+	}
+}
+
+// Adjust the window so that the messages reach the target compressed size.
+// The bytes per second of a message are smoothed over the last windows.
+func (r *batchRoute) adapt(messages int, sentBytes int, now int64) {
+	adaptive := configuration.AdaptiveWindow
+
+	// Window set with the set-batch-window command
+	if r.pinned {
+		return
+	}
+
+	elapsed := now - r.startTime
+	if elapsed <= 0 {
+		return
+	}
+
+	observed := 0.0
+	if messages > 0 {
+		observed = float64(sentBytes) / float64(messages) / float64(elapsed)
+	}
+	if r.byteRate == 0 {
+		r.byteRate = observed
+	} else {
+		r.byteRate = adaptiveSmoothing*observed + (1-adaptiveSmoothing)*r.byteRate
+	}
+
+	window := int64(adaptive.MaxWindow)
+	if r.byteRate > 0 {
+		window = int64(float64(adaptive.TargetBytes)/r.byteRate + 0.5)
+	}
+	if window < int64(adaptive.MinWindow) {
+		window = int64(adaptive.MinWindow)
+	}
+	if window > int64(adaptive.MaxWindow) {
+		window = int64(adaptive.MaxWindow)
+	}
+
+	if window != r.timeWindow {
+		log.Debug("Batch window of route ", r.name, " adjusted to ", window, "s (", int64(r.byteRate), " bytes/s)")
+		r.timeWindow = window
+	}
+	batchWindow.WithLabelValues(r.name).Set(float64(window))
+}
+
+// Add a record to every route that takes its type
+func routeRecord(routes []*batchRoute, rec record) {
+	for _, route := range routes {
+		if route.accepts(rec.recordType) {
+			route.buffer = append(route.buffer, rec)
+		}
+	}
+}
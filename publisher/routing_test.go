@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/hugomcruz/dump1090-mqtt/internal/codec"
+	"github.com/hugomcruz/dump1090-mqtt/internal/sequence"
+)
+
+func TestSequenceHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		global bool
+		route  bool
+		header bool
+	}{
+		{"off by default", false, false, false},
+		{"route", false, true, true},
+		{"all the routes", true, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupPublisher(t)
+			configuration.SequenceHeader = tt.global
+			configuration.Routes = []RouteConfig{{Name: "positions", SequenceHeader: tt.route}}
+
+			routes := newRoutes(configuration, 100)
+			for run := 1; run <= 2; run++ {
+				routeRecord(routes, record{recordType: "3", hexIdent: "ABC123", line: "3,1000,ABC123"})
+				messages := routes[0].collect(int64(100+2*run), codec.None)
+				if len(messages) != 1 {
+					t.Fatalf("%d messages, want 1", len(messages))
+				}
+
+				h, records, ok, err := sequence.Split(messages[0].payload)
+				if err != nil || ok != tt.header {
+					t.Fatalf("header %v (%v), want %v", ok, err, tt.header)
+				}
+				if strings.TrimSpace(string(records)) != "3,1000,ABC123" {
+					t.Errorf("records %q", records)
+				}
+				if ok && (h.Seq != uint64(run) || h.Stream != "positions" || h.Station != "sgn1" || h.Count != 1) {
+					t.Errorf("batch %d: header %+v", run, h)
+				}
+			}
+		})
+	}
+}
+
+func TestRouteTypes(t *testing.T) {
+	setupPublisher(t)
+	qos0 := 0
+	configuration.Routes = []RouteConfig{
+		{Name: "positions", RecordTypes: []int{2, 3}, MQTTTopic: "adsb/positions", MQTTQos: &qos0},
+		{Name: "all"},
+	}
+
+	routes := newRoutes(configuration, 100)
+	for _, recordType := range []string{"1", "3", "4"} {
+		routeRecord(routes, record{recordType: recordType, hexIdent: "ABC123", line: recordType + ",1000"})
+	}
+
+	// Window, topic and QoS of the configuration when the route has none
+	tests := []struct {
+		route    int
+		buffered int
+		topic    string
+		records  int
+		qos      byte
+	}{
+		{0, 1, "adsb/positions", 1, 0},
+		{1, 3, "adsb/sgn1/1", 1, 1},
+	}
+	for _, tt := range tests {
+		r := routes[tt.route]
+		if r.qos != tt.qos {
+			t.Errorf("route %s: QoS %d, want %d", r.name, r.qos, tt.qos)
+		}
+		if r.timeWindow != 2 || len(r.buffer) != tt.buffered {
+			t.Errorf("route %s: window %d with %d records, want 2 with %d", r.name, r.timeWindow, len(r.buffer), tt.buffered)
+		}
+		messages := r.collect(102, codec.None)
+		if messages[0].topic != tt.topic || messages[0].records != tt.records {
+			t.Errorf("route %s: first message to %s with %d records, want %s with %d", r.name, messages[0].topic, messages[0].records, tt.topic, tt.records)
+		}
+	}
+}
+
+func TestAdaptiveWindow(t *testing.T) {
+	tests := []struct {
+		name     string
+		byteRate float64
+		messages int
+		bytes    int
+		elapsed  int64
+		window   int64
+	}{
+		{"target reached in 5 seconds", 0, 1, 3000, 3, 5},
+		{"per message", 0, 2, 6000, 3, 5},
+		{"busy, minimum window", 0, 1, 300000, 3, 2},
+		{"quiet, maximum window", 0, 1, 30, 3, 20},
+		{"no messages", 0, 0, 0, 3, 20},
+		{"smoothed", 1000, 1, 6000, 3, 4},
+		{"no time elapsed", 0, 1, 3000, 0, 3},
+	}
+
+	for _, tt := range tests {
+		setupPublisher(t)
+		configuration.AdaptiveWindow = AdaptiveConfig{TargetBytes: 5000, MinWindow: 2, MaxWindow: 20}
+
+		r := newRoute(RouteConfig{Name: "adaptive", BatchTimeWindow: 3}, 100)
+		r.byteRate = tt.byteRate
+		r.adapt(tt.messages, tt.bytes, 100+tt.elapsed)
+
+		if r.timeWindow != tt.window {
+			t.Errorf("%s: window %ds, want %ds", tt.name, r.timeWindow, tt.window)
+		}
+	}
+}
+
+func TestSetBatchWindowPinned(t *testing.T) {
+	setupPublisher(t)
+	configuration.AdaptiveWindow = AdaptiveConfig{TargetBytes: 5000, MinWindow: 2, MaxWindow: 20}
+	routes = []*batchRoute{newRoute(RouteConfig{Name: "adaptive", BatchTimeWindow: 3}, 100)}
+	r := routes[0]
+
+	if err := setBatchWindow(json.RawMessage(`{"seconds":7}`)); err != nil {
+		t.Fatal(err)
+	}
+	r.adapt(1, 3000, 103)
+	if r.timeWindow != 7 {
+		t.Errorf("window %ds after a batch, want the 7s of the command", r.timeWindow)
+	}
+
+	if err := setBatchWindow(json.RawMessage(`{"seconds":0}`)); err != nil {
+		t.Fatal(err)
+	}
+	r.adapt(1, 3000, 103)
+	if r.timeWindow != 5 {
+		t.Errorf("window %ds after a batch, want 5s adaptive again", r.timeWindow)
+	}
+
+	configuration.AdaptiveWindow = AdaptiveConfig{}
+	if err := setBatchWindow(json.RawMessage(`{"seconds":0}`)); err == nil {
+		t.Error("0 seconds accepted without the adaptive window")
+	}
+}
+
+func TestCheckAdaptiveWindow(t *testing.T) {
+	tests := []struct {
+		name     string
+		min, max int
+		err      string
+	}{
+		{"bounds", 1, 30, ""},
+		{"same bound", 5, 5, ""},
+		{"minimum over the maximum", 10, 5, "MinWindow is greater"},
+	}
+
+	for _, tt := range tests {
+		checkChange(t, tt.name, func(c *Configuration) { c.AdaptiveWindow.MinWindow, c.AdaptiveWindow.MaxWindow = tt.min, tt.max }, tt.err)
+	}
+}
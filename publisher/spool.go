@@ -0,0 +1,192 @@
+// ----------------------------------------------------------------------------
+// Pending messages and disk spool
+// Messages not acknowledged at shutdown are saved and published on next start
+// Contact: Hugo Cruz - hugo.m.cruz@gmail.com
+// ----------------------------------------------------------------------------
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Message published and not yet completed
+type pendingMessage struct {
+	Topic    string
+	Qos      byte
+	Retained bool
+	Payload  []byte
+	token    delivery
+	batch    *batchMessage
+}
+
+// Messages with outstanding tokens
+var pendingMessages = make([]pendingMessage, 0)
+
+// Keep the message until its token completes
+func trackPending(message pendingMessage) {
+	pendingMessages = append(pendingMessages, message)
+	prunePending()
+}
+
+// Remove the messages with completed tokens
+func prunePending() {
+	remaining := pendingMessages[:0]
+	for _, message := range pendingMessages {
+		select {
+		case <-message.token.Done():
+			if message.token.Error() != nil {
+				log.Warn("Error publishing to ", message.Topic, ": ", message.token.Error())
+				publishResults.WithLabelValues("failure").Inc()
+				// Saved for the next start instead of being lost
+				spoolMessages([]pendingMessage{message})
+			} else {
+				publishResults.WithLabelValues("success").Inc()
+				if message.batch != nil {
+					countBatch(message.batch)
+				}
+			}
+		default:
+			remaining = append(remaining, message)
+		}
+	}
+	pendingMessages = remaining
+}
+
+// Wait for the outstanding tokens until the deadline
+func waitPending(deadline time.Time) {
+	for _, message := range pendingMessages {
+		timeout := time.Until(deadline)
+		if timeout <= 0 {
+			break
+		}
+		message.token.WaitTimeout(timeout)
+	}
+	prunePending()
+}
+
+// Take the pending messages, to publish them again with another connection
+func takePending() []pendingMessage {
+	messages := pendingMessages
+	pendingMessages = make([]pendingMessage, 0)
+	return messages
+}
+
+// Publish again the messages of a previous connection
+func resendPending(client transport, messages []pendingMessage) {
+	if len(messages) == 0 {
+		return
+	}
+
+	log.Info("Publishing again ", len(messages), " pending messages")
+	for _, message := range messages {
+		sendPending(client, message)
+	}
+}
+
+// Check if a message is saved to the spool: only the batches. The status,
+// coverage and quota messages are retained and published again fresh on
+// the next start, a replayed offline status would replace the birth.
+func spoolable(message pendingMessage) bool {
+	return message.batch != nil && !message.Retained
+}
+
+// Save the pending messages to the spool directory
+func spoolPending() {
+	spoolMessages(pendingMessages)
+	pendingMessages = pendingMessages[:0]
+}
+
+// Save the batches of the messages to the spool directory
+func spoolMessages(messages []pendingMessage) {
+	batches := make([]pendingMessage, 0, len(messages))
+	for _, message := range messages {
+		if spoolable(message) {
+			batches = append(batches, message)
+		}
+	}
+	if len(batches) == 0 {
+		return
+	}
+
+	if configuration.SpoolDirectory == "" {
+		log.Warn(len(batches), " batches not published and no SpoolDirectory configured")
+		return
+	}
+
+	if err := os.MkdirAll(configuration.SpoolDirectory, 0755); err != nil {
+		log.Error("Error creating the spool directory: ", err.Error())
+		return
+	}
+
+	for i, message := range batches {
+		data, err := json.Marshal(message)
+		if err != nil {
+			log.Error("Error spooling message: ", err.Error())
+			continue
+		}
+
+		filename := "batch-" + strconv.FormatInt(time.Now().UnixNano(), 10) + "-" + strconv.Itoa(i) + ".json"
+		if err := ioutil.WriteFile(filepath.Join(configuration.SpoolDirectory, filename), data, 0644); err != nil {
+			log.Error("Error spooling message: ", err.Error())
+		}
+	}
+
+	log.Info(len(batches), " batches saved to ", configuration.SpoolDirectory)
+}
+
+// Publish the messages spooled by the previous run. Files are removed once acknowledged.
+func replaySpool(client transport) {
+	if configuration.SpoolDirectory == "" {
+		return
+	}
+
+	files, err := filepath.Glob(filepath.Join(configuration.SpoolDirectory, "batch-*.json"))
+	if err != nil || len(files) == 0 {
+		return
+	}
+	sort.Strings(files)
+
+	log.Info("Publishing ", len(files), " spooled messages")
+
+	for _, filename := range files {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			log.Error("Error reading spooled message: ", err.Error())
+			continue
+		}
+
+		var message pendingMessage
+		if err := json.Unmarshal(data, &message); err != nil {
+			log.Error("Invalid spooled message ", filename)
+			continue
+		}
+
+		// Status messages spooled by older versions are out of date
+		if message.Retained {
+			log.Warn("Retained message in the spool, not published: ", filename)
+			os.Remove(filename)
+			continue
+		}
+
+		if !quota.allow(message.Topic, len(message.Payload), message.Qos, time.Now()) {
+			log.Warn("Data quota exceeded, keeping the spooled messages for later")
+			return
+		}
+
+		if err := wait(client.Publish(message.Topic, message.Qos, message.Retained, message.Payload)); err != nil {
+			log.Warn("Error publishing spooled message, keeping it for later: ", filename)
+			return
+		}
+
+		os.Remove(filename)
+	}
+}
@@ -0,0 +1,161 @@
+// ----------------------------------------------------------------------------
+// Station status
+// Retained birth, heartbeat and last will messages on the status topic
+// Contact: Hugo Cruz - hugo.m.cruz@gmail.com
+// ----------------------------------------------------------------------------
+
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/hugomcruz/dump1090-mqtt/internal/station"
+	log "github.com/sirupsen/logrus"
+)
+
+// Version of the publisher, reported in the station status
+const version = "1.1.0"
+
+// Configuration summary in the birth message
+type configSummary struct {
+	BatchTimeWindow int      `json:"batchTimeWindow"`
+	Routes          []string `json:"routes"`
+	Codec           string   `json:"codec"`
+	Filters         bool     `json:"filters"`
+	AllowList       bool     `json:"allowList"`
+	DenyList        bool     `json:"denyList"`
+}
+
+// Counters at the previous heartbeat, for the rates
+var lastHeartbeat time.Time
+var lastHeartbeatStats publisherStats
+
+// Expanded status topic, empty when not configured
+func statusTopic() string {
+	if configuration.StatusTopic == "" {
+		return ""
+	}
+	return stationTopic(configuration.StatusTopic)
+}
+
+// Status message with the fields common to all the events
+func newStatus(event string, online bool, now time.Time) station.Status {
+	status := station.Status{
+		Station:           configuration.StationID,
+		Online:            online,
+		Event:             event,
+		Version:           version,
+		Timestamp:         now.Unix(),
+		HeartbeatInterval: configuration.HeartbeatInterval,
+		Input:             input.url(),
+	}
+
+	if receiverKnown() {
+		status.Receiver = &station.Receiver{
+			Latitude:  configuration.ReceiverLatitude,
+			Longitude: configuration.ReceiverLongitude,
+			Altitude:  configuration.ReceiverAltitude,
+		}
+	}
+
+	return status
+}
+
+// Last will: the broker flips the status to offline when the connection is lost
+func willPayload() []byte {
+	payload, _ := json.Marshal(station.Status{Station: configuration.StationID, Online: false, Event: station.Lost})
+	return payload
+}
+
+// Birth message with the configuration summary. The timestamp is set when it is published.
+func birthStatus(now time.Time) station.Status {
+	status := newStatus(station.Birth, true, now)
+
+	summary := configSummary{
+		BatchTimeWindow: configuration.BatchTimeWindow,
+		Codec:           configuration.Codec,
+		Filters:         len(configuration.Filters.Areas) > 0 || configuration.Filters.MinAltitude != 0 || configuration.Filters.MaxAltitude != 0,
+		AllowList:       configuration.AllowList != "",
+		DenyList:        configuration.DenyList != "",
+	}
+	for _, rc := range configuration.Routes {
+		summary.Routes = append(summary.Routes, rc.Name)
+	}
+	status.Config = summary
+
+	return status
+}
+
+// Handler that publishes the birth message on every connection to MQTT. It
+// runs on the goroutine of the MQTT client, so it publishes directly instead
+// of tracking the token in the main loop, and only uses the copies it gets.
+func publishBirth(topic string, birth station.Status) mqtt.OnConnectHandler {
+	return func(client mqtt.Client) {
+		status := birth
+		status.Timestamp = time.Now().Unix()
+
+		payload, err := json.Marshal(status)
+		if err != nil {
+			log.Error("Error creating the birth message: ", err.Error())
+			return
+		}
+
+		if !quota.allow(topic, len(payload), 1, time.Now()) {
+			return
+		}
+		client.Publish(topic, 1, true, payload)
+		log.Info("Station status published to ", topic)
+	}
+}
+
+// Check if the heartbeat must be published
+func heartbeatDue(now time.Time) bool {
+	return statusTopic() != "" && now.Sub(lastHeartbeat) >= time.Duration(configuration.HeartbeatInterval)*time.Second
+}
+
+// Publish the heartbeat with the uptime and the rates since the previous one
+func publishHeartbeat(client transport, now time.Time) {
+	status := newStatus(station.Heartbeat, true, now)
+	status.Uptime = int64(now.Sub(startTime).Seconds())
+
+	if !lastHeartbeat.IsZero() {
+		seconds := now.Sub(lastHeartbeat).Seconds()
+		status.Rates = &station.Rates{
+			Lines:   float64(stats.linesRead-lastHeartbeatStats.linesRead) / seconds,
+			Records: float64(stats.recordsBatched-lastHeartbeatStats.recordsBatched) / seconds,
+			Batches: float64(stats.batchesSent-lastHeartbeatStats.batchesSent) / seconds,
+			Bytes:   float64(stats.bytesSent-lastHeartbeatStats.bytesSent) / seconds,
+		}
+	}
+
+	lastHeartbeat = now
+	lastHeartbeatStats = stats
+
+	// Current window of each route, adjusted by the adaptive mode and the quota
+	status.BatchWindows = make(map[string]int64)
+	for _, r := range routes {
+		status.BatchWindows[r.name] = r.timeWindow * quota.windowFactor()
+	}
+
+	payload, err := json.Marshal(status)
+	if err != nil {
+		log.Error("Error creating the heartbeat: ", err.Error())
+		return
+	}
+	send(client, statusTopic(), 1, true, payload)
+}
+
+// Publish the offline status on a clean shutdown (the last will is not sent then)
+func publishOffline(client transport) {
+	if statusTopic() == "" {
+		return
+	}
+
+	status := newStatus(station.Shutdown, false, time.Now())
+	status.Uptime = int64(time.Since(startTime).Seconds())
+
+	payload, _ := json.Marshal(status)
+	send(client, statusTopic(), 1, true, payload)
+}
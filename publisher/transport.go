@@ -0,0 +1,161 @@
+// ----------------------------------------------------------------------------
+// Output transports
+// MQTT, Kafka, NATS and HTTP POST behind the same interface, selected by Type.
+// The main MQTT broker is an MQTT transport too.
+// Contact: Hugo Cruz - hugo.m.cruz@gmail.com
+// ----------------------------------------------------------------------------
+
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/hugomcruz/dump1090-mqtt/internal/connection"
+	log "github.com/sirupsen/logrus"
+)
+
+// Maximum wait of a publish for the acknowledgement of the destination
+const publishTimeout = 10 * time.Second
+
+// Destination of the messages of the publisher or of an output. Publish is
+// called from one goroutine only, Connected also from the health checks.
+type transport interface {
+	// Start connecting. The transport connects again by itself when the connection is lost.
+	Connect() error
+	// Publish one message. The delivery completes with the acknowledgement
+	// of the destination. Retained is only used by MQTT.
+	Publish(topic string, qos byte, retained bool, payload []byte) delivery
+	Connected() bool
+	Close()
+}
+
+// Acknowledgement of a published message. The MQTT tokens are deliveries.
+type delivery interface {
+	Done() <-chan struct{}
+	WaitTimeout(time.Duration) bool
+	Error() error
+}
+
+// Delivery of a transport that publishes before returning
+type completed struct {
+	err error
+}
+
+var completedChannel = make(chan struct{})
+
+func init() {
+	close(completedChannel)
+}
+
+func (c completed) Done() <-chan struct{}          { return completedChannel }
+func (c completed) WaitTimeout(time.Duration) bool { return true }
+func (c completed) Error() error                   { return c.err }
+
+// Wait for a delivery, at most publishTimeout
+func wait(d delivery) error {
+	if !d.WaitTimeout(publishTimeout) {
+		return errors.New("timeout")
+	}
+	return d.Error()
+}
+
+// Create the transport of an output from its Type
+func newTransport(oc OutputConfig, clientID string) (transport, error) {
+	switch oc.Type {
+	case "", "mqtt":
+		return newMQTTTransport(oc, clientID)
+	case "kafka":
+		return newKafkaTransport(oc, clientID)
+	case "nats":
+		return newNATSTransport(oc, clientID), nil
+	case "http":
+		return newHTTPTransport(oc), nil
+	}
+	return nil, errors.New("unknown output type " + oc.Type)
+}
+
+// MQTT broker with its own paho client. The main broker waits for the
+// first connection and queues the messages while reconnecting, the outputs
+// connect in the background and fail fast while disconnected.
+type mqttTransport struct {
+	name   string
+	url    string
+	client mqtt.Client
+	main   bool
+}
+
+func newMQTTTransport(oc OutputConfig, clientID string) (*mqttTransport, error) {
+	t := &mqttTransport{name: oc.Name, url: oc.URL}
+
+	opts := mqtt.NewClientOptions().AddBroker(oc.URL).SetClientID(clientID)
+	opts.SetUsername(oc.Username)
+	opts.SetPassword(oc.Password)
+	opts.SetKeepAlive(keepaliveInterval)
+	opts.SetPingTimeout(pingTimeout * time.Second)
+	opts.SetAutoReconnect(true)
+	opts.SetConnectRetry(true)
+	opts.SetMaxReconnectInterval(maxRetryBackoff)
+	opts.SetOnConnectHandler(func(c mqtt.Client) {
+		log.Info("Output ", t.name, " connected to ", t.url)
+	})
+	opts.SetConnectionLostHandler(func(c mqtt.Client, err error) {
+		log.Warn("Output ", t.name, " lost the connection: ", err.Error())
+	})
+
+	// WebSocket headers and proxy
+	if err := connection.Configure(opts, oc.Headers, oc.Proxy); err != nil {
+		return nil, err
+	}
+
+	t.client = mqtt.NewClient(opts)
+	return t, nil
+}
+
+func (t *mqttTransport) Connect() error {
+	token := t.client.Connect()
+	if !t.main {
+		// Retried in the background until connected
+		return nil
+	}
+	token.Wait()
+	return token.Error()
+}
+
+func (t *mqttTransport) Publish(topic string, qos byte, retained bool, payload []byte) delivery {
+	if !t.main && !t.client.IsConnectionOpen() {
+		return completed{errors.New("not connected to " + t.url)}
+	}
+	return t.client.Publish(topic, qos, retained, payload)
+}
+
+func (t *mqttTransport) Connected() bool {
+	return t.client.IsConnectionOpen()
+}
+
+func (t *mqttTransport) Close() {
+	t.client.Disconnect(250)
+}
+
+// Topic templates use "/" between levels, Kafka topics and NATS subjects use "."
+func dottedTopic(topic string) string {
+	return strings.Replace(strings.Trim(topic, "/"), "/", ".", -1)
+}
+
+// Characters of the placeholder values kept in a Kafka topic or a NATS
+// subject. A "." would add a level and Kafka refuses ":" and most others.
+var dottedValueRegexp = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// Placeholder value for the transports with dotted topics, e.g. the source
+// 10.0.0.1:30003 gives 10_0_0_1_30003
+func dottedValue(value string) string {
+	return dottedValueRegexp.ReplaceAllString(value, "_")
+}
+
+// Check if the transport uses dotted topics
+func dottedTransport(transportType string) bool {
+	return transportType == "kafka" || transportType == "nats"
+}
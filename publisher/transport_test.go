@@ -0,0 +1,369 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hugomcruz/dump1090-mqtt/internal/codec"
+	"github.com/hugomcruz/dump1090-mqtt/internal/sequence"
+)
+
+// Message received by the fake transport
+type fakeMessage struct {
+	topic    string
+	qos      byte
+	retained bool
+	payload  []byte
+}
+
+// Transport that keeps the messages in memory. With fail set, the
+// deliveries complete with that error and nothing is kept.
+type fakeTransport struct {
+	mutex     sync.Mutex
+	connected bool
+	closed    bool
+	fail      error
+	messages  []fakeMessage
+}
+
+func (t *fakeTransport) Connect() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.connected = true
+	return nil
+}
+
+func (t *fakeTransport) Publish(topic string, qos byte, retained bool, payload []byte) delivery {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.fail != nil {
+		return completed{t.fail}
+	}
+	t.messages = append(t.messages, fakeMessage{topic: topic, qos: qos, retained: retained, payload: payload})
+	return completed{}
+}
+
+func (t *fakeTransport) Connected() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.connected
+}
+
+func (t *fakeTransport) Close() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.connected = false
+	t.closed = true
+}
+
+// Copy of the messages received
+func (t *fakeTransport) published() []fakeMessage {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return append([]fakeMessage(nil), t.messages...)
+}
+
+// Globals of the publisher for a test, with a fake main broker
+func setupPublisher(t *testing.T) *fakeTransport {
+	t.Helper()
+
+	configuration = Configuration{
+		StationID:       "sgn1",
+		Source:          "dump",
+		Codec:           codec.None,
+		BatchTimeWindow: 2,
+	}
+	configuration.MQTTTopic = "adsb/{station}/{type}"
+	configuration.MQTTQos = 1
+	quota = newQuota(QuotaConfig{ResetDay: 1}, time.Now())
+	sealer = nil
+	paused = false
+	stats = publisherStats{}
+	pendingMessages = make([]pendingMessage, 0)
+	batchSequence = make(map[string]uint64)
+
+	fake := &fakeTransport{}
+	fake.Connect()
+	return fake
+}
+
+// Records of a batch payload, without the sequence header
+func splitBatch(t *testing.T, payload []byte) []string {
+	t.Helper()
+
+	_, records, _, err := sequence.Split(payload)
+	if err != nil {
+		t.Fatalf("invalid batch: %v", err)
+	}
+	return strings.Split(strings.TrimSuffix(string(records), "\n"), "\n")
+}
+
+func TestFlushPublishesThroughTransport(t *testing.T) {
+	fake := setupPublisher(t)
+
+	routes := newRoutes(configuration, 100)
+	routeRecord(routes, record{recordType: "3", hexIdent: "ABC123", line: "3,1000,ABC123,35000,10.8,106.6,0"})
+	routeRecord(routes, record{recordType: "1", hexIdent: "ABC123", line: "1,1001,ABC123,VJC123"})
+	routeRecord(routes, record{recordType: "3", hexIdent: "888123", line: "3,1002,888123,12000,10.9,106.7,0"})
+	routes[0].flush(fake, 102)
+
+	messages := fake.published()
+	if len(messages) != 2 {
+		t.Fatalf("got %d messages, want one per topic (2)", len(messages))
+	}
+
+	tests := []struct {
+		topic   string
+		records []string
+	}{
+		{"adsb/sgn1/3", []string{"3,1000,ABC123,35000,10.8,106.6,0", "3,1002,888123,12000,10.9,106.7,0"}},
+		{"adsb/sgn1/1", []string{"1,1001,ABC123,VJC123"}},
+	}
+	for i, tt := range tests {
+		m := messages[i]
+		if m.topic != tt.topic || m.qos != 1 || m.retained {
+			t.Errorf("message %d: topic %q qos %d retained %v, want %q qos 1 not retained", i, m.topic, m.qos, m.retained, tt.topic)
+		}
+		if got := splitBatch(t, m.payload); strings.Join(got, "|") != strings.Join(tt.records, "|") {
+			t.Errorf("message %d: records %q, want %q", i, got, tt.records)
+		}
+	}
+
+	prunePending()
+	if len(pendingMessages) != 0 {
+		t.Errorf("%d messages still pending after the deliveries completed", len(pendingMessages))
+	}
+}
+
+func TestFlushEmptyWindowPublishesNothing(t *testing.T) {
+	fake := setupPublisher(t)
+
+	routes := newRoutes(configuration, 100)
+	routes[0].flush(fake, 102)
+
+	if n := len(fake.published()); n != 0 {
+		t.Errorf("got %d messages for an empty window", n)
+	}
+}
+
+func TestReplaySpool(t *testing.T) {
+	fake := setupPublisher(t)
+	configuration.SpoolDirectory = t.TempDir()
+
+	for i, name := range []string{"batch-1-0.json", "batch-2-0.json"} {
+		data, _ := json.Marshal(pendingMessage{Topic: "adsb/sgn1", Qos: 1, Payload: []byte{byte('a' + i)}})
+		if err := ioutil.WriteFile(filepath.Join(configuration.SpoolDirectory, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Failed publishes keep the files for the next start
+	fake.fail = errors.New("broker down")
+	replaySpool(fake)
+	if files, _ := filepath.Glob(filepath.Join(configuration.SpoolDirectory, "batch-*.json")); len(files) != 2 {
+		t.Fatalf("%d spool files left after a failed publish, want 2", len(files))
+	}
+
+	fake.fail = nil
+	replaySpool(fake)
+
+	messages := fake.published()
+	if len(messages) != 2 || string(messages[0].payload) != "a" || string(messages[1].payload) != "b" {
+		t.Fatalf("spooled messages published %v, want a then b", messages)
+	}
+	if files, _ := filepath.Glob(filepath.Join(configuration.SpoolDirectory, "batch-*.json")); len(files) != 0 {
+		t.Errorf("%d spool files left after publishing them", len(files))
+	}
+}
+
+func TestResendPending(t *testing.T) {
+	fake := setupPublisher(t)
+
+	resendPending(fake, []pendingMessage{
+		{Topic: "adsb/sgn1/status", Qos: 1, Retained: true, Payload: []byte("{}")},
+		{Topic: "adsb/sgn1/3", Qos: 0, Payload: []byte("3,1000")},
+	})
+
+	messages := fake.published()
+	if len(messages) != 2 || !messages[0].retained || messages[1].retained || messages[1].topic != "adsb/sgn1/3" {
+		t.Errorf("messages published again %v", messages)
+	}
+}
+
+func TestSpoolPending(t *testing.T) {
+	setupPublisher(t)
+	configuration.SpoolDirectory = filepath.Join(t.TempDir(), "spool")
+
+	batch := &batchMessage{topic: "adsb/sgn1/3", route: "default", records: 1}
+	pendingMessages = append(pendingMessages,
+		pendingMessage{Topic: "adsb/sgn1/3", Qos: 1, Payload: []byte("x"), token: completed{}, batch: batch},
+		pendingMessage{Topic: "adsb/sgn1/status", Qos: 1, Retained: true, Payload: []byte("{}"), token: completed{}},
+		pendingMessage{Topic: "adsb/sgn1/heartbeat", Qos: 0, Payload: []byte("{}"), token: completed{}},
+	)
+	spoolPending()
+
+	// Only the batch, the status messages are published again on the next start
+	files, _ := filepath.Glob(filepath.Join(configuration.SpoolDirectory, "batch-*.json"))
+	if len(files) != 1 {
+		t.Fatalf("%d spool files, want 1", len(files))
+	}
+	var message pendingMessage
+	data, _ := ioutil.ReadFile(files[0])
+	if err := json.Unmarshal(data, &message); err != nil || message.Topic != "adsb/sgn1/3" {
+		t.Errorf("spooled %q (%v), want the batch", message.Topic, err)
+	}
+	if len(pendingMessages) != 0 {
+		t.Errorf("pending messages not cleared after spooling")
+	}
+	os.RemoveAll(configuration.SpoolDirectory)
+}
+
+func TestSpoolFailedBatches(t *testing.T) {
+	fake := setupPublisher(t)
+	configuration.SpoolDirectory = t.TempDir()
+	fake.fail = errors.New("broker down")
+
+	routes := newRoutes(configuration, 100)
+	routeRecord(routes, record{recordType: "3", hexIdent: "ABC123", line: "3,1000,ABC123"})
+	routes[0].flush(fake, 102)
+	sendPending(fake, pendingMessage{Topic: "adsb/sgn1/status", Qos: 1, Retained: true, Payload: []byte("{}")})
+	prunePending()
+
+	files, _ := filepath.Glob(filepath.Join(configuration.SpoolDirectory, "batch-*.json"))
+	if len(files) != 1 {
+		t.Fatalf("%d spool files after a failed delivery, want the batch only", len(files))
+	}
+
+	fake.fail = nil
+	replaySpool(fake)
+	messages := fake.published()
+	if len(messages) != 1 || messages[0].topic != "adsb/sgn1/3" {
+		t.Errorf("replayed %v, want the failed batch", messages)
+	}
+}
+
+func TestReplaySkipsRetained(t *testing.T) {
+	fake := setupPublisher(t)
+	configuration.SpoolDirectory = t.TempDir()
+
+	data, _ := json.Marshal(pendingMessage{Topic: "adsb/sgn1/status", Qos: 1, Retained: true, Payload: []byte(`{"status":"offline"}`)})
+	ioutil.WriteFile(filepath.Join(configuration.SpoolDirectory, "batch-1-0.json"), data, 0644)
+	replaySpool(fake)
+
+	if messages := fake.published(); len(messages) != 0 {
+		t.Errorf("retained message replayed %v", messages)
+	}
+	if files, _ := filepath.Glob(filepath.Join(configuration.SpoolDirectory, "batch-*.json")); len(files) != 0 {
+		t.Errorf("retained message left in the spool")
+	}
+}
+
+func TestBatchCountedWhenDelivered(t *testing.T) {
+	tests := []struct {
+		name    string
+		fail    error
+		records int64
+		batches int64
+	}{
+		{"delivered", nil, 3, 2},
+		{"failed", errors.New("broker down"), 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := setupPublisher(t)
+			fake.fail = tt.fail
+
+			routes := newRoutes(configuration, 100)
+			routeRecord(routes, record{recordType: "3", hexIdent: "ABC123", line: "3,1000,ABC123"})
+			routeRecord(routes, record{recordType: "3", hexIdent: "888123", line: "3,1001,888123"})
+			routeRecord(routes, record{recordType: "1", hexIdent: "ABC123", line: "1,1002,ABC123,VJC123"})
+			routes[0].flush(fake, 102)
+			prunePending()
+
+			if stats.recordsBatched != tt.records || stats.batchesSent != tt.batches {
+				t.Errorf("counted %d records in %d batches, want %d in %d", stats.recordsBatched, stats.batchesSent, tt.records, tt.batches)
+			}
+		})
+	}
+}
+
+func TestDottedTopic(t *testing.T) {
+	setupPublisher(t)
+
+	tests := []struct {
+		source string
+		topic  string
+	}{
+		{"dump", "adsb.dump.3"},
+		{"10.0.0.1", "adsb.10_0_0_1.3"},
+		{"host:30003", "adsb.host_30003.3"},
+		{"a b*>", "adsb.a_b__.3"},
+	}
+
+	for _, tt := range tests {
+		r := newRoute(RouteConfig{Name: "output-kafka", BatchTimeWindow: 2, MQTTTopic: "adsb/{source}/{type}"}, 100)
+		r.escape = dottedValue
+		r.buffer = append(r.buffer, record{recordType: "3", hexIdent: "ABC123", source: tt.source, line: "3,1000"})
+
+		messages := r.collect(102, codec.None)
+		if got := dottedTopic(messages[0].topic); got != tt.topic {
+			t.Errorf("source %q: topic %q, want %q", tt.source, got, tt.topic)
+		}
+	}
+}
+
+func TestHTTPTransport(t *testing.T) {
+	var request *http.Request
+	var body []byte
+	status := http.StatusNoContent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request = r
+		body, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	transport := newHTTPTransport(OutputConfig{
+		URL:      server.URL + "/batches",
+		Codec:    codec.Gzip,
+		Username: "user",
+		Password: "pass",
+		Headers:  map[string]string{"X-Station": "sgn1"},
+	})
+
+	if err := wait(transport.Publish("adsb/sgn1/3", 1, false, []byte("batch"))); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	username, password, _ := request.BasicAuth()
+	if request.Method != http.MethodPost || request.URL.Path != "/batches" || string(body) != "batch" {
+		t.Errorf("%s %s with %q, want POST /batches with the batch", request.Method, request.URL.Path, body)
+	}
+	if request.Header.Get("X-Topic") != "adsb/sgn1/3" || request.Header.Get("Content-Encoding") != "gzip" || request.Header.Get("X-Station") != "sgn1" {
+		t.Errorf("headers %v", request.Header)
+	}
+	if username != "user" || password != "pass" {
+		t.Errorf("basic authentication %q %q, want user pass", username, password)
+	}
+	if !transport.Connected() {
+		t.Error("not connected after an accepted batch")
+	}
+
+	status = http.StatusServiceUnavailable
+	if err := wait(transport.Publish("adsb/sgn1/3", 1, false, []byte("batch"))); err == nil {
+		t.Error("status 503 accepted")
+	}
+	if transport.Connected() {
+		t.Error("connected after a refused batch")
+	}
+}
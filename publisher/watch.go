@@ -0,0 +1,55 @@
+// ----------------------------------------------------------------------------
+// File watcher
+// Polls the modification time of a file and calls back when it changes
+// Contact: Hugo Cruz - hugo.m.cruz@gmail.com
+// ----------------------------------------------------------------------------
+
+package main
+
+import (
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Watch a file in a goroutine. Polling works for every editor and for
+// files replaced by configuration management tools. Returns the function
+// that stops the watch.
+func watchFile(filename string, interval time.Duration, onChange func()) func() {
+	lastModified := modificationTime(filename)
+	done := make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			modified := modificationTime(filename)
+			if modified.Equal(lastModified) {
+				continue
+			}
+
+			log.Info("File changed: ", filename)
+			lastModified = modified
+			onChange()
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+// Modification time of a file, zero when it does not exist
+func modificationTime(filename string) time.Time {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
@@ -6,49 +6,90 @@
 package main
 
 import (
-	"bytes"
-	"compress/gzip"
 	"crypto/tls"
+	"flag"
 	"fmt"
-	"io/ioutil"
+	"net/http"
 
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	MQTT "github.com/eclipse/paho.mqtt.golang"
-	"github.com/tkanos/gonfig"
+	"github.com/hugomcruz/dump1090-mqtt/internal/codec"
+	"github.com/hugomcruz/dump1090-mqtt/internal/config"
+	"github.com/hugomcruz/dump1090-mqtt/internal/connection"
+	"github.com/hugomcruz/dump1090-mqtt/internal/envelope"
+	"github.com/hugomcruz/dump1090-mqtt/internal/health"
+	"github.com/hugomcruz/dump1090-mqtt/internal/sequence"
+	"github.com/hugomcruz/dump1090-mqtt/internal/station"
+	"github.com/hugomcruz/dump1090-mqtt/internal/topic"
 )
 
+// Topic template and station registry from the configuration
+var topicTemplate topic.Template
+var stations *station.Registry
+
+// Time of the last message, for the health checks
+var lastMessage health.Activity
+
+// Keys of the signed and encrypted batches
+var opener *envelope.Opener
+
+// Sequence numbers of the batches per station, for the loss statistics
+var sequences = sequence.NewTracker()
+
 //Configuration Data
 type Configuration struct {
-	MQTTServerURL string
-	MQTTClientID  string
-	MQTTTopic     string
-	MQTTQos       int
-	MQTTUsername  string
-	MQTTPassword  string
+	config.MQTT
+	HTTPListen    string
+	MaxMessageAge int `validate:"min=0"`
+	Security      envelope.OpenConfig
+}
+
+// Callback for the station status messages
+func onStatusReceived(client MQTT.Client, message MQTT.Message) {
+	stations.Update(message.Topic(), message.Payload(), time.Now())
 }
 
 func onMessageReceived(client MQTT.Client, message MQTT.Message) {
 
-	byteData := message.Payload()
+	lastMessage.Mark(time.Now())
+
+	// Verify or decrypt the batch when the publisher sealed it
+	byteData, err := opener.Open(message.Payload(), message.Topic())
+	if err != nil {
+		return
+	}
+
+	//Decompress the payload message (gzip, zlib or plain)
+	result, _ := codec.Decode(byteData)
 
-	//Decompress the payload message
-	r, _ := gzip.NewReader(bytes.NewReader(byteData))
-	result, _ := ioutil.ReadAll(r)
+	// Gaps, duplicates and reordered batches. The header line is printed with the records.
+	if header, _, ok, _ := sequence.Split(result); ok {
+		sequences.Track(header, message.Topic())
+	}
 
 	data := string(result)
 
+	// Station and source from the topic levels, when the template has them
+	if values, ok := topicTemplate.Match(message.Topic()); ok && len(values) > 0 {
+		fmt.Printf("# station=%s source=%s\n", values[topic.Station], values[topic.Source])
+	}
+
 	fmt.Print(data)
 
 }
 
 func main() {
 
-	// Read the configuration file using gonfig package
+	configPath := config.PathFlag()
+	flag.Parse()
+
+	// Read the configuration file, the environment overrides it
 	configuration := Configuration{}
-	err := gonfig.GetConf("config.json", &configuration)
+	err := config.Load(*configPath, "DUMPER", &configuration)
 
 	if err != nil {
 		fmt.Println("Error reading configuration file: " + err.Error())
@@ -57,6 +98,18 @@ func main() {
 
 	}
 
+	opener, err = envelope.NewOpener(configuration.Security)
+	if err != nil {
+		fmt.Println("Error in the security configuration: " + err.Error())
+		fmt.Println("Exiting now.")
+		os.Exit(1)
+	}
+
+	// Log messages (station status) go to stderr, the records to stdout
+	config.SetupLogging(configuration.LogLevel)
+
+	topicTemplate = topic.Parse(configuration.MQTTTopic)
+
 	// Create channel for subscription
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
@@ -72,10 +125,27 @@ func main() {
 	tlsConfig := &tls.Config{InsecureSkipVerify: true, ClientAuth: tls.NoClientCert}
 	connOpts.SetTLSConfig(tlsConfig)
 
+	// WebSocket headers and proxy
+	if err := connection.Configure(connOpts, configuration.MQTTHeaders, configuration.MQTTProxy); err != nil {
+		fmt.Println("Error in the MQTT settings: " + err.Error())
+		os.Exit(1)
+	}
+
+	// Liveness of the stations from their status topic
+	if configuration.StatusTopic != "" {
+		stations = station.NewRegistry(configuration.StatusTopic)
+		stations.Monitor(30 * time.Second)
+	}
+
 	connOpts.OnConnect = func(c MQTT.Client) {
-		if token := c.Subscribe(configuration.MQTTTopic, byte(configuration.MQTTQos), onMessageReceived); token.Wait() && token.Error() != nil {
+		if token := c.Subscribe(topicTemplate.Filter(), byte(configuration.MQTTQos), onMessageReceived); token.Wait() && token.Error() != nil {
 			panic(token.Error())
 		}
+		if stations != nil {
+			if token := c.Subscribe(stations.Filter(), 1, onStatusReceived); token.Wait() && token.Error() != nil {
+				panic(token.Error())
+			}
+		}
 	}
 
 	client := MQTT.NewClient(connOpts)
@@ -83,5 +153,28 @@ func main() {
 		panic(token.Error())
 	}
 
+	// Health checks: readiness fails without MQTT or, with MaxMessageAge, without messages
+	if configuration.HTTPListen != "" {
+		live := &health.Checks{}
+		live.Add("messages", health.MaxAge(&lastMessage, "message", 0))
+
+		ready := &health.Checks{}
+		ready.Add("mqtt", health.Connected(configuration.MQTTServerURL, client.IsConnectionOpen))
+		ready.Add("messages", health.MaxAge(&lastMessage, "message", time.Duration(configuration.MaxMessageAge)*time.Second))
+		ready.Add("integrity", opener.Check)
+		ready.Add("sequence", sequences.Check)
+		if stations != nil {
+			ready.Add("stations", stations.Summary)
+		}
+
+		mux := http.NewServeMux()
+		health.Register(mux, live, ready)
+		mux.Handle("/sequence", sequences)
+		if stations != nil {
+			mux.Handle("/stations", stations)
+		}
+		health.Listen(configuration.HTTPListen, mux)
+	}
+
 	<-c
 }
@@ -6,10 +6,10 @@
 package main
 
 import (
-	"bytes"
-	"compress/gzip"
 	"crypto/tls"
+	"flag"
 	"io/ioutil"
+	"net/http"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -20,42 +20,97 @@ import (
 	"syscall"
 
 	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/hugomcruz/dump1090-mqtt/internal/codec"
+	"github.com/hugomcruz/dump1090-mqtt/internal/config"
+	"github.com/hugomcruz/dump1090-mqtt/internal/connection"
+	"github.com/hugomcruz/dump1090-mqtt/internal/envelope"
+	"github.com/hugomcruz/dump1090-mqtt/internal/health"
+	"github.com/hugomcruz/dump1090-mqtt/internal/sequence"
+	"github.com/hugomcruz/dump1090-mqtt/internal/station"
+	"github.com/hugomcruz/dump1090-mqtt/internal/topic"
 	log "github.com/sirupsen/logrus"
-	"github.com/tkanos/gonfig"
 )
 
 // Channel variables
 var done = make(chan bool)
-var tasks = make(chan string)
+var tasks = make(chan storeTask)
 
 //Configuration global varaible
 var configuration Configuration
+var topicTemplate topic.Template
+var stations *station.Registry
+
+// Last message and result of the last write, for the health checks
+var lastMessage health.Activity
+var fileSink health.Sink
+
+// Keys of the signed and encrypted batches
+var opener *envelope.Opener
+
+// Sequence numbers of the batches per station, for the loss statistics
+var sequences = sequence.NewTracker()
+
+// Batch received from MQTT with the station taken from the topic, and the
+// batches missing before it
+type storeTask struct {
+	station string
+	data    string
+	gap     *sequence.Gap
+}
+
+// Storage file of a station for the current hourly window
+type storeFile struct {
+	path string
+	file *os.File
+}
 
 type Configuration struct {
-	MQTTServerURL string
-	MQTTClientID  string
-	MQTTTopic     string
-	MQTTQos       int
-	MQTTUsername  string
-	MQTTPassword  string
-	FilesPath     string
-	LogLevel      string
+	config.MQTT
+	FilesPath     string `validate:"required"`
+	HTTPListen    string
+	MaxMessageAge int `validate:"min=0"`
+	Security      envelope.OpenConfig
+}
+
+// Callback for the station status messages
+func onStatusReceived(client MQTT.Client, message MQTT.Message) {
+	stations.Update(message.Topic(), message.Payload(), time.Now())
 }
 
 func onMessageReceived(client MQTT.Client, message MQTT.Message) {
 
-	byteData := message.Payload()
+	lastMessage.Mark(time.Now())
 
-	r, _ := gzip.NewReader(bytes.NewReader(byteData))
-	result, _ := ioutil.ReadAll(r)
+	// Verify or decrypt the batch when the publisher sealed it
+	byteData, err := opener.Open(message.Payload(), message.Topic())
+	if err != nil {
+		return
+	}
+
+	//Decompress the payload message (gzip, zlib or plain)
+	result, _ := codec.Decode(byteData)
 
-	data := string(result)
+	// Gaps, duplicates and reordered batches, the records follow the header line
+	header, records, ok, err := sequence.Split(result)
+	var gap *sequence.Gap
+	if err != nil {
+		log.Warn("Batch from ", message.Topic(), ": ", err.Error())
+	} else if ok {
+		gap = sequences.Track(header, message.Topic()).Gap
+	}
 
-	tasks <- data
+	data := string(records)
+
+	station := ""
+	if values, ok := topicTemplate.Match(message.Topic()); ok {
+		station = values[topic.Station]
+	}
+
+	tasks <- storeTask{station: station, data: data, gap: gap}
 
 }
 
-func genFileName(startTime time.Time) string {
+func genFileName(station string, startTime time.Time) string {
 
 	hour, _, _ := startTime.Clock()
 	year := startTime.Year()
@@ -80,7 +135,12 @@ func genFileName(startTime time.Time) string {
 		hourStr = "0" + hourStr
 	}
 
-	filename := "fr-" + strconv.Itoa(year) + monthStr + dayStr + "_" + hourStr + "00.csv"
+	prefix := "fr-"
+	if station != "" {
+		prefix = prefix + station + "-"
+	}
+
+	filename := prefix + strconv.Itoa(year) + monthStr + dayStr + "_" + hourStr + "00.csv"
 	return filename
 
 }
@@ -103,9 +163,10 @@ func nextRollOver() (int64, time.Time) {
 	return windowCloseTS, windowInit
 }
 
-func consume() {
-	nextRoll, startTime := nextRollOver()
-	filename := genFileName(startTime)
+// Open the temporary storage file of a station
+func openStoreFile(station string, startTime time.Time) *storeFile {
+	filename := genFileName(station, startTime)
+	log.Debug("New Filename       : ", filename)
 
 	fullpath := filepath.Join(configuration.FilesPath, filename)
 	file, err := os.OpenFile(fullpath+".tmp", os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
@@ -113,9 +174,53 @@ func consume() {
 		panic(err)
 	}
 
+	return &storeFile{path: fullpath, file: file}
+}
+
+// Close the storage file and rename it to the final name
+func (s *storeFile) close() {
+	s.file.Close()
+	e := os.Rename(s.path+".tmp", s.path)
+	if e != nil {
+		log.Fatal(e)
+	}
+}
+
+// Append a gap to the gap log of the hourly window, next to the storage file
+// of the station: fr-<station>-<date>_<hour>00-gaps.csv
+func writeGap(station string, startTime time.Time, gap *sequence.Gap) error {
+	filename := strings.TrimSuffix(genFileName(station, startTime), ".csv") + "-gaps.csv"
+
+	file, err := os.OpenFile(filepath.Join(configuration.FilesPath, filename), os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// Detection time, station, stream, topic, run, first and last missing batch, missing batches
+	line := strconv.FormatInt(time.Now().UnixNano()/1000000, 10) + "," + gap.Station + "," + gap.Stream + "," + gap.Topic + "," +
+		strconv.FormatInt(gap.Run, 10) + "," + strconv.FormatUint(gap.From, 10) + "," + strconv.FormatUint(gap.To, 10) + "," +
+		strconv.FormatUint(gap.Size(), 10) + "\n"
+	_, err = file.WriteString(line)
+	return err
+}
+
+// Check that files can be created in FilesPath
+func checkFilesPath() (string, error) {
+	file, err := ioutil.TempFile(configuration.FilesPath, ".healthz-")
+	if err != nil {
+		return configuration.FilesPath + " not writable", err
+	}
+	file.Close()
+	os.Remove(file.Name())
+
+	return configuration.FilesPath + " writable", nil
+}
+
+// Log the roll over times
+func logRollOver(nextRoll int64, startTime time.Time) {
 	loc, _ := time.LoadLocation("UTC")
 
-	//Debug
 	tm := time.Unix(nextRoll/1000, 0).In(loc)
 	timeNow := time.Now().In(loc)
 	timeNowMillis := timeNow.UnixNano() / 1000000
@@ -124,13 +229,30 @@ func consume() {
 	log.Debug("Start Time         : ", startTime)
 	log.Debug("Next roll time     : ", tm)
 	log.Debug("Next Roll timestamp: ", nextRoll)
-	log.Debug("New Filename       : ", filename)
+}
+
+func consume() {
+	nextRoll, startTime := nextRollOver()
+
+	// One file per station. Batches without station go to the plain file name.
+	files := make(map[string]*storeFile)
+	files[""] = openStoreFile("", startTime)
+
+	//Debug
+	logRollOver(nextRoll, startTime)
 
 	for {
 		msg := <-tasks
 
+		if msg.gap != nil {
+			if err := writeGap(msg.station, startTime, msg.gap); err != nil {
+				log.Error("Error writing the gap log: ", err.Error())
+			}
+		}
+
 		//Split into Individual messages
-		dataArray := strings.Split(msg, "\n")
+		dataArray := strings.Split(msg.data, "\n")
+		var writeError error
 
 		for _, radarLine := range dataArray {
 			lineSplit := strings.Split(radarLine, ",")
@@ -150,81 +272,76 @@ func consume() {
 			//fmt.Printf("CurrentTimestamp: %d", timestamp)
 
 			if timestamp >= nextRoll {
-				log.Info("Rolling the storage file now.")
-				file.Close()
-				e := os.Rename(fullpath+".tmp", fullpath)
-				if e != nil {
-					log.Fatal(e)
+				log.Info("Rolling the storage files now.")
+				for station, file := range files {
+					file.close()
+					delete(files, station)
 				}
 
 				nextRoll, startTime = nextRollOver()
-				filename = genFileName(startTime)
 
 				//Debug
-				tm := time.Unix(nextRoll/1000, 0).In(loc)
-				timeNow := time.Now().In(loc)
-				timeNowMillis := timeNow.UnixNano() / 1000000
-				log.Debug("Current time       : ", timeNow)
-				log.Debug("Current timestamp  : ", timeNowMillis)
-				log.Debug("Start Time         : ", startTime)
-				log.Debug("Next roll time     : ", tm)
-				log.Debug("Next Roll timestamp: ", nextRoll)
-				log.Debug("New Filename       : ", filename)
-
-				fullpath := filepath.Join(configuration.FilesPath, filename)
-				file, err = os.OpenFile(fullpath+".tmp", os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
-				if err != nil {
-					panic(err)
-				}
+				logRollOver(nextRoll, startTime)
+			}
+
+			file, ok := files[msg.station]
+			if !ok {
+				file = openStoreFile(msg.station, startTime)
+				files[msg.station] = file
 			}
 
 			//Write to the file
-			file.WriteString(radarLine + "\n")
+			if _, err := file.file.WriteString(radarLine + "\n"); err != nil {
+				writeError = err
+			}
+
+		}
 
+		if writeError != nil {
+			log.Error("Error writing to the storage file: ", writeError.Error())
 		}
+		fileSink.Done(time.Now(), writeError)
 
 	}
 }
 
 func main() {
 
-	// Setup the logger
-	log.SetFormatter(&log.TextFormatter{
-		DisableColors: false,
-		FullTimestamp: true,
-	})
+	// Setup the logger. The level is set once the configuration is read.
+	config.SetupLogging("")
+
+	configPath := config.PathFlag()
+	flag.Parse()
 
 	log.Info(">>>>>>>>>> STARTING the Dump1090 Store Subscriber <<<<<<<<<<<<<")
 
-	// Read the configuration
+	// Read the configuration, the environment overrides it
 	configuration = Configuration{}
-	err := gonfig.GetConf("config.json", &configuration)
+	err := config.Load(*configPath, "STORE", &configuration)
 
 	if err != nil {
 		log.Error("Error reading configuration: ", err.Error())
 		os.Exit(1)
 	}
 
-	// Setup the Log Level
-	if configuration.LogLevel == "DEBUG" {
-		log.SetLevel(log.DebugLevel)
-	} else if configuration.LogLevel == "INFO" {
-		log.SetLevel(log.InfoLevel)
-	} else if configuration.LogLevel == "ERROR" {
-		log.SetLevel(log.ErrorLevel)
-	} else if configuration.LogLevel == "WARN" {
-		log.SetLevel(log.WarnLevel)
-	} else {
-		log.SetLevel(log.InfoLevel) // Make info default in case of missing config
+	opener, err = envelope.NewOpener(configuration.Security)
+	if err != nil {
+		log.Error("Error in the security configuration: " + err.Error())
+		log.Error("Exiting now.")
+		os.Exit(1)
 	}
 
+	config.SetLogLevel(configuration.LogLevel)
+
 	// Channel for MQTT subscription
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 
 	// Read from configuration variables - OPTIMIZE IN THE FUTURE
+	topicTemplate = topic.Parse(configuration.MQTTTopic)
+
 	server := configuration.MQTTServerURL
-	topic := configuration.MQTTTopic
+	topicFilter := topicTemplate.Filter()
 	qos := configuration.MQTTQos
 	clientid := configuration.MQTTClientID
 	username := configuration.MQTTUsername
@@ -240,10 +357,27 @@ func main() {
 	tlsConfig := &tls.Config{InsecureSkipVerify: true, ClientAuth: tls.NoClientCert}
 	connOpts.SetTLSConfig(tlsConfig)
 
+	// WebSocket headers and proxy
+	if err := connection.Configure(connOpts, configuration.MQTTHeaders, configuration.MQTTProxy); err != nil {
+		log.Error("Error in the MQTT settings: ", err.Error())
+		os.Exit(1)
+	}
+
+	// Liveness of the stations from their status topic
+	if configuration.StatusTopic != "" {
+		stations = station.NewRegistry(configuration.StatusTopic)
+		stations.Monitor(30 * time.Second)
+	}
+
 	connOpts.OnConnect = func(c MQTT.Client) {
-		if token := c.Subscribe(topic, byte(qos), onMessageReceived); token.Wait() && token.Error() != nil {
+		if token := c.Subscribe(topicFilter, byte(qos), onMessageReceived); token.Wait() && token.Error() != nil {
 			panic(token.Error())
 		}
+		if stations != nil {
+			if token := c.Subscribe(stations.Filter(), 1, onStatusReceived); token.Wait() && token.Error() != nil {
+				panic(token.Error())
+			}
+		}
 	}
 
 	client := MQTT.NewClient(connOpts)
@@ -254,6 +388,32 @@ func main() {
 		log.Info("Connected to MQTT Server:", server)
 	}
 
+	// Health checks: readiness fails without MQTT, when the files cannot be
+	// written or, with MaxMessageAge, without messages
+	if configuration.HTTPListen != "" {
+		live := &health.Checks{}
+		live.Add("messages", health.MaxAge(&lastMessage, "message", 0))
+
+		ready := &health.Checks{}
+		ready.Add("mqtt", health.Connected(server, client.IsConnectionOpen))
+		ready.Add("messages", health.MaxAge(&lastMessage, "message", time.Duration(configuration.MaxMessageAge)*time.Second))
+		ready.Add("integrity", opener.Check)
+		ready.Add("sequence", sequences.Check)
+		if stations != nil {
+			ready.Add("stations", stations.Summary)
+		}
+		ready.Add("files", checkFilesPath)
+		ready.Add("writes", fileSink.Check)
+
+		mux := http.NewServeMux()
+		health.Register(mux, live, ready)
+		mux.Handle("/sequence", sequences)
+		if stations != nil {
+			mux.Handle("/stations", stations)
+		}
+		health.Listen(configuration.HTTPListen, mux)
+	}
+
 	// Start the consume goroutine
 	go consume()
 
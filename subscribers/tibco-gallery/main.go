@@ -8,11 +8,14 @@ package main
 
 import (
 	"bytes"
-	"compress/gzip"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"flag"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"strconv"
@@ -21,24 +24,28 @@ import (
 	"time"
 
 	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/hugomcruz/dump1090-mqtt/internal/codec"
+	"github.com/hugomcruz/dump1090-mqtt/internal/config"
+	"github.com/hugomcruz/dump1090-mqtt/internal/connection"
+	"github.com/hugomcruz/dump1090-mqtt/internal/envelope"
+	"github.com/hugomcruz/dump1090-mqtt/internal/health"
+	"github.com/hugomcruz/dump1090-mqtt/internal/sequence"
+	"github.com/hugomcruz/dump1090-mqtt/internal/station"
+	"github.com/hugomcruz/dump1090-mqtt/internal/topic"
 	log "github.com/sirupsen/logrus"
-	"github.com/tkanos/gonfig"
 )
 
 //Configuration Data
 type Configuration struct {
-	MQTTServerURL string
-	MQTTClientID  string
-	MQTTTopic     string
-	MQTTQos       int
-	MQTTUsername  string
-	MQTTPassword  string
+	config.MQTT
 	Region        string
 	Source        string
-	TIBURL        string
+	TIBURL        string `validate:"required,url"`
 	TIBUser       string
-	TIBPass       string
-	LogLevel      string
+	TIBPass       string `secret:"true"`
+	HTTPListen    string
+	MaxMessageAge int `validate:"min=0"`
+	Security      envelope.OpenConfig
 }
 
 // Struct to create JSON request to TIBCO Gallery
@@ -60,16 +67,55 @@ type streamingMessage struct {
 
 // Global variables
 var configuration Configuration
+var topicTemplate topic.Template
+var stations *station.Registry
+
+// Last message and result of the last request to TIBCO, for the health checks
+var lastMessage health.Activity
+var tibcoSink health.Sink
+
+// Keys of the signed and encrypted batches
+var opener *envelope.Opener
+
+// Sequence numbers of the batches per station, for the loss statistics
+var sequences = sequence.NewTracker()
+
+// Callback for the station status messages
+func onStatusReceived(client MQTT.Client, message MQTT.Message) {
+	stations.Update(message.Topic(), message.Payload(), time.Now())
+}
 
 // Callback function for each message received
 func onMessageReceived(client MQTT.Client, message MQTT.Message) {
 
-	byteData := message.Payload()
+	lastMessage.Mark(time.Now())
 
-	r, _ := gzip.NewReader(bytes.NewReader(byteData))
-	result, _ := ioutil.ReadAll(r)
+	// Verify or decrypt the batch when the publisher sealed it
+	byteData, err := opener.Open(message.Payload(), message.Topic())
+	if err != nil {
+		return
+	}
 
-	data := string(result)
+	//Decompress the payload message (gzip, zlib or plain)
+	result, _ := codec.Decode(byteData)
+
+	// Gaps, duplicates and reordered batches, the records follow the header line
+	header, records, ok, err := sequence.Split(result)
+	if err != nil {
+		log.Warn("Batch from ", message.Topic(), ": ", err.Error())
+	} else if ok {
+		sequences.Track(header, message.Topic())
+	}
+
+	data := string(records)
+
+	// The configured Source identifies the data, without it the station in the topic
+	source := configuration.Source
+	if source == "" {
+		if values, ok := topicTemplate.Match(message.Topic()); ok {
+			source = values[topic.Station]
+		}
+	}
 
 	dataArray := strings.Split(data, "\n")
 
@@ -80,7 +126,7 @@ func onMessageReceived(client MQTT.Client, message MQTT.Message) {
 
 		if lineSplit[0] == "1" {
 			timestamp, _ := strconv.ParseInt(lineSplit[1], 10, 64)
-			singleMessage := createStreamingMessage(lineSplit[2], lineSplit[3], 0, 0.0, 0.0, 0.0, 0, timestamp)
+			singleMessage := createStreamingMessage(lineSplit[2], lineSplit[3], 0, 0.0, 0.0, 0.0, 0, timestamp, source)
 			streamingMessageArray = append(streamingMessageArray, singleMessage)
 
 		} else if lineSplit[0] == "2" {
@@ -88,21 +134,21 @@ func onMessageReceived(client MQTT.Client, message MQTT.Message) {
 			altitude, _ := strconv.ParseInt(lineSplit[3], 10, 64)
 			latitude, _ := strconv.ParseFloat(lineSplit[4], 64)
 			longitude, _ := strconv.ParseFloat(lineSplit[5], 64)
-			singleMessage := createStreamingMessage(lineSplit[2], "", altitude, latitude, longitude, 0.0, 0, timestamp)
+			singleMessage := createStreamingMessage(lineSplit[2], "", altitude, latitude, longitude, 0.0, 0, timestamp, source)
 			streamingMessageArray = append(streamingMessageArray, singleMessage)
 		} else if lineSplit[0] == "3" {
 			timestamp, _ := strconv.ParseInt(lineSplit[1], 10, 64)
 			altitude, _ := strconv.ParseInt(lineSplit[3], 10, 64)
 			latitude, _ := strconv.ParseFloat(lineSplit[4], 64)
 			longitude, _ := strconv.ParseFloat(lineSplit[5], 64)
-			singleMessage := createStreamingMessage(lineSplit[2], "", altitude, latitude, longitude, 0.0, 0, timestamp)
+			singleMessage := createStreamingMessage(lineSplit[2], "", altitude, latitude, longitude, 0.0, 0, timestamp, source)
 			streamingMessageArray = append(streamingMessageArray, singleMessage)
 		} else if lineSplit[0] == "4" {
 			timestamp, _ := strconv.ParseInt(lineSplit[1], 10, 64)
 			speedF, _ := strconv.ParseFloat(lineSplit[3], 64)
 			speed := int64(speedF)
 			track, _ := strconv.ParseFloat(lineSplit[4], 64)
-			singleMessage := createStreamingMessage(lineSplit[2], "", 0, 0.0, 0.0, track, speed, timestamp)
+			singleMessage := createStreamingMessage(lineSplit[2], "", 0, 0.0, 0.0, track, speed, timestamp, source)
 			streamingMessageArray = append(streamingMessageArray, singleMessage)
 
 		} else if lineSplit[0] == "5" {
@@ -128,29 +174,16 @@ func onMessageReceived(client MQTT.Client, message MQTT.Message) {
 // Main function
 func main() {
 
-	// Setup the logger
-	log.SetFormatter(&log.TextFormatter{
-		DisableColors: false,
-		FullTimestamp: true,
-	})
-	//log.SetReportCaller(true)
-
-	if configuration.LogLevel == "DEBUG" {
-		log.SetLevel(log.DebugLevel)
-	} else if configuration.LogLevel == "INFO" {
-		log.SetLevel(log.InfoLevel)
-	} else if configuration.LogLevel == "ERROR" {
-		log.SetLevel(log.ErrorLevel)
-	} else if configuration.LogLevel == "WARN" {
-		log.SetLevel(log.WarnLevel)
-	} else {
-		log.SetLevel(log.InfoLevel) // Make info default in case of missing config
-	}
+	// Setup the logger. The level is set once the configuration is read.
+	config.SetupLogging("")
+
+	configPath := config.PathFlag()
+	flag.Parse()
 
 	log.Info("Starting Dump1090 Subscriber to TIBCO Gallery")
-	// Read the configuration file using gonfig package
+	// Read the configuration file, the environment overrides it
 	configuration = Configuration{}
-	err := gonfig.GetConf("config.json", &configuration)
+	err := config.Load(*configPath, "TIBCO", &configuration)
 
 	if err != nil {
 		log.Error("Error reading configuration file: " + err.Error())
@@ -158,11 +191,22 @@ func main() {
 		os.Exit(1)
 	}
 
+	opener, err = envelope.NewOpener(configuration.Security)
+	if err != nil {
+		log.Error("Error in the security configuration: " + err.Error())
+		log.Error("Exiting now.")
+		os.Exit(1)
+	}
+
+	config.SetLogLevel(configuration.LogLevel)
+
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 
+	topicTemplate = topic.Parse(configuration.MQTTTopic)
+
 	server := configuration.MQTTServerURL
-	topic := configuration.MQTTTopic
+	topicFilter := topicTemplate.Filter()
 	qos := configuration.MQTTQos
 	clientid := configuration.MQTTClientID
 	username := configuration.MQTTUsername
@@ -178,10 +222,27 @@ func main() {
 	tlsConfig := &tls.Config{InsecureSkipVerify: true, ClientAuth: tls.NoClientCert}
 	connOpts.SetTLSConfig(tlsConfig)
 
+	// WebSocket headers and proxy
+	if err := connection.Configure(connOpts, configuration.MQTTHeaders, configuration.MQTTProxy); err != nil {
+		log.Error("Error in the MQTT settings: ", err.Error())
+		os.Exit(1)
+	}
+
+	// Liveness of the stations from their status topic
+	if configuration.StatusTopic != "" {
+		stations = station.NewRegistry(configuration.StatusTopic)
+		stations.Monitor(30 * time.Second)
+	}
+
 	connOpts.OnConnect = func(c MQTT.Client) {
-		if token := c.Subscribe(topic, byte(qos), onMessageReceived); token.Wait() && token.Error() != nil {
+		if token := c.Subscribe(topicFilter, byte(qos), onMessageReceived); token.Wait() && token.Error() != nil {
 			panic(token.Error())
 		}
+		if stations != nil {
+			if token := c.Subscribe(stations.Filter(), 1, onStatusReceived); token.Wait() && token.Error() != nil {
+				panic(token.Error())
+			}
+		}
 	}
 
 	client := MQTT.NewClient(connOpts)
@@ -192,12 +253,62 @@ func main() {
 		log.Info("Connected to MQTT Server: ", server)
 	}
 
+	// Health checks: readiness fails without MQTT, when TIBCO is not reachable
+	// or rejects the data and, with MaxMessageAge, without messages
+	if configuration.HTTPListen != "" {
+		live := &health.Checks{}
+		live.Add("messages", health.MaxAge(&lastMessage, "message", 0))
+
+		ready := &health.Checks{}
+		ready.Add("mqtt", health.Connected(server, client.IsConnectionOpen))
+		ready.Add("messages", health.MaxAge(&lastMessage, "message", time.Duration(configuration.MaxMessageAge)*time.Second))
+		ready.Add("integrity", opener.Check)
+		ready.Add("sequence", sequences.Check)
+		if stations != nil {
+			ready.Add("stations", stations.Summary)
+		}
+		ready.Add("tibco", checkTIBCO)
+		ready.Add("requests", tibcoSink.Check)
+
+		mux := http.NewServeMux()
+		health.Register(mux, live, ready)
+		mux.Handle("/sequence", sequences)
+		if stations != nil {
+			mux.Handle("/stations", stations)
+		}
+		health.Listen(configuration.HTTPListen, mux)
+	}
+
 	<-c
 }
 
-func createStreamingMessage(icao string, callsign string, altitude int64, latitude float64, longitude float64, heading float64, speed int64, timestamp int64) streamingMessage {
+// Check that the TIBCO server accepts connections
+func checkTIBCO() (string, error) {
+	u, err := url.Parse(configuration.TIBURL)
+	if err != nil {
+		return "invalid URL", err
+	}
+
+	address := u.Host
+	if u.Port() == "" {
+		if u.Scheme == "https" {
+			address = address + ":443"
+		} else {
+			address = address + ":80"
+		}
+	}
+
+	conn, err := net.DialTimeout("tcp", address, 3*time.Second)
+	if err != nil {
+		return address + " unreachable", err
+	}
+	conn.Close()
+
+	return address + " reachable", nil
+}
+
+func createStreamingMessage(icao string, callsign string, altitude int64, latitude float64, longitude float64, heading float64, speed int64, timestamp int64, source string) streamingMessage {
 	var region = configuration.Region
-	var source = configuration.Source
 
 	var streamingMessage = streamingMessage{
 		ICAO:             icao,
@@ -217,25 +328,6 @@ func createStreamingMessage(icao string, callsign string, altitude int64, latitu
 
 func sendRestData(streamingMessageArray []streamingMessage) string {
 
-	// Setup the logger
-	log.SetFormatter(&log.TextFormatter{
-		DisableColors: false,
-		FullTimestamp: true,
-	})
-	//log.SetReportCaller(true)
-
-	if configuration.LogLevel == "DEBUG" {
-		log.SetLevel(log.DebugLevel)
-	} else if configuration.LogLevel == "INFO" {
-		log.SetLevel(log.InfoLevel)
-	} else if configuration.LogLevel == "ERROR" {
-		log.SetLevel(log.ErrorLevel)
-	} else if configuration.LogLevel == "WARN" {
-		log.SetLevel(log.WarnLevel)
-	} else {
-		log.SetLevel(log.InfoLevel) // Make info default in case of missing config
-	}
-
 	var url = configuration.TIBURL
 	var user = configuration.TIBUser
 	var pass = configuration.TIBPass
@@ -259,9 +351,16 @@ func sendRestData(streamingMessageArray []streamingMessage) string {
 	resp, err := client.Do(req)
 	if err != nil {
 		log.Error("Error invoking TIBCO server: ", err.Error())
+		tibcoSink.Done(time.Now(), err)
 		return ""
 	}
 	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		tibcoSink.Done(time.Now(), errors.New("TIBCO server response "+resp.Status))
+	} else {
+		tibcoSink.Done(time.Now(), nil)
+	}
 	bodyBytes, err := ioutil.ReadAll(resp.Body)
 
 	log.Debug("TIBCO server response: ", resp.StatusCode, ":", string(bodyBytes))
@@ -0,0 +1,118 @@
+// ----------------------------------------------------------------------------
+// Dump1090 traffic generator
+// Simulates aircraft around a point and serves their SBS lines like the port
+// 30003 of dump1090, for load tests and repeatable end-to-end tests
+// Contact: Hugo Cruz - hugo.m.cruz@gmail.com
+// ----------------------------------------------------------------------------
+
+package main
+
+import (
+	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/hugomcruz/dump1090-mqtt/internal/config"
+	"github.com/hugomcruz/dump1090-mqtt/internal/sbs"
+	log "github.com/sirupsen/logrus"
+)
+
+// Interval of the simulation steps
+const stepInterval = 100 * time.Millisecond
+
+//Configuration Data
+type Configuration struct {
+	Listen          string  `default:":30003"`
+	Aircraft        int     `default:"20" validate:"min=1"`
+	CenterLatitude  float64 `default:"10.8188" validate:"min=-80,max=80"`
+	CenterLongitude float64 `default:"106.652" validate:"min=-180,max=180"`
+	Radius          float64 `default:"150" validate:"min=1"`
+	GroundRatio     float64 `default:"0.1" validate:"min=0,max=1"`
+	RateFactor      float64 `default:"1" validate:"min=0"`
+	MalformedRatio  float64 `validate:"min=0,max=1"`
+	BurstInterval   int     `validate:"min=0"`
+	BurstDuration   int     `default:"5" validate:"min=1"`
+	BurstFactor     float64 `default:"10" validate:"min=1"`
+	Seed            int64
+	QueueSize       int    `default:"10000" validate:"min=1"`
+	LogLevel        string `default:"INFO" validate:"oneof=DEBUG INFO WARN ERROR"`
+}
+
+func main() {
+
+	// Setup the logger. The level is set once the configuration is read.
+	config.SetupLogging("")
+
+	configPath := config.PathFlag()
+	flag.Parse()
+
+	log.Info(">>>>>>>>>> STARTING the Dump1090 Traffic Generator <<<<<<<<<<<<<")
+
+	// Read the configuration, the environment overrides it
+	configuration := Configuration{}
+	err := config.Load(*configPath, "GENERATOR", &configuration)
+	if err != nil {
+		log.Error("Error reading configuration: ", err.Error())
+		os.Exit(1)
+	}
+	config.SetLogLevel(configuration.LogLevel)
+
+	// The same seed flies the same aircraft
+	seed := configuration.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	log.Info("Simulating ", configuration.Aircraft, " aircraft within ", configuration.Radius, " km of ",
+		configuration.CenterLatitude, ",", configuration.CenterLongitude, " (seed ", seed, ")")
+
+	// Slow clients lose lines, like with dump1090
+	server, err := sbs.Listen(configuration.Listen, configuration.QueueSize, false)
+	if err != nil {
+		log.Error("Error listening on ", configuration.Listen, ": ", err.Error())
+		os.Exit(1)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	sim := newTraffic(configuration, seed)
+	ticker := time.NewTicker(stepInterval)
+	report := time.NewTicker(time.Minute)
+	started := time.Now()
+	last := started
+	var reported int64
+
+	for {
+		select {
+		case now := <-ticker.C:
+			factor := configuration.RateFactor
+			if bursting(configuration, now.Sub(started)) {
+				factor = factor * configuration.BurstFactor
+			}
+			sim.step(now.Sub(last).Seconds(), factor, now, server.Send)
+			last = now
+
+		case <-report.C:
+			log.Info(sim.lines-reported, " lines in the last minute, ", server.Clients(), " clients, ",
+				server.Dropped(), " lines dropped")
+			reported = sim.lines
+
+		case sig := <-signals:
+			log.Info("Signal received: ", sig)
+			server.Close()
+			log.Info("Generator stopped after ", sim.lines, " lines")
+			return
+		}
+	}
+}
+
+// Bursts of BurstDuration seconds every BurstInterval seconds
+func bursting(configuration Configuration, elapsed time.Duration) bool {
+	if configuration.BurstInterval == 0 {
+		return false
+	}
+	interval := time.Duration(configuration.BurstInterval) * time.Second
+	return elapsed%interval >= interval-time.Duration(configuration.BurstDuration)*time.Second
+}
@@ -0,0 +1,264 @@
+// ----------------------------------------------------------------------------
+// Simulated traffic
+// Aircraft flying around the center point and the SBS lines they produce
+// Contact: Hugo Cruz - hugo.m.cruz@gmail.com
+// ----------------------------------------------------------------------------
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hugomcruz/dump1090-mqtt/internal/sbs"
+)
+
+// Meters per degree of latitude
+const metersPerDegree = 111320.0
+
+// Messages per second of an aircraft by transmission type, close to what
+// dump1090 reports for an aircraft at a good range. MSG,2 replaces MSG,3
+// for the aircraft on the ground.
+var messageRates = [9]float64{0, 0.2, 1.0, 1.0, 1.0, 0.7, 0.2, 0.5, 1.0}
+
+// Airline prefixes of the callsigns
+var airlines = []string{"VJC", "HVN", "PIC", "SIA", "CPA", "THA", "AXM", "UAE", "QTR", "KAL"}
+
+// Simulated aircraft
+type aircraft struct {
+	hexIdent     string
+	callsign     string
+	squawk       string
+	latitude     float64
+	longitude    float64
+	altitude     float64
+	targetAlt    float64
+	speed        float64
+	track        float64
+	turnRate     float64
+	verticalRate float64
+	onGround     bool
+}
+
+// Aircraft around the center and the random source of the simulation
+type traffic struct {
+	config   Configuration
+	random   *rand.Rand
+	aircraft []*aircraft
+	lines    int64
+}
+
+func newTraffic(config Configuration, seed int64) *traffic {
+	t := &traffic{config: config, random: rand.New(rand.NewSource(seed))}
+	for i := 0; i < config.Aircraft; i++ {
+		t.aircraft = append(t.aircraft, t.newAircraft(true))
+	}
+	return t
+}
+
+// New aircraft inside the radius. Aircraft created later enter at the border.
+func (t *traffic) newAircraft(anywhere bool) *aircraft {
+	r := t.random
+	a := &aircraft{
+		hexIdent: fmt.Sprintf("%06X", r.Intn(0xFFFFFF)),
+		callsign: airlines[r.Intn(len(airlines))] + strconv.Itoa(100+r.Intn(9900)),
+		squawk:   fmt.Sprintf("%04o", r.Intn(07777)),
+		track:    r.Float64() * 360,
+	}
+
+	distance := t.config.Radius * 1000
+	if anywhere {
+		distance = distance * math.Sqrt(r.Float64())
+	}
+	bearing := r.Float64() * 360
+	a.latitude, a.longitude = move(t.config.CenterLatitude, t.config.CenterLongitude, bearing, distance)
+
+	if r.Float64() < t.config.GroundRatio {
+		a.onGround = true
+		a.speed = 5 + r.Float64()*20
+		a.turnRate = (r.Float64() - 0.5) * 10
+		return a
+	}
+
+	a.altitude = float64(1000 + r.Intn(40)*1000)
+	a.targetAlt = a.altitude
+	a.speed = 180 + r.Float64()*320
+	if !anywhere {
+		// Entering aircraft fly towards the center
+		a.track = math.Mod(bearing+180+(r.Float64()-0.5)*60, 360)
+	}
+	return a
+}
+
+// Point at a distance (meters) and bearing (degrees) of a position
+func move(latitude float64, longitude float64, bearing float64, distance float64) (float64, float64) {
+	rad := bearing * math.Pi / 180
+	latitude += distance * math.Cos(rad) / metersPerDegree
+	longitude += distance * math.Sin(rad) / (metersPerDegree * math.Cos(latitude*math.Pi/180))
+	return latitude, longitude
+}
+
+// Distance in meters between two close positions
+func distance(lat1 float64, lon1 float64, lat2 float64, lon2 float64) float64 {
+	dy := (lat2 - lat1) * metersPerDegree
+	dx := (lon2 - lon1) * metersPerDegree * math.Cos(lat1*math.Pi/180)
+	return math.Sqrt(dx*dx + dy*dy)
+}
+
+// Move the aircraft for dt seconds. Aircraft out of the radius are replaced
+// by new ones, announced with AIR and ID lines.
+func (t *traffic) step(dt float64, factor float64, now time.Time, send func(string)) {
+	r := t.random
+
+	for i, a := range t.aircraft {
+		a.track = math.Mod(a.track+a.turnRate*dt+360, 360)
+		a.latitude, a.longitude = move(a.latitude, a.longitude, a.track, a.speed*1852/3600*dt)
+
+		if !a.onGround {
+			// Turns and altitude changes from time to time
+			if r.Float64() < 0.02*dt {
+				a.turnRate = (r.Float64() - 0.5) * 6
+			}
+			if r.Float64() < 0.01*dt {
+				a.targetAlt = float64(1000 + r.Intn(40)*1000)
+			}
+			switch {
+			case a.targetAlt > a.altitude+50:
+				a.verticalRate = 1500
+			case a.targetAlt < a.altitude-50:
+				a.verticalRate = -1500
+			default:
+				a.verticalRate = 0
+			}
+			a.altitude += a.verticalRate / 60 * dt
+		}
+
+		if distance(t.config.CenterLatitude, t.config.CenterLongitude, a.latitude, a.longitude) > t.config.Radius*1000 {
+			a = t.newAircraft(false)
+			t.aircraft[i] = a
+			t.emit(send, t.airLine(a, now))
+			t.emit(send, t.idLine(a, now))
+		}
+
+		for msgType := 1; msgType < len(messageRates); msgType++ {
+			if msgType == 2 && !a.onGround || msgType == 3 && a.onGround {
+				continue
+			}
+			if r.Float64() < messageRates[msgType]*factor*dt {
+				t.emit(send, t.msgLine(a, msgType, now))
+			}
+		}
+	}
+}
+
+// Send a line, malformed with the configured probability
+func (t *traffic) emit(send func(string), line string) {
+	if t.random.Float64() < t.config.MalformedRatio {
+		line = t.malform(line)
+	}
+	t.lines++
+	send(line)
+}
+
+// Damage a line the way broken connections and buggy feeders do
+func (t *traffic) malform(line string) string {
+	r := t.random
+	fields := strings.Split(line, ",")
+
+	switch r.Intn(6) {
+	case 0:
+		// Truncated
+		return line[:r.Intn(len(line))]
+	case 1:
+		// Missing fields
+		return strings.Join(fields[:r.Intn(len(fields))], ",")
+	case 2:
+		// Unknown message type
+		fields[0] = "XYZ"
+	case 3:
+		// Invalid numbers
+		if len(fields) > 15 {
+			fields[11] = "abc"
+			fields[14] = "9x.1"
+		} else {
+			fields[6] = "2020-13-45"
+		}
+	case 4:
+		// Binary garbage
+		garbage := make([]byte, 1+r.Intn(40))
+		r.Read(garbage)
+		return string(garbage)
+	default:
+		// Two lines glued together
+		return line + line
+	}
+	return strings.Join(fields, ",")
+}
+
+// Common fields: type, transmission, session, aircraft ID, hex, flight ID and times
+func header(messageType string, transmission string, a *aircraft, now time.Time) string {
+	date, clock := sbs.Timestamp(now.UTC())
+	return messageType + "," + transmission + ",1,1," + a.hexIdent + ",1," + date + "," + clock + "," + date + "," + clock
+}
+
+func (t *traffic) airLine(a *aircraft, now time.Time) string {
+	return header("AIR", "", a, now)
+}
+
+func (t *traffic) idLine(a *aircraft, now time.Time) string {
+	return header("ID", "", a, now) + "," + a.callsign
+}
+
+// MSG line with the fields of its transmission type, the others empty
+func (t *traffic) msgLine(a *aircraft, msgType int, now time.Time) string {
+	fields := make([]string, 12)
+	ground := "0"
+	if a.onGround {
+		ground = "-1"
+	}
+	altitude := strconv.Itoa(int(a.altitude/25) * 25)
+	position := func() {
+		fields[4] = strconv.FormatFloat(a.latitude, 'f', 5, 64)
+		fields[5] = strconv.FormatFloat(a.longitude, 'f', 5, 64)
+	}
+	velocity := func() {
+		fields[2] = strconv.Itoa(int(a.speed))
+		fields[3] = strconv.Itoa(int(a.track))
+	}
+
+	// Fields from the callsign (index 0) to the ground flag (index 11)
+	switch msgType {
+	case 1:
+		fields[0] = a.callsign
+	case 2:
+		fields[1] = "0"
+		velocity()
+		position()
+		fields[11] = ground
+	case 3:
+		fields[1] = altitude
+		position()
+		fields[8], fields[9], fields[10], fields[11] = "0", "0", "0", ground
+	case 4:
+		velocity()
+		fields[6] = strconv.Itoa(int(a.verticalRate))
+	case 5:
+		fields[1] = altitude
+		fields[8], fields[10], fields[11] = "0", "0", ground
+	case 6:
+		fields[1] = altitude
+		fields[7] = a.squawk
+		fields[8], fields[9], fields[10], fields[11] = "0", "0", "0", ground
+	case 7:
+		fields[1] = altitude
+		fields[11] = ground
+	case 8:
+		fields[11] = ground
+	}
+
+	return header("MSG", strconv.Itoa(msgType), a, now) + "," + strings.Join(fields, ",")
+}
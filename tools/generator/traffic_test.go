@@ -0,0 +1,95 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hugomcruz/dump1090-mqtt/internal/sbs"
+)
+
+// Lines of a simulation of a minute, with the ground and the replaced aircraft
+func simulate(malformedRatio float64) []string {
+	config := Configuration{Aircraft: 20, CenterLatitude: 10.8188, CenterLongitude: 106.652, Radius: 20,
+		GroundRatio: 0.2, RateFactor: 1, MalformedRatio: malformedRatio}
+	sim := newTraffic(config, 42)
+
+	lines := make([]string, 0)
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 600; i++ {
+		now = now.Add(stepInterval)
+		sim.step(stepInterval.Seconds(), 1, now, func(line string) { lines = append(lines, line) })
+	}
+	return lines
+}
+
+// Fields of each message type, as read by the publisher
+var fieldCounts = map[string]int{"AIR": 10, "ID": 11, "MSG": 22}
+
+func TestLinesAreSBS(t *testing.T) {
+	lines := simulate(0)
+	if len(lines) < 1000 {
+		t.Fatalf("%d lines in a minute for 20 aircraft", len(lines))
+	}
+
+	seen := make(map[string]int)
+	for _, line := range lines {
+		fields := strings.Split(line, ",")
+		if want, ok := fieldCounts[fields[0]]; !ok || len(fields) != want {
+			t.Fatalf("%q: %d fields for type %s", line, len(fields), fields[0])
+		}
+		if _, ok := sbs.LineTime(line); !ok {
+			t.Errorf("%q: invalid date and time", line)
+		}
+		if len(fields[4]) != 6 {
+			t.Errorf("%q: hex ident %q", line, fields[4])
+		}
+
+		seen[fields[0]+fields[1]]++
+		if fields[0] != "MSG" {
+			continue
+		}
+
+		// Numbers where the transmission type has them
+		for _, i := range []int{11, 12, 13, 14, 15, 16} {
+			if fields[i] == "" {
+				continue
+			}
+			if _, err := strconv.ParseFloat(fields[i], 64); err != nil {
+				t.Errorf("%q: field %d is not a number", line, i+1)
+			}
+		}
+		if fields[14] != "" {
+			latitude, _ := strconv.ParseFloat(fields[14], 64)
+			longitude, _ := strconv.ParseFloat(fields[15], 64)
+			if distance(10.8188, 106.652, latitude, longitude) > 25000 {
+				t.Errorf("%q: position out of the radius", line)
+			}
+		}
+	}
+
+	for _, kind := range []string{"AIR", "ID", "MSG1", "MSG2", "MSG3", "MSG4", "MSG5", "MSG6", "MSG7", "MSG8"} {
+		if seen[kind] == 0 {
+			t.Errorf("no %s line in %v", kind, seen)
+		}
+	}
+}
+
+func TestMalformedLines(t *testing.T) {
+	lines := simulate(1)
+
+	valid := 0
+	for _, line := range lines {
+		fields := strings.Split(line, ",")
+		if want, ok := fieldCounts[fields[0]]; ok && len(fields) == want {
+			if _, ok := sbs.LineTime(line); ok {
+				valid++
+			}
+		}
+	}
+	// Only the invalid numbers keep the fields and the time
+	if valid > len(lines)/4 {
+		t.Errorf("%d of %d lines still valid with MalformedRatio 1", valid, len(lines))
+	}
+}
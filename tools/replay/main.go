@@ -0,0 +1,198 @@
+// ----------------------------------------------------------------------------
+// Dump1090 replay server
+// Serves a recorded SBS capture like the port 30003 of dump1090: real time,
+// accelerated or as fast as possible, with the times rewritten and in a loop
+// Contact: Hugo Cruz - hugo.m.cruz@gmail.com
+// ----------------------------------------------------------------------------
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/hugomcruz/dump1090-mqtt/internal/config"
+	"github.com/hugomcruz/dump1090-mqtt/internal/sbs"
+	log "github.com/sirupsen/logrus"
+)
+
+//Configuration Data
+type Configuration struct {
+	Listen            string  `default:":30003"`
+	File              string  `validate:"required"`
+	Speed             float64 `default:"1" validate:"min=0.01"`
+	AsFastAsPossible  bool
+	RewriteTimestamps bool
+	Loop              bool
+	QueueSize         int    `default:"10000" validate:"min=1"`
+	LogLevel          string `default:"INFO" validate:"oneof=DEBUG INFO WARN ERROR"`
+}
+
+// Lines sent and passes over the capture, updated by the replay and read by the stats log
+var linesSent int64
+var passes int64
+
+func main() {
+
+	// Setup the logger. The level is set once the configuration is read.
+	config.SetupLogging("")
+
+	configPath := config.PathFlag()
+	flag.Parse()
+
+	log.Info(">>>>>>>>>> STARTING the Dump1090 Replay Server <<<<<<<<<<<<<")
+
+	// Read the configuration, the environment overrides it
+	configuration := Configuration{}
+	err := config.Load(*configPath, "REPLAY", &configuration)
+	if err != nil {
+		log.Error("Error reading configuration: ", err.Error())
+		os.Exit(1)
+	}
+	config.SetLogLevel(configuration.LogLevel)
+
+	// Check the capture before accepting clients. Stdin can only be read once.
+	if configuration.File == "-" {
+		if configuration.Loop {
+			log.Error("Loop is not possible when reading the capture from stdin")
+			os.Exit(1)
+		}
+	} else {
+		_, file, err := sbs.Open(configuration.File)
+		if err != nil {
+			log.Error("Error opening the capture: ", err.Error())
+			os.Exit(1)
+		}
+		file.Close()
+	}
+
+	// Every client receives every line, the replay waits for the slowest one
+	server, err := sbs.Listen(configuration.Listen, configuration.QueueSize, true)
+	if err != nil {
+		log.Error("Error listening on ", configuration.Listen, ": ", err.Error())
+		os.Exit(1)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	quit := make(chan bool)
+	finished := make(chan bool)
+	go func() {
+		replay(configuration, server, quit)
+		close(finished)
+	}()
+
+	report := time.NewTicker(time.Minute)
+	var reported int64
+
+	for {
+		select {
+		case <-report.C:
+			sent := atomic.LoadInt64(&linesSent)
+			log.Info(sent-reported, " lines in the last minute, ", server.Clients(), " clients, pass ",
+				atomic.LoadInt64(&passes))
+			reported = sent
+
+		case <-finished:
+			server.Drain(10 * time.Second)
+			server.Close()
+			log.Info("Replay finished after ", atomic.LoadInt64(&linesSent), " lines")
+			return
+
+		case sig := <-signals:
+			log.Info("Signal received: ", sig)
+			close(quit)
+			// Closed first, a client that stopped reading would block the replay
+			server.Close()
+			<-finished
+			log.Info("Replay stopped after ", atomic.LoadInt64(&linesSent), " lines")
+			return
+		}
+	}
+}
+
+// Send the capture once, or until stopped with Loop. The replay starts when
+// the first client connects, so that it receives the capture from the start.
+func replay(configuration Configuration, server *sbs.Server, quit chan bool) {
+	log.Info("Waiting for a client")
+	for server.Clients() == 0 {
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-quit:
+			return
+		}
+	}
+
+	for {
+		// Short captures loop many times a second when not paced
+		pass := atomic.AddInt64(&passes, 1)
+		if pass == 1 {
+			log.Info("Replaying ", configuration.File)
+		} else {
+			log.Debug("Replaying ", configuration.File, " (pass ", pass, ")")
+		}
+		if !replayFile(configuration, server, quit) || !configuration.Loop {
+			return
+		}
+	}
+}
+
+// Send the lines of the capture paced by their time. Returns false when stopped.
+func replayFile(configuration Configuration, server *sbs.Server, quit chan bool) bool {
+	reader, file, err := sbs.Open(configuration.File)
+	if err != nil {
+		log.Error("Error opening the capture: ", err.Error())
+		return false
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(reader)
+	var first time.Time
+	var start time.Time
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		// Wait until the time of the line relative to the first one
+		if !configuration.AsFastAsPossible {
+			if t, ok := sbs.LineTime(line); ok {
+				if first.IsZero() || t.Before(first) {
+					first = t
+					start = time.Now()
+				}
+				wait := time.Duration(float64(t.Sub(first))/configuration.Speed) - time.Since(start)
+				if wait > 0 {
+					select {
+					case <-time.After(wait):
+					case <-quit:
+						return false
+					}
+				}
+			}
+		}
+
+		select {
+		case <-quit:
+			return false
+		default:
+		}
+
+		if configuration.RewriteTimestamps {
+			line = sbs.Rewrite(line, time.Now().UTC())
+		}
+		server.Send(line)
+		atomic.AddInt64(&linesSent, 1)
+	}
+
+	if err := scanner.Err(); err != nil {
+		log.Error("Error reading the capture: ", err.Error())
+		return false
+	}
+	return true
+}